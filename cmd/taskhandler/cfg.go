@@ -63,4 +63,48 @@ func SetConfig() {
 
 func setDefaults() {
 	viper.SetDefault("healthprobe.modelName", "__TFSERVINGCACHE_PROBE_CHECK__")
+	viper.SetDefault("modelCache.policy", "lru")
+	viper.SetDefault("modelCache.accessTimeFlushInterval", 60)
+	viper.SetDefault("modelProvider.versionCacheTTL", 10)
+	viper.SetDefault("modelProvider.http.timeout", 30)
+	viper.SetDefault("modelProvider.oci.insecure", false)
+	viper.SetDefault("modelProvider.archive.maxSize", 0)
+	viper.SetDefault("modelProvider.archive.maxEntries", 100000)
+	viper.SetDefault("serving.modelLoadTimeout", 10)
+	viper.SetDefault("admin.token", "")
+	viper.SetDefault("proxy.adminTimeout", 60)
+	viper.SetDefault("proxy.rest.timeout", 0)
+	viper.SetDefault("proxy.rest.responseHeaderTimeout", 0)
+	viper.SetDefault("proxy.rest.bodyTimeout", 0)
+	viper.SetDefault("proxy.replicas.dynamic", false)
+	viper.SetDefault("proxy.replicas.min", 1)
+	viper.SetDefault("proxy.replicas.max", 8)
+	viper.SetDefault("proxy.replicas.targetRequestRate", 10)
+	viper.SetDefault("proxy.replicas.interval", 10)
+	viper.SetDefault("proxy.replicas.scaleUpDelay", 30)
+	viper.SetDefault("proxy.replicas.scaleDownDelay", 60)
+	viper.SetDefault("proxy.hashRing.type", "consistent")
+	viper.SetDefault("proxy.hashRing.loadFactor", 1.25)
+	viper.SetDefault("proxy.hashRing.virtualNodes", 100)
+	viper.SetDefault("proxy.hashRing.weightByCapacity", true)
+	viper.SetDefault("proxy.selection.strategy", "random")
+	viper.SetDefault("proxy.selection.statusInterval", 5)
+	viper.SetDefault("proxy.zones.preferLocal", true)
+	viper.SetDefault("proxy.zones.spreadReplicas", false)
+	viper.SetDefault("proxy.zones.failureCooldown", 10)
+	viper.SetDefault("shutdown.drainPeriod", 10)
+	viper.SetDefault("shutdown.timeout", 30)
+	viper.SetDefault("healthCheck.interval", 10)
+	viper.SetDefault("serviceDiscovery.dns.recordType", "A")
+	viper.SetDefault("serviceDiscovery.dns.interval", 5)
+	viper.SetDefault("serviceDiscovery.dns.timeout", 5)
+	viper.SetDefault("serviceDiscovery.k8s.resyncInterval", 30)
+	viper.SetDefault("serviceDiscovery.gossip.bindAddr", "0.0.0.0")
+	viper.SetDefault("serviceDiscovery.gossip.bindPort", 7946)
+	viper.SetDefault("serviceDiscovery.gossip.failureTimeout", 5)
+	viper.SetDefault("proxy.retries.maxAttempts", 3)
+	viper.SetDefault("proxy.retries.perAttemptTimeout", 0)
+	viper.SetDefault("proxy.retries.maxBodySize", 4*1024*1024)
+	viper.SetDefault("proxy.retries.budget.ratio", 0.2)
+	viper.SetDefault("proxy.retries.budget.maxTokens", 10)
 }
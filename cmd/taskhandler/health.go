@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthStatus is the result of the latest health check of the node
+type healthStatus struct {
+	mux     sync.RWMutex
+	healthy bool
+	reason  error
+}
+
+var nodeHealth = &healthStatus{reason: errors.New("Health has not been checked yet")}
+
+// set stores the result of a health check and logs when the health changes
+func (status *healthStatus) set(healthy bool, reason error) {
+	status.mux.Lock()
+	defer status.mux.Unlock()
+	if healthy && !status.healthy {
+		log.Info("Node is healthy")
+	} else if !healthy && (status.healthy || errorString(reason) != errorString(status.reason)) {
+		log.WithError(reason).Warn("Node is unhealthy")
+	}
+	status.healthy = healthy
+	status.reason = reason
+	if !healthy && reason == nil {
+		status.reason = errors.New("Health check failed")
+	}
+}
+
+func (status *healthStatus) get() (bool, error) {
+	status.mux.RLock()
+	defer status.mux.RUnlock()
+	if status.healthy {
+		return true, nil
+	}
+	return false, status.reason
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// isHealthy reports whether the node is ready to receive requests, and why not
+func isHealthy() (bool, error) {
+	if draining.Load() {
+		return false, errors.New("Node is shutting down")
+	}
+	return nodeHealth.get()
+}
+
+// serveLiveness responds OK as long as the process is able to serve requests
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// serveReadiness responds OK if the node is healthy, and otherwise responds
+// 503 Service Unavailable with the reason
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if healthy, err := isHealthy(); !healthy {
+		http.Error(w, errorString(err), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
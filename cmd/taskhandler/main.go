@@ -1,48 +1,142 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/azblobmodelprovider"
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/diskmodelprovider"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/gcsmodelprovider"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/httpmodelprovider"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/ocimodelprovider"
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/s3modelprovider"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/consul"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/dns"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/etcd"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/gossip"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/kubernetes"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/static"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 )
 
+// draining is set when the node is shutting down, such that it reports itself as unhealthy
+var draining atomic.Bool
+
 func main() {
 
 	SetConfig()
 
-	cache := serveCache()
-	defer cache.GrpcProxy.Close()
+	cache, cacheServer := serveCache()
+	// Check the health before joining the cluster, such that discovery reports the actual health
+	nodeHealth.set(cache.IsHealthy())
 
-	taskHandler, err := serveProxy()
+	taskHandler, proxyServer, err := serveProxy(cache)
 	if err != nil {
 		log.WithError(err).Fatal("Could not start proxy")
 	}
-	if taskHandler != nil {
-		defer taskHandler.Close()
-	}
-	// Run health checks
-	for {
-		isHealthy := cache.IsHealthy()
+	setHealth := func(isHealthy bool) {
 		cache.GrpcProxy.SetHealth(isHealthy)
 		if taskHandler != nil {
 			taskHandler.GrpcProxy.SetHealth(isHealthy)
 		}
-		time.Sleep(time.Second * 30)
+	}
+
+	// Run health checks
+	go func() {
+		interval := viper.GetDuration("healthCheck.interval") * time.Second
+		for !draining.Load() {
+			isHealthy, err := cache.IsHealthy()
+			if !draining.Load() {
+				nodeHealth.set(isHealthy, err)
+				setHealth(isHealthy)
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Received %s. Shutting down", sig)
+	drain(cache, cacheServer, taskHandler, proxyServer, setHealth)
+}
+
+// drain shuts down the node gracefully: It reports itself as unhealthy, leaves
+// the cluster, waits shutdown.drainPeriod seconds for the other nodes to stop
+// routing requests to it, waits for the pending requests to finish, and
+// finally closes the connections to TF Serving.
+func drain(cache *cachemanager.CacheManager, cacheServer *http.Server, taskHandler *taskhandler.TaskHandler, proxyServer *http.Server, setHealth func(bool)) {
+	draining.Store(true)
+	setHealth(false)
+	if taskHandler != nil {
+		if err := taskHandler.DisconnectFromCluster(); err != nil {
+			log.WithError(err).Error("Could not leave cluster")
+		}
+	}
+
+	drainPeriod := viper.GetDuration("shutdown.drainPeriod") * time.Second
+	log.Infof("Draining for %v", drainPeriod)
+	time.Sleep(drainPeriod)
+
+	ctx := context.Background()
+	if timeout := viper.GetDuration("shutdown.timeout") * time.Second; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// The proxy is stopped first, since its pending requests may be waiting for the cache
+	if proxyServer != nil {
+		if err := proxyServer.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("Could not stop proxy REST server gracefully")
+		}
+	}
+	if taskHandler != nil {
+		if err := taskHandler.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("Could not stop proxy gracefully")
+		}
+	}
+	if err := cacheServer.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("Could not stop cache REST server gracefully")
+	}
+	if err := cache.GrpcProxy.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("Could not stop cache grpc server gracefully")
+	}
+	if err := cache.Close(); err != nil {
+		log.WithError(err).Error("Could not close TF Serving connections")
+	}
+	log.Info("Shut down")
+}
+
+// listenAndServe serves HTTP requests with server until it is shut down
+func listenAndServe(server *http.Server) {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithError(err).Fatalf("Could not serve HTTP at %s", server.Addr)
+	}
+}
+
+// listenGrpc serves grpc requests with proxy until it is shut down
+func listenGrpc(proxy *tfservingproxy.GrpcProxy, port int) {
+	if err := proxy.Listen(port); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		log.WithError(err).Fatalf("Could not serve grpc at port %d", port)
 	}
 }
 
-func serveCache() *cachemanager.CacheManager {
+func serveCache() (*cachemanager.CacheManager, *http.Server) {
 
 	var (
 		restPort = viper.GetInt("cacheRestPort")
@@ -53,17 +147,37 @@ func serveCache() *cachemanager.CacheManager {
 
 	cache := CreateCacheManager()
 
+	var pinnedModels []cachemanager.PinnedModel
+	err := viper.UnmarshalKey("modelCache.pinned", &pinnedModels)
+	if err != nil {
+		log.WithError(err).Fatal("Could not read pinned models")
+	}
+	var versionLabels []cachemanager.VersionLabel
+	err = viper.UnmarshalKey("modelProvider.versionLabels", &versionLabels)
+	if err != nil {
+		log.WithError(err).Fatal("Could not read version labels")
+	}
+	cache.VersionResolver.SetVersionLabels(versionLabels)
+	cache.LoadPinnedModels(pinnedModels)
+	go cache.RunModelExpiry()
+	go cache.RunAccessTimeFlush()
+
 	cacheMux := http.NewServeMux()
 
 	cacheMux.HandleFunc("/v1/models/", cache.ServeRest())
-	go http.ListenAndServe(fmt.Sprintf(":%d", restPort), cacheMux)
+	cacheMux.HandleFunc("/admin/models", cache.ServeAdmin())
+	cacheMux.HandleFunc("/admin/models/", cache.ServeAdmin())
+	cacheMux.HandleFunc("/healthz", serveLiveness)
+	cacheMux.HandleFunc("/readyz", serveReadiness)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", restPort), Handler: cacheMux}
+	go listenAndServe(server)
 
-	go cache.GrpcProxy.Listen(grpcPort)
+	go listenGrpc(cache.GrpcProxy, grpcPort)
 
-	return cache
+	return cache, server
 }
 
-func serveProxy() (*taskhandler.TaskHandler, error) {
+func serveProxy(cache *cachemanager.CacheManager) (*taskhandler.TaskHandler, *http.Server, error) {
 
 	var (
 		restPort = viper.GetInt("proxyRestPort")
@@ -87,16 +201,18 @@ func serveProxy() (*taskhandler.TaskHandler, error) {
 	var tHandler *taskhandler.TaskHandler
 	if dService != nil {
 
-		tHandler = taskhandler.NewTaskHandler(dService)
+		tHandler = taskhandler.NewTaskHandler(dService, cache.VersionResolver)
 		err := tHandler.ConnectToCluster()
 		if err != nil {
 			log.WithError(err).Fatal("Could not connect to cluster")
-			return nil, err
+			return nil, nil, err
 		}
 
-		go tHandler.GrpcProxy.Listen(grpcPort)
+		go listenGrpc(tHandler.GrpcProxy, grpcPort)
 
 		proxyMux.HandleFunc("/v1/models/", tHandler.ServeRest())
+		proxyMux.HandleFunc("/admin/cluster/models/", tHandler.ServeAdmin())
+		proxyMux.HandleFunc("/admin/cluster/replicas", tHandler.ServeReplicas())
 
 		log.Infof("Proxy is ready to handle requests at rest:%v and grpc:%v", restPort, grpcPort)
 
@@ -104,26 +220,54 @@ func serveProxy() (*taskhandler.TaskHandler, error) {
 		log.Info("Proxy is disabled")
 	}
 
+	proxyMux.HandleFunc("/healthz", serveLiveness)
+	proxyMux.HandleFunc("/readyz", serveReadiness)
 	proxyMux.Handle(metricsPath, taskhandler.MetricsHandler(servingRestHost, servingMetricsPath, metricsTimeout))
 
 	log.Infof("Metrics are available at %v:%v", restPort, metricsPath)
 
-	go http.ListenAndServe(fmt.Sprintf(":%d", restPort), proxyMux)
-	return tHandler, nil
+	server := &http.Server{Addr: fmt.Sprintf(":%d", restPort), Handler: proxyMux}
+	go listenAndServe(server)
+	return tHandler, server, nil
 }
 
 func CreateCacheManager() *cachemanager.CacheManager {
 	provider := CreateModelProvider()
-	modelCache := cachemanager.NewLRUCache(viper.GetString("modelCache.hostModelPath"), viper.GetInt64("modelCache.size"))
-	c := cachemanager.New(provider, &modelCache,
+	modelCache := CreateModelCache()
+	c := cachemanager.New(provider, modelCache,
 		viper.GetString("serving.servingModelPath"),
 		viper.GetString("serving.grpcHost"),
 		viper.GetString("serving.restHost"),
-		10.0,
+		float32(viper.GetFloat64("serving.modelLoadTimeout")),
 		viper.GetInt("serving.maxConcurrentModels"))
 	return c
 }
 
+func CreateModelCache() cachemanager.ModelCache {
+	var (
+		hostModelPath = viper.GetString("modelCache.hostModelPath")
+		size          = viper.GetInt64("modelCache.size")
+	)
+
+	switch viper.GetString("modelCache.policy") {
+	case "lru":
+		return cachemanager.NewLRUCache(hostModelPath, size)
+	case "lfu":
+		return cachemanager.NewLFUCache(hostModelPath, size)
+	case "gdsf":
+		return cachemanager.NewGDSFCache(hostModelPath, size)
+	case "ttl":
+		ttl := viper.GetDuration("modelCache.ttl") * time.Second
+		if ttl <= 0 {
+			log.Fatalf("modelCache.ttl must be positive when using the ttl policy, but was: %s", viper.GetString("modelCache.ttl"))
+		}
+		return cachemanager.NewTTLCache(hostModelPath, size, ttl)
+	default:
+		log.Fatalf("Unsupported modelCache policy: %s", viper.GetString("modelCache.policy"))
+	}
+	return nil
+}
+
 func CreateDiscoveryService() taskhandler.DiscoveryService {
 
 	var dService taskhandler.DiscoveryService = nil
@@ -137,6 +281,14 @@ func CreateDiscoveryService() taskhandler.DiscoveryService {
 			dService, err = etcd.NewDiscoveryService(isHealthy)
 		case "k8s":
 			dService, err = kubernetes.NewDiscoveryService()
+		case "dns":
+			dService, err = dns.NewDiscoveryService()
+		case "gossip":
+			dService, err = gossip.NewDiscoveryService()
+		case "static":
+			dService, err = static.NewDiscoveryService()
+		case "file":
+			dService, err = static.NewFileDiscoveryService(viper.GetString("serviceDiscovery.file.path"))
 		default:
 			log.Fatalf("Unsupported discoveryService: %s", viper.GetString("serviceDiscovery.type"))
 		}
@@ -153,29 +305,98 @@ func CreateModelProvider() cachemanager.ModelProvider {
 	var mProvider cachemanager.ModelProvider = nil
 	var err error = nil
 
+	// Archives may not expand to more than the model cache can hold
+	archiveLimits := archive.Limits{
+		MaxSize:    viper.GetInt64("modelProvider.archive.maxSize"),
+		MaxEntries: viper.GetInt("modelProvider.archive.maxEntries"),
+	}
+	if archiveLimits.MaxSize <= 0 {
+		archiveLimits.MaxSize = viper.GetInt64("modelCache.size")
+	}
+
 	switch viper.GetString("modelProvider.type") {
 	case "diskProvider":
 		mProvider = diskmodelprovider.DiskModelProvider{
-			BaseDir: viper.GetString("modelProvider.diskProvider.baseDir"),
+			BaseDir:       viper.GetString("modelProvider.diskProvider.baseDir"),
+			ArchiveLimits: archiveLimits,
 		}
 	case "s3Provider":
-		mProvider, err = s3modelprovider.NewS3ModelProvider(
+		var provider *s3modelprovider.S3ModelProvider
+		provider, err = s3modelprovider.NewS3ModelProvider(
 			viper.GetString("modelProvider.s3.bucket"),
 			viper.GetString("modelProvider.s3.basePath"))
+		if err == nil {
+			provider.ArchiveLimits = archiveLimits
+			mProvider = provider
+		}
+	case "gcsProvider":
+		var opts []option.ClientOption
+		if credentialsFile := viper.GetString("modelProvider.gcs.credentialsFile"); credentialsFile != "" {
+			opts = append(opts, option.WithCredentialsFile(credentialsFile))
+		}
+		if endpoint := viper.GetString("modelProvider.gcs.endpoint"); endpoint != "" {
+			opts = append(opts, option.WithEndpoint(endpoint))
+		}
+		var provider *gcsmodelprovider.GCSModelProvider
+		provider, err = gcsmodelprovider.NewGCSModelProvider(
+			viper.GetString("modelProvider.gcs.bucket"),
+			viper.GetString("modelProvider.gcs.basePath"),
+			opts...)
+		if err == nil {
+			provider.ArchiveLimits = archiveLimits
+			mProvider = provider
+		}
+	case "httpProvider":
+		var provider *httpmodelprovider.HTTPModelProvider
+		provider, err = httpmodelprovider.NewHTTPModelProvider(
+			viper.GetString("modelProvider.http.url"),
+			viper.GetDuration("modelProvider.http.timeout")*time.Second)
+		if err == nil {
+			provider.VersionsURLTemplate = viper.GetString("modelProvider.http.versionsUrl")
+			provider.CheckURL = viper.GetString("modelProvider.http.checkUrl")
+			provider.Format = archive.Format(viper.GetString("modelProvider.http.format"))
+			provider.BearerToken = viper.GetString("modelProvider.http.bearerToken")
+			provider.Username = viper.GetString("modelProvider.http.username")
+			provider.Password = viper.GetString("modelProvider.http.password")
+			provider.ArchiveLimits = archiveLimits
+			mProvider = provider
+		}
+	case "ociProvider":
+		// Without credentials, the Docker config file is used, e.g. from docker login
+		var auth authn.Authenticator
+		if token := viper.GetString("modelProvider.oci.bearerToken"); token != "" {
+			auth = &authn.Bearer{Token: token}
+		} else if username := viper.GetString("modelProvider.oci.username"); username != "" {
+			auth = &authn.Basic{Username: username, Password: viper.GetString("modelProvider.oci.password")}
+		}
+		var provider *ocimodelprovider.OCIModelProvider
+		provider, err = ocimodelprovider.NewOCIModelProvider(
+			viper.GetString("modelProvider.oci.repository"),
+			auth,
+			viper.GetBool("modelProvider.oci.insecure"))
+		if err == nil {
+			provider.ArchiveLimits = archiveLimits
+			mProvider = provider
+		}
 	case "azBlobProvider":
+		var provider *azblobmodelprovider.AZBlobModelProvider
 		if viper.IsSet("modelProvider.azBlob.containerUrl") {
-			mProvider, err = azblobmodelprovider.NewAZBlobModelProviderWithUrl(
+			provider, err = azblobmodelprovider.NewAZBlobModelProviderWithUrl(
 				viper.GetString("modelProvider.azBlob.containerUrl"),
 				viper.GetString("modelProvider.azBlob.basePath"),
 				viper.GetString("modelProvider.azBlob.accountName"),
 				viper.GetString("modelProvider.azBlob.accountKey"))
 		} else {
-			mProvider, err = azblobmodelprovider.NewAZBlobModelProvider(
+			provider, err = azblobmodelprovider.NewAZBlobModelProvider(
 				viper.GetString("modelProvider.azBlob.container"),
 				viper.GetString("modelProvider.azBlob.basePath"),
 				viper.GetString("modelProvider.azBlob.accountName"),
 				viper.GetString("modelProvider.azBlob.accountKey"))
 		}
+		if err == nil {
+			provider.ArchiveLimits = archiveLimits
+			mProvider = provider
+		}
 	default:
 		log.Fatalf("Unsupported discoveryService: %s", viper.GetString("serviceDiscovery.type"))
 	}
@@ -185,8 +406,3 @@ func CreateModelProvider() cachemanager.ModelProvider {
 	}
 	return mProvider
 }
-
-func isHealthy() (bool, error) {
-	// TODO: Implement a health check. Also expose via http
-	return true, nil
-}
@@ -0,0 +1,185 @@
+package cachemanager
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var adminModelsURLMatch = regexp.MustCompile(`^/admin/models(/(?P<modelName>[^/]+)(/versions/(?P<version>[0-9]+))?)?/?$`)
+
+// ErrModelNotCached is returned when evicting a model that is not in the cache
+var ErrModelNotCached = errors.New("Model is not in the cache")
+
+// ErrModelPinned is returned when evicting a pinned model
+var ErrModelPinned = errors.New("Model is pinned")
+
+// ModelInfo describes a model in the local cache
+type ModelInfo struct {
+	Name       string
+	Version    int64
+	SizeOnDisk int64
+	// Position is the position of the model in the cache, starting
+	// from 0 for the most recently used model.
+	Position     int
+	State        string
+	LastAccessed time.Time
+	Pinned       bool
+}
+
+// ListCachedModels returns the models in the cache along with
+// their serving state, most recently used first.
+func (cache *CacheManager) ListCachedModels() []ModelInfo {
+	models := cache.LocalCache.ListModels()
+	res := make([]ModelInfo, 0, len(models))
+	for i, model := range models {
+		state := "NOT_LOADED"
+		if servingState, err := cache.ServingController.GetModelStatus(*model); err == nil {
+			state = servingState.String()
+		}
+		res = append(res, ModelInfo{
+			Name:         model.Identifier.ModelName,
+			Version:      model.Identifier.Version,
+			SizeOnDisk:   model.SizeOnDisk,
+			Position:     i,
+			State:        state,
+			LastAccessed: model.LastAccessed,
+			Pinned:       cache.isPinned(model.Identifier),
+		})
+	}
+	return res
+}
+
+// PreloadModel fetches a model into the cache and loads it in serving.
+// The load is not cancelled if the caller goes away.
+func (cache *CacheManager) PreloadModel(identifier ModelIdentifier) error {
+	return cache.fetchModel(context.Background(), identifier)
+}
+
+// EvictModel deletes a model from the cache and from disk and
+// unloads it from serving. Pinned models cannot be evicted.
+func (cache *CacheManager) EvictModel(identifier ModelIdentifier) error {
+	if cache.isPinned(identifier) {
+		return ErrModelPinned
+	}
+	// An in-flight load of the model would add the model to the cache again,
+	// so the model is evicted after the load, and new loads wait for the eviction
+	return cache.modelLoads.Exclusive(identifier, func() error {
+		if !cache.LocalCache.Remove(identifier) {
+			return ErrModelNotCached
+		}
+		log.Infof("Evicted model %s:%d", identifier.ModelName, identifier.Version)
+		return cache.updateServingConfig()
+	})
+}
+
+// ServeAdmin returns the HTTP handler function for the cache admin api:
+//
+//	GET    /admin/models                               lists the models in the cache
+//	POST   /admin/models/<model>[/versions/<version>]  loads a model, by default the latest version
+//	DELETE /admin/models/<model>/versions/<version>    evicts a model
+//
+// If an admin token is configured, requests must send it as a bearer token.
+// Otherwise, only GET requests are allowed.
+func (cache *CacheManager) ServeAdmin() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if cache.AdminToken == "" && req.Method != http.MethodGet {
+			writeAdminResponse(rw, http.StatusForbidden, "Error", "Admin token is not configured")
+			return
+		}
+		if cache.AdminToken != "" && !hasAdminToken(req, cache.AdminToken) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminResponse(rw, http.StatusUnauthorized, "Error", "Invalid admin token")
+			return
+		}
+		matches := adminModelsURLMatch.FindStringSubmatch(req.URL.Path)
+		if len(matches) == 0 {
+			writeAdminResponse(rw, http.StatusNotFound, "Error", "Not found")
+			return
+		}
+		modelName, version := matches[2], matches[4]
+		switch {
+		case req.Method == http.MethodGet && modelName == "":
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(cache.ListCachedModels())
+		case req.Method == http.MethodPost && modelName != "":
+			cache.servePreload(rw, modelName, version)
+		case req.Method == http.MethodDelete && modelName != "" && version != "":
+			cache.serveEvict(rw, modelName, version)
+		default:
+			writeAdminResponse(rw, http.StatusMethodNotAllowed, "Error", "Method not allowed")
+		}
+	}
+}
+
+func (cache *CacheManager) servePreload(rw http.ResponseWriter, modelName string, version string) {
+	var modelVersion int64
+	var err error
+	if version == "" {
+		modelVersion, err = cache.VersionResolver.LatestVersion(modelName)
+		if err != nil {
+			writeAdminResponse(rw, http.StatusNotFound, "Error", fmt.Sprintf("Could not resolve version of model: %s", modelName))
+			return
+		}
+	} else {
+		modelVersion, err = strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			writeAdminResponse(rw, http.StatusBadRequest, "Error", fmt.Sprintf("Invalid model version: %s", version))
+			return
+		}
+	}
+	identifier := ModelIdentifier{ModelName: modelName, Version: modelVersion}
+	log.Infof("Preloading model %s:%d", modelName, modelVersion)
+	err = cache.PreloadModel(identifier)
+	if err != nil {
+		log.WithError(err).Errorf("Could not preload model %s:%d", modelName, modelVersion)
+		writeAdminResponse(rw, http.StatusInternalServerError, "Error", fmt.Sprintf("Could not load model %s:%d: %v", modelName, modelVersion, err))
+		return
+	}
+	writeAdminResponse(rw, http.StatusOK, "OK", fmt.Sprintf("Loaded model %s:%d", modelName, modelVersion))
+}
+
+func (cache *CacheManager) serveEvict(rw http.ResponseWriter, modelName string, version string) {
+	modelVersion, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		writeAdminResponse(rw, http.StatusBadRequest, "Error", fmt.Sprintf("Invalid model version: %s", version))
+		return
+	}
+	err = cache.EvictModel(ModelIdentifier{ModelName: modelName, Version: modelVersion})
+	switch {
+	case err == ErrModelNotCached:
+		writeAdminResponse(rw, http.StatusNotFound, "Error", fmt.Sprintf("Model %s:%d is not in the cache", modelName, modelVersion))
+	case err == ErrModelPinned:
+		writeAdminResponse(rw, http.StatusConflict, "Error", fmt.Sprintf("Model %s:%d is pinned", modelName, modelVersion))
+	case err != nil:
+		log.WithError(err).Errorf("Could not reload serving config after evicting model %s:%d", modelName, modelVersion)
+		writeAdminResponse(rw, http.StatusInternalServerError, "Error", fmt.Sprintf("Evicted model %s:%d, but could not reload serving config: %v", modelName, modelVersion, err))
+	default:
+		writeAdminResponse(rw, http.StatusOK, "OK", fmt.Sprintf("Evicted model %s:%d", modelName, modelVersion))
+	}
+}
+
+// hasAdminToken reports whether the request has the given bearer token
+func hasAdminToken(req *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func writeAdminResponse(rw http.ResponseWriter, statusCode int, status string, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(struct {
+		Status  string
+		Message string
+	}{
+		Status:  status,
+		Message: message,
+	})
+}
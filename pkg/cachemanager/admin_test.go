@@ -0,0 +1,290 @@
+package cachemanager
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	serving "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tfServingMock is a TF Serving model service that makes
+// models available as soon as they are added to the config
+type tfServingMock struct {
+	serving.UnimplementedModelServiceServer
+	mux    sync.Mutex
+	models map[ModelIdentifier]bool
+	// loading makes models report LOADING instead of AVAILABLE until it is closed, if set
+	loading chan struct{}
+}
+
+func (server *tfServingMock) GetModelStatus(ctx context.Context, req *serving.GetModelStatusRequest) (*serving.GetModelStatusResponse, error) {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+	identifier := ModelIdentifier{ModelName: req.GetModelSpec().GetName(), Version: req.GetModelSpec().GetVersion().GetValue()}
+	if !server.models[identifier] {
+		return nil, status.Error(codes.NotFound, "Model not found")
+	}
+	state := serving.ModelVersionStatus_AVAILABLE
+	if server.loading != nil {
+		select {
+		case <-server.loading:
+		default:
+			state = serving.ModelVersionStatus_LOADING
+		}
+	}
+	return &serving.GetModelStatusResponse{
+		ModelVersionStatus: []*serving.ModelVersionStatus{{
+			Version: identifier.Version,
+			State:   state,
+		}},
+	}, nil
+}
+
+func (server *tfServingMock) HandleReloadConfigRequest(ctx context.Context, req *serving.ReloadConfigRequest) (*serving.ReloadConfigResponse, error) {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+	server.models = map[ModelIdentifier]bool{}
+	for _, config := range req.GetConfig().GetModelConfigList().GetConfig() {
+		for _, version := range config.GetModelVersionPolicy().GetSpecific().GetVersions() {
+			server.models[ModelIdentifier{ModelName: config.Name, Version: version}] = true
+		}
+	}
+	return &serving.ReloadConfigResponse{}, nil
+}
+
+func (server *tfServingMock) isServing(identifier ModelIdentifier) bool {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+	return server.models[identifier]
+}
+
+const testAdminToken = "secret"
+
+// sendAdminRequest sends a request with the admin token to the admin api
+func sendAdminRequest(t *testing.T, method string, url string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending admin request: %v", err)
+	}
+	return resp
+}
+
+// setupTestCacheManager creates a CacheManager backed by a mock TF Serving model service
+func setupTestCacheManager(t *testing.T) (*CacheManager, *tfServingMock, func()) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	servingMock := &tfServingMock{models: map[ModelIdentifier]bool{}}
+	grpcServer := grpc.NewServer()
+	serving.RegisterModelServiceServer(grpcServer, servingMock)
+	go grpcServer.Serve(lis)
+
+	controller, err := NewTFServingController(lis.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("Error creating serving controller: %v", err)
+	}
+	provider := &modelProviderMock{versions: map[string][]int64{"foo": {1, 2}}}
+	cache := &CacheManager{
+		ModelProvider:       provider,
+		VersionResolver:     NewVersionResolver(provider, time.Minute),
+		LocalCache:          NewLRUCache(cacheDir, 1024),
+		ServingController:   controller,
+		ModelFetchTimeout:   5,
+		MaxConcurrentModels: 2,
+		modelLoads:          newModelLoadGroup(),
+		pinnedModels:        map[ModelIdentifier]bool{},
+		AdminToken:          testAdminToken,
+	}
+	return cache, servingMock, func() {
+		controller.Close()
+		grpcServer.Stop()
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestAdminPreloadListAndEvictModel(t *testing.T) {
+	cache, servingMock, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(cache.ServeAdmin()))
+	defer server.Close()
+
+	// Preload latest version
+	resp := sendAdminRequest(t, http.MethodPost, server.URL+"/admin/models/foo")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 when preloading, but was %d", resp.StatusCode)
+	}
+	latest := ModelIdentifier{ModelName: "foo", Version: 2}
+	if !servingMock.isServing(latest) {
+		t.Errorf("Expected preloaded model to be served")
+	}
+
+	resp = sendAdminRequest(t, http.MethodGet, server.URL+"/admin/models")
+	var models []ModelInfo
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		t.Fatalf("Error decoding model list: %v", err)
+	}
+	if len(models) != 1 || models[0].Name != "foo" || models[0].Version != 2 ||
+		models[0].State != "AVAILABLE" || models[0].SizeOnDisk != 10 {
+		t.Errorf("Unexpected model list: %+v", models)
+	}
+
+	resp = sendAdminRequest(t, http.MethodDelete, server.URL+"/admin/models/foo/versions/2")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 when evicting, but was %d", resp.StatusCode)
+	}
+	if servingMock.isServing(latest) {
+		t.Errorf("Expected evicted model to be unloaded from serving")
+	}
+	if _, isPresent := cache.LocalCache.Get(latest); isPresent {
+		t.Errorf("Expected evicted model to be removed from the cache")
+	}
+}
+
+func TestAdminEvictUnknownOrPinnedModel(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(cache.ServeAdmin()))
+	defer server.Close()
+
+	resp := sendAdminRequest(t, http.MethodDelete, server.URL+"/admin/models/foo/versions/1")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status code 404 when evicting model not in cache, but was %d", resp.StatusCode)
+	}
+
+	pinned := ModelIdentifier{ModelName: "foo", Version: 1}
+	cache.pinnedModels[pinned] = true
+	if err := cache.PreloadModel(pinned); err != nil {
+		t.Fatalf("Error preloading model: %v", err)
+	}
+	resp = sendAdminRequest(t, http.MethodDelete, server.URL+"/admin/models/foo/versions/1")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status code 409 when evicting pinned model, but was %d", resp.StatusCode)
+	}
+}
+
+func TestAdminUnknownRoute(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(cache.ServeAdmin()))
+	defer server.Close()
+
+	resp := sendAdminRequest(t, http.MethodGet, server.URL+"/admin/models/foo/bar/baz")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status code 404, but was %d", resp.StatusCode)
+	}
+	resp = sendAdminRequest(t, http.MethodDelete, server.URL+"/admin/models")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code 405, but was %d", resp.StatusCode)
+	}
+}
+
+func TestAdminInvalidVersion(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(cache.ServeAdmin()))
+	defer server.Close()
+
+	// The version does not fit in an int64
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		resp := sendAdminRequest(t, method, server.URL+"/admin/models/foo/versions/99999999999999999999")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for invalid version, but was %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(cache.ServeAdmin()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/models")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status code 401 without token, but was %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/admin/models/foo/versions/1", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status code 401 with wrong token, but was %d", resp.StatusCode)
+	}
+
+	// Without a configured token, models can be listed but not loaded or evicted
+	cache.AdminToken = ""
+	resp, err = http.Get(server.URL + "/admin/models")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 when listing models, but was %d", resp.StatusCode)
+	}
+	resp = sendAdminRequest(t, http.MethodPost, server.URL+"/admin/models/foo/versions/1")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code 403 when loading model without configured token, but was %d", resp.StatusCode)
+	}
+}
+
+func TestEvictModelWaitsForInFlightLoad(t *testing.T) {
+	cache, servingMock, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	provider := cache.ModelProvider.(*modelProviderMock)
+	provider.block = make(chan struct{})
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+
+	loadErr := make(chan error)
+	go func() {
+		loadErr <- cache.PreloadModel(identifier)
+	}()
+	// Wait for the model to be fetched
+	for i := 0; i < 100 && !provider.isLoading(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	evictErr := make(chan error)
+	go func() {
+		evictErr <- cache.EvictModel(identifier)
+	}()
+	select {
+	case err := <-evictErr:
+		t.Fatalf("Expected eviction to wait for the load, but it returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(provider.block)
+	if err := <-loadErr; err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if err := <-evictErr; err != nil {
+		t.Fatalf("Error evicting model: %v", err)
+	}
+	if _, isPresent := cache.LocalCache.Get(identifier); isPresent {
+		t.Errorf("Expected model to be evicted after the load")
+	}
+	if servingMock.isServing(identifier) {
+		t.Errorf("Expected evicted model to be unloaded from serving")
+	}
+}
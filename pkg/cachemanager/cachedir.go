@@ -0,0 +1,141 @@
+package cachemanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelMarkerFile is written to a model directory once the model has been
+// completely fetched. Its modification time is the last access time of the
+// model, which allows the cache state to be restored after a restart.
+const modelMarkerFile = ".tfservingcache"
+
+// markModelComplete marks the model in the given directory as completely fetched.
+// Nothing is written if the model directory does not exist.
+func markModelComplete(modelPath string) {
+	if !fileOrDirExists(modelPath) {
+		return
+	}
+	err := ioutil.WriteFile(path.Join(modelPath, modelMarkerFile), []byte{}, 0666)
+	if err != nil {
+		log.WithError(err).Warnf("Could not mark model as complete: %s", modelPath)
+	}
+}
+
+// touchModels updates the last access times of the models in the given
+// directories. Models that have been deleted in the meantime are skipped.
+func touchModels(accessTimes map[string]time.Time) {
+	for modelPath, accessTime := range accessTimes {
+		err := os.Chtimes(path.Join(modelPath, modelMarkerFile), accessTime, accessTime)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Debugf("Could not update model access time: %s", modelPath)
+		}
+	}
+}
+
+// deleteModelFromDisk deletes a model that has been evicted from a cache
+func deleteModelFromDisk(modelPath string, model Model) {
+	log.Infof("Removing model: %s:%d (%s)", model.Identifier.ModelName, model.Identifier.Version, modelPath)
+	err := removeModelDir(modelPath)
+	if err != nil {
+		log.WithError(err).Errorf("Could not delete model: %s", modelPath)
+	}
+}
+
+// removeModelDir deletes a model directory, as well as the parent
+// model name directory if no other versions are left in it.
+func removeModelDir(modelPath string) error {
+	err := os.RemoveAll(modelPath)
+	if err != nil {
+		return err
+	}
+	// Remove fails on non-empty dirs, which is what we want
+	os.Remove(path.Dir(modelPath))
+	return nil
+}
+
+// scanCacheDir finds the models stored in a cache directory with the layout
+// <baseDir>/<model>/<version>. Version directories that were not completely
+// fetched are deleted, as are model directories without any versions.
+// The models are returned ordered by last access time, oldest first.
+func scanCacheDir(baseDir string) []Model {
+	modelDirs, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Errorf("Could not read cache dir: %s", baseDir)
+		}
+		return []Model{}
+	}
+
+	models := []Model{}
+	for _, modelDir := range modelDirs {
+		if !modelDir.IsDir() {
+			continue
+		}
+		modelName := modelDir.Name()
+		modelPath := path.Join(baseDir, modelName)
+		versionDirs, err := ioutil.ReadDir(modelPath)
+		if err != nil {
+			log.WithError(err).Errorf("Could not read model dir: %s", modelPath)
+			continue
+		}
+		for _, versionDir := range versionDirs {
+			version, err := strconv.ParseInt(versionDir.Name(), 10, 64)
+			if err != nil || !versionDir.IsDir() {
+				log.Debugf("Skipping unknown entry in cache dir: %s", path.Join(modelPath, versionDir.Name()))
+				continue
+			}
+			versionPath := path.Join(modelPath, versionDir.Name())
+			marker, err := os.Stat(path.Join(versionPath, modelMarkerFile))
+			if err != nil {
+				log.Infof("Removing incomplete model: %s:%d (%s)", modelName, version, versionPath)
+				if err := os.RemoveAll(versionPath); err != nil {
+					log.WithError(err).Errorf("Could not delete incomplete model: %s", versionPath)
+				}
+				continue
+			}
+			size, err := DirSize(versionPath)
+			if err != nil {
+				log.WithError(err).Errorf("Could not get size of model: %s", versionPath)
+				continue
+			}
+			models = append(models, Model{
+				Identifier:   ModelIdentifier{ModelName: modelName, Version: version},
+				Path:         path.Join(modelName, versionDir.Name()),
+				SizeOnDisk:   size,
+				LastAccessed: marker.ModTime(),
+			})
+		}
+		// Remove fails on non-empty dirs, so only orphaned model dirs are removed
+		if os.Remove(modelPath) == nil {
+			log.Infof("Removed orphaned model dir: %s", modelPath)
+		}
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		return models[i].LastAccessed.Before(models[j].LastAccessed)
+	})
+	return models
+}
+
+// DirSize returns the total size of the files in a directory and its subdirectories
+func DirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
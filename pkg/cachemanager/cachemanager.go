@@ -1,6 +1,7 @@
 package cachemanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -18,9 +19,13 @@ import (
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// ErrModelLoadTimeout is returned when TF Serving does not load a model within the model fetch timeout
+var ErrModelLoadTimeout = fmt.Errorf("Timeout: Model did not load in time: %w", context.DeadlineExceeded)
+
 var promCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "tfservingcache_cache_total",
 	Help: "The total number of cache misses and hits",
@@ -43,9 +48,11 @@ var promCacheFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 }, []string{"model", "version"})
 
 type Model struct {
-	Identifier ModelIdentifier
-	Path       string
-	SizeOnDisk int64
+	Identifier    ModelIdentifier
+	Path          string
+	SizeOnDisk    int64
+	LastAccessed  time.Time
+	FetchDuration time.Duration // time it took to fetch the model from the model provider
 }
 
 type ModelIdentifier struct {
@@ -60,35 +67,51 @@ type CacheManager struct {
 	localGrpcURL                 string
 	localGrpcConnection          *grpc.ClientConn
 	ModelProvider                ModelProvider
+	VersionResolver              *VersionResolver
 	LocalCache                   ModelCache
 	MaxConcurrentModels          int
 	TFServingServerModelBasePath string
 	ServingController            *TFServingController
-	ModelFetchTimeout            float32 // model fetch timeout in seconds
-	rwMux                        sync.RWMutex
+	ModelFetchTimeout            float32    // model fetch timeout in seconds
+	reloadMux                    sync.Mutex // serializes serving config reloads
+	modelLoads                   *modelLoadGroup
+	pinnedMux                    sync.RWMutex
+	pinnedModels                 map[ModelIdentifier]bool
+	numPendingPinnedModels       int
 	healthProbeModelName         string
+	AdminToken                   string // bearer token required by the admin api
+	AccessTimeFlushInterval      time.Duration
 }
 
 func (handler *CacheManager) ServeRest() func(http.ResponseWriter, *http.Request) {
 	return handler.RestProxy.Serve()
 }
 
-func (cache *CacheManager) IsHealthy() bool {
+// IsHealthy reports whether TF Serving is reachable, the model provider is healthy and
+// all pinned models are available. If the node is not healthy, the error tells why.
+func (cache *CacheManager) IsHealthy() (bool, error) {
 	// Check if serving is healthy. Only way we know how is to ask for model status on a model that does not exist
 	_, err := cache.ServingController.GetModelStatus(Model{Identifier: ModelIdentifier{ModelName: cache.healthProbeModelName, Version: 1}})
 	if err != nil {
 		st, _ := status.FromError(err)
-		// Check if st is NOTFOUND
-		if st.Code() != 5 {
-			return false
+		if st.Code() != codes.NotFound {
+			return false, fmt.Errorf("TF Serving is not reachable: %w", err)
 		}
 	}
 	// Check if model provider is healthy
-	modelProviderIsHealthy := cache.ModelProvider.Check()
-	return modelProviderIsHealthy
+	if !cache.ModelProvider.Check() {
+		return false, errors.New("Model provider is not healthy")
+	}
+	if err := cache.checkPinnedModels(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (cache *CacheManager) fetchModel(identifier ModelIdentifier) error {
+// fetchModel makes sure that the model is present in the local cache and loaded
+// in serving. If ctx is done before the model is loaded, the context error is
+// returned, and the load is cancelled if no other requests are waiting for it.
+func (cache *CacheManager) fetchModel(ctx context.Context, identifier ModelIdentifier) error {
 	var promTimer *prometheus.Timer
 	if viper.GetBool("metrics.modelLabels") {
 		promCacheTotal.WithLabelValues(identifier.ModelName, strconv.FormatInt(identifier.Version, 10)).Inc()
@@ -110,37 +133,17 @@ func (cache *CacheManager) fetchModel(identifier ModelIdentifier) error {
 			promMissTimer = prometheus.NewTimer(promCacheFetchDuration.WithLabelValues("all_models", "-1"))
 		}
 		defer promMissTimer.ObserveDuration()
-		// Model does not exist - get size, then put in cache
-		cache.rwMux.Lock()
-		defer cache.rwMux.Unlock()
-		modelSize, err := cache.ModelProvider.ModelSize(identifier.ModelName, identifier.Version)
-		if err != nil {
-			log.WithError(err).Error("Error while retrieving model size")
-			return err
-		}
-		cache.LocalCache.EnsureFreeBytes(modelSize)
-		model, err := cache.ModelProvider.LoadModel(identifier.ModelName, identifier.Version, cache.LocalCache.BaseDir())
-		if err != nil {
-			log.WithError(err).Error("Error while retrieving model")
-			return err
-		}
-		cache.LocalCache.Put(identifier, *model)
-		err = cache.reloadServingConfig(*model)
-		if err != nil {
-			log.WithError(err).Error("Error while loading model")
-			return err
-		}
+		// Model does not exist - fetch it, or wait for the fetch if it is already in progress
+		return cache.modelLoads.Do(ctx, identifier, func(ctx context.Context) error {
+			return cache.loadModel(ctx, identifier)
+		})
 	} else if state, err := cache.ServingController.GetModelStatus(model); err != nil ||
 		state == ModelVersionStatus_UNLOADING ||
 		state == ModelVersionStatus_END {
 		// Model in disk cache but not loaded in serving
-		cache.rwMux.Lock()
-		defer cache.rwMux.Unlock()
-		err = cache.reloadServingConfig(model)
-		if err != nil {
-			log.WithError(err).Error("Error while loading model")
-			return err
-		}
+		return cache.modelLoads.Do(ctx, identifier, func(ctx context.Context) error {
+			return cache.loadModel(ctx, identifier)
+		})
 	} else {
 		if viper.GetBool("metrics.modelLabels") {
 			promCacheHits.WithLabelValues(identifier.ModelName, strconv.FormatInt(identifier.Version, 10)).Inc()
@@ -151,9 +154,69 @@ func (cache *CacheManager) fetchModel(identifier ModelIdentifier) error {
 	return nil
 }
 
+// loadModel makes sure that the model is present in the local cache and
+// loaded in serving. It must only be called through cache.modelLoads, such
+// that at most one load is in progress for each model. If ctx is cancelled
+// while the model is fetched, the fetched model is kept in the cache, but
+// it is not loaded in serving.
+func (cache *CacheManager) loadModel(ctx context.Context, identifier ModelIdentifier) error {
+	// The model must not be evicted by concurrent loads of other
+	// models before it is available in serving
+	cache.LocalCache.Hold(identifier)
+	defer cache.LocalCache.Unhold(identifier)
+
+	// The model may have been fetched by a load that finished
+	// between the cache lookup and the start of this load.
+	model, isPresent := cache.tryGetModelFromCache(identifier)
+	if isPresent {
+		if state, err := cache.ServingController.GetModelStatus(model); err == nil && state == ModelVersionStatus_AVAILABLE {
+			return nil
+		}
+		err := cache.reloadServingConfig(ctx, model)
+		if err != nil {
+			log.WithError(err).Error("Error while loading model")
+			return err
+		}
+		return nil
+	}
+
+	// Model does not exist - get size, then put in cache
+	modelSize, err := cache.ModelProvider.ModelSize(identifier.ModelName, identifier.Version)
+	if err != nil {
+		log.WithError(err).Error("Error while retrieving model size")
+		return err
+	}
+	// Reserve the space while the model is fetched, such that concurrent
+	// fetches of other models do not use the same free space
+	cache.LocalCache.Reserve(modelSize)
+	fetchStart := time.Now()
+	loadedModel, err := cache.ModelProvider.LoadModel(identifier.ModelName, identifier.Version, cache.LocalCache.BaseDir())
+	cache.LocalCache.Release(modelSize)
+	if err != nil {
+		log.WithError(err).Error("Error while retrieving model")
+		return err
+	}
+	// The reported size may be the size of an archive, which is smaller than the
+	// extracted model. Put frees the space needed by the size on disk of the model.
+	if loadedModel.SizeOnDisk > modelSize {
+		log.Debugf("Model %s:%d is %d bytes on disk, but was reported as %d bytes",
+			identifier.ModelName, identifier.Version, loadedModel.SizeOnDisk, modelSize)
+	}
+	loadedModel.FetchDuration = time.Since(fetchStart)
+	cache.LocalCache.Put(identifier, *loadedModel)
+	if ctx.Err() != nil {
+		log.Infof("Model %s:%d fetched, but no longer requested", identifier.ModelName, identifier.Version)
+		return ctx.Err()
+	}
+	err = cache.reloadServingConfig(ctx, *loadedModel)
+	if err != nil {
+		log.WithError(err).Error("Error while loading model")
+		return err
+	}
+	return nil
+}
+
 func (cache *CacheManager) tryGetModelFromCache(identifier ModelIdentifier) (Model, bool) {
-	cache.rwMux.RLock()
-	defer cache.rwMux.RUnlock()
 	model, isPresent := cache.LocalCache.Get(identifier)
 	hostModelPath := cache.LocalCache.ModelPath(model)
 	fileExists := isPresent && fileOrDirExists(hostModelPath)
@@ -164,10 +227,12 @@ func (cache *CacheManager) tryGetModelFromCache(identifier ModelIdentifier) (Mod
 	return model, fileExists
 }
 
-func (cache *CacheManager) reloadServingConfig(requestedModel Model) error {
-	availableModels := cache.LocalCache.ListModels()
-	numActiveModels := int(math.Min(float64(len(availableModels)), float64(cache.MaxConcurrentModels)))
-	err := cache.ServingController.ReloadConfig(availableModels[:numActiveModels], cache.TFServingServerModelBasePath)
+// reloadServingConfig updates the serving config and waits until the requested model is
+// available, or until the model load timeout has passed or ctx is done.
+func (cache *CacheManager) reloadServingConfig(ctx context.Context, requestedModel Model) error {
+	// Only the config update itself is serialized. Waiting for the model
+	// to become available is done without holding the lock.
+	err := cache.updateServingConfig()
 	if err != nil {
 		log.WithError(err).Error("Error while loading model")
 		return err
@@ -186,14 +251,85 @@ func (cache *CacheManager) reloadServingConfig(requestedModel Model) error {
 			log.Debugf("Model not yet available: %s. Duration: %fs", status.String(), totalTime)
 		}
 		totalTime += 0.5
-		time.Sleep(time.Millisecond * 500)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 500):
+		}
 	}
 	if totalTime >= cache.ModelFetchTimeout {
-		return errors.New("Timeout: Model did not load in time")
+		return ErrModelLoadTimeout
+	}
+	if cache.VersionResolver != nil && len(cache.VersionResolver.VersionLabels(requestedModel.Identifier)) > 0 {
+		// Labels can only be assigned to the requested model now that it is available
+		err = cache.updateServingConfig()
+		if err != nil {
+			log.WithError(err).Error("Error while assigning version labels")
+			return err
+		}
 	}
 	return nil
 }
 
+// updateServingConfig reloads the serving config with the current serving models
+func (cache *CacheManager) updateServingConfig() error {
+	cache.reloadMux.Lock()
+	defer cache.reloadMux.Unlock()
+	models := cache.servingModels()
+	return cache.ServingController.ReloadConfig(models, cache.TFServingServerModelBasePath, cache.availableVersionLabels(models))
+}
+
+// availableVersionLabels returns the version labels of the given models, by model name.
+// TF Serving rejects labels assigned to versions that are not available, so labels of
+// versions that are not yet loaded are left out.
+func (cache *CacheManager) availableVersionLabels(models []*Model) map[string]map[string]int64 {
+	labels := map[string]map[string]int64{}
+	if cache.VersionResolver == nil {
+		return labels
+	}
+	for _, model := range models {
+		modelLabels := cache.VersionResolver.VersionLabels(model.Identifier)
+		if len(modelLabels) == 0 {
+			continue
+		}
+		if state, err := cache.ServingController.GetModelStatus(*model); err != nil || state != ModelVersionStatus_AVAILABLE {
+			log.Debugf("Not assigning labels to unavailable model %s:%d", model.Identifier.ModelName, model.Identifier.Version)
+			continue
+		}
+		if _, ok := labels[model.Identifier.ModelName]; !ok {
+			labels[model.Identifier.ModelName] = map[string]int64{}
+		}
+		for _, label := range modelLabels {
+			labels[model.Identifier.ModelName][label] = model.Identifier.Version
+		}
+	}
+	return labels
+}
+
+// servingModels returns the models that should be loaded in serving. Pinned
+// models always occupy slots, and the remaining slots are used for the most
+// recently used models.
+func (cache *CacheManager) servingModels() []*Model {
+	availableModels := cache.LocalCache.ListModels()
+	models := make([]*Model, 0, cache.MaxConcurrentModels)
+	for _, model := range availableModels {
+		if cache.isPinned(model.Identifier) {
+			models = append(models, model)
+		}
+	}
+	// Always leave a slot for the requested model, which is the most recently used
+	maxModels := int(math.Max(float64(cache.MaxConcurrentModels), float64(len(models)+1)))
+	for _, model := range availableModels {
+		if len(models) >= maxModels {
+			break
+		}
+		if !cache.isPinned(model.Identifier) {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
 func New(
 	modelProvider ModelProvider,
 	modelCache ModelCache,
@@ -220,19 +356,29 @@ func New(
 		localRestURL:                 *restUrl,
 		localGrpcURL:                 tfservingServerGRPCHost,
 		ModelProvider:                modelProvider,
+		VersionResolver:              NewVersionResolver(modelProvider, viper.GetDuration("modelProvider.versionCacheTTL")*time.Second),
 		LocalCache:                   modelCache,
 		ServingController:            servingController,
 		TFServingServerModelBasePath: tfServingServerBasePath,
 		ModelFetchTimeout:            modelFetchTimeout,
 		MaxConcurrentModels:          maxConcurrentModels,
+		modelLoads:                   newModelLoadGroup(),
+		pinnedModels:                 map[ModelIdentifier]bool{},
 		healthProbeModelName:         viper.GetString("healthprobe.modelName"),
+		AdminToken:                   viper.GetString("admin.token"),
+		AccessTimeFlushInterval:      viper.GetDuration("modelCache.accessTimeFlushInterval") * time.Second,
 	}
 	maxGrpcMsgSize := viper.GetInt("serving.grpcMaxMsgSize")
 	if maxGrpcMsgSize == 0 {
 		maxGrpcMsgSize = 16 * 1024 * 1024
 	}
-	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector)
-	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector, maxGrpcMsgSize)
+	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector, h.VersionResolver)
+	h.RestProxy.SetTimeouts(tfservingproxy.RestTimeouts{
+		Request:        viper.GetDuration("proxy.rest.timeout") * time.Second,
+		ResponseHeader: viper.GetDuration("proxy.rest.responseHeaderTimeout") * time.Second,
+		Body:           viper.GetDuration("proxy.rest.bodyTimeout") * time.Second,
+	})
+	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector, h.VersionResolver, maxGrpcMsgSize)
 
 	// Create new grpc client
 	localConn, err := grpc.Dial(h.localGrpcURL,
@@ -266,7 +412,7 @@ func fileOrDirExists(filename string) bool {
 }
 
 func (cache *CacheManager) restDirector(req *http.Request, modelName string, version string) error {
-	err := cache.handleModelRequest(modelName, version)
+	err := cache.handleModelRequest(req.Context(), modelName, version)
 	if err != nil {
 		log.WithError(err).Errorf("Error handling request. Aborting: %s", req.URL.String())
 		return fmt.Errorf("Error handling request. Aborting: %s, %w", req.URL.String(), err)
@@ -282,16 +428,16 @@ func (cache *CacheManager) restDirector(req *http.Request, modelName string, ver
 	return nil
 }
 
-func (cache *CacheManager) grpcDirector(modelName string, version string) (*grpc.ClientConn, error) {
-	err := cache.handleModelRequest(modelName, version)
+func (cache *CacheManager) grpcDirector(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error) {
+	err := cache.handleModelRequest(ctx, modelName, version)
 	if err != nil {
 		log.WithError(err).Errorf("Error handling request")
 		return nil, err
 	}
-	return cache.localGrpcConnection, nil
+	return []*grpc.ClientConn{cache.localGrpcConnection}, nil
 }
 
-func (cache *CacheManager) handleModelRequest(modelName string, version string) error {
+func (cache *CacheManager) handleModelRequest(ctx context.Context, modelName string, version string) error {
 	log.Infof("Handling request: %s:%s", modelName, version)
 
 	modelVersion, err := strconv.ParseInt(version, 10, 64)
@@ -300,7 +446,7 @@ func (cache *CacheManager) handleModelRequest(modelName string, version string)
 		return err
 	}
 	identifier := ModelIdentifier{ModelName: modelName, Version: modelVersion}
-	err = cache.fetchModel(identifier)
+	err = cache.fetchModel(ctx, identifier)
 	if err != nil {
 		log.WithError(err).Errorf("Error handling request.")
 		return err
@@ -308,7 +454,22 @@ func (cache *CacheManager) handleModelRequest(modelName string, version string)
 	return nil
 }
 
+// RunAccessTimeFlush periodically writes the last access times of the cached models to disk.
+// It never returns if the interval is positive.
+func (cache *CacheManager) RunAccessTimeFlush() {
+	if cache.AccessTimeFlushInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cache.AccessTimeFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cache.LocalCache.FlushAccessTimes()
+	}
+}
+
+// Close writes the last access times of the cached models to disk and closes the connections to TF Serving
 func (cache *CacheManager) Close() error {
+	cache.LocalCache.FlushAccessTimes()
 	err1 := cache.ServingController.Close()
 	if err1 != nil {
 		log.WithError(err1).Error("Could not close TF serving controller")
@@ -0,0 +1,123 @@
+package cachemanager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsHealthyReportsReason(t *testing.T) {
+	cache, servingMock, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	cache.healthProbeModelName = "__probe__"
+
+	if healthy, err := cache.IsHealthy(); !healthy || err != nil {
+		t.Errorf("Expected cache to be healthy, but got: %v", err)
+	}
+
+	pinned := ModelIdentifier{ModelName: "foo", Version: 1}
+	cache.pinnedModels[pinned] = true
+	if healthy, err := cache.IsHealthy(); healthy || err == nil || !strings.Contains(err.Error(), "foo:1") {
+		t.Errorf("Expected cache to be unhealthy while pinned model is not available, but got: %v", err)
+	}
+	servingMock.mux.Lock()
+	servingMock.models[pinned] = true
+	servingMock.mux.Unlock()
+	if healthy, err := cache.IsHealthy(); !healthy || err != nil {
+		t.Errorf("Expected cache to be healthy when pinned model is available, but got: %v", err)
+	}
+
+	cache.ModelProvider.(*modelProviderMock).unhealthy = true
+	if healthy, err := cache.IsHealthy(); healthy || err == nil || !strings.Contains(err.Error(), "provider") {
+		t.Errorf("Expected cache to be unhealthy when model provider is unhealthy, but got: %v", err)
+	}
+
+	cleanup()
+	if healthy, err := cache.IsHealthy(); healthy || err == nil || !strings.Contains(err.Error(), "TF Serving") {
+		t.Errorf("Expected cache to be unhealthy when TF Serving is not reachable, but got: %v", err)
+	}
+}
+
+func TestLoadModelReleasesReservedBytes(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	localCache := cache.LocalCache.(*LRUCache)
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+
+	cache.ModelProvider.(*modelProviderMock).loadErr = errors.New("Model not found")
+	if err := cache.loadModel(context.Background(), identifier); err == nil {
+		t.Errorf("Expected load of missing model to fail")
+	}
+	if localCache.reserved != 0 {
+		t.Errorf("Expected reserved bytes to be released after failed load, but was %d", localCache.reserved)
+	}
+
+	cache.ModelProvider.(*modelProviderMock).loadErr = nil
+	if err := cache.loadModel(context.Background(), identifier); err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if localCache.reserved != 0 || localCache.currentSize != 10 {
+		t.Errorf("Expected model to be accounted for instead of reserved, but got size %d and reserved %d",
+			localCache.currentSize, localCache.reserved)
+	}
+}
+
+func TestLoadModelFreesSpaceForExtractedSize(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	localCache := cache.LocalCache.(*LRUCache)
+	// The reported size is the size of an archive, which is much smaller than the extracted model
+	cache.ModelProvider.(*modelProviderMock).extractedSize = 600
+
+	for version := int64(1); version <= 2; version++ {
+		if err := cache.loadModel(context.Background(), ModelIdentifier{ModelName: "foo", Version: version}); err != nil {
+			t.Fatalf("Error loading model: %v", err)
+		}
+	}
+	if localCache.currentSize != 600 {
+		t.Errorf("Expected the first model to be evicted for the extracted size of the second, but size is %d", localCache.currentSize)
+	}
+	if _, ok := localCache.Get(ModelIdentifier{ModelName: "foo", Version: 1}); ok {
+		t.Errorf("Expected the first model to be evicted")
+	}
+}
+
+func TestLoadModelIsNotEvictedByConcurrentLoad(t *testing.T) {
+	cache, servingMock, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	// The cache only has room for one model
+	cache.LocalCache = NewLRUCache(cache.LocalCache.BaseDir(), 10)
+	cache.ModelFetchTimeout = 2
+	servingMock.loading = make(chan struct{})
+	first := ModelIdentifier{ModelName: "foo", Version: 1}
+	second := ModelIdentifier{ModelName: "foo", Version: 2}
+
+	firstErr := make(chan error)
+	go func() {
+		firstErr <- cache.loadModel(context.Background(), first)
+	}()
+	// Wait for the first model to be fetched, such that it waits for serving
+	for i := 0; i < 100 && len(cache.LocalCache.ListModels()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	secondErr := make(chan error)
+	go func() {
+		secondErr <- cache.loadModel(context.Background(), second)
+	}()
+	for i := 0; i < 100 && len(cache.LocalCache.ListModels()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(servingMock.loading)
+
+	if err := <-firstErr; err != nil {
+		t.Errorf("Expected the first model to load while the second was loaded, but got: %v", err)
+	}
+	if err := <-secondErr; err != nil {
+		t.Errorf("Error loading second model: %v", err)
+	}
+	if !servingMock.isServing(first) || !servingMock.isServing(second) {
+		t.Errorf("Expected both models to be served")
+	}
+}
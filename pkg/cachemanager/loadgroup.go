@@ -0,0 +1,123 @@
+package cachemanager
+
+import (
+	"context"
+	"sync"
+)
+
+// modelLoad is an in-flight load of a single model. The done
+// channel is closed when the load has finished, after which
+// err holds the result of the load.
+type modelLoad struct {
+	done    chan struct{}
+	err     error
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+	// exclusive is true for an operation started with Exclusive, which
+	// loads must wait for instead of sharing its result
+	exclusive bool
+}
+
+// modelLoadGroup deduplicates concurrent loads of the same model,
+// such that only one caller downloads and loads a model while
+// concurrent callers for the same model wait for the result.
+type modelLoadGroup struct {
+	mux   sync.Mutex
+	loads map[ModelIdentifier]*modelLoad
+}
+
+func newModelLoadGroup() *modelLoadGroup {
+	return &modelLoadGroup{
+		loads: make(map[ModelIdentifier]*modelLoad),
+	}
+}
+
+// Do executes loadFun for the given model and returns its result, making sure
+// that only one execution is in-flight for a model at a time. If a load of the
+// model is already in-flight, Do waits for that load to finish and returns its
+// result. If ctx is done before the load has finished, Do returns the context
+// error. The context passed to loadFun is cancelled when all callers waiting
+// for the load have given up.
+func (group *modelLoadGroup) Do(ctx context.Context, identifier ModelIdentifier, loadFun func(ctx context.Context) error) error {
+	group.mux.Lock()
+	load, ok := group.loads[identifier]
+	for ok && (load.exclusive || load.ctx.Err() != nil) {
+		// The load has been abandoned by all callers, or the model is being
+		// evicted. Wait for it to stop before starting a new load of the model.
+		group.mux.Unlock()
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		group.mux.Lock()
+		load, ok = group.loads[identifier]
+	}
+	if !ok {
+		load = group.start(identifier, loadFun)
+	}
+	load.waiters++
+	group.mux.Unlock()
+
+	select {
+	case <-load.done:
+		return load.err
+	case <-ctx.Done():
+		group.mux.Lock()
+		load.waiters--
+		if load.waiters == 0 {
+			load.cancel()
+		}
+		group.mux.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Exclusive runs fun while no load of the given model is in-flight. It waits for an
+// in-flight load to finish before running fun, and loads started while fun is
+// running wait for fun to return.
+func (group *modelLoadGroup) Exclusive(identifier ModelIdentifier, fun func() error) error {
+	group.mux.Lock()
+	for {
+		load, ok := group.loads[identifier]
+		if !ok {
+			break
+		}
+		group.mux.Unlock()
+		<-load.done
+		group.mux.Lock()
+	}
+	load := &modelLoad{done: make(chan struct{}), exclusive: true}
+	group.loads[identifier] = load
+	group.mux.Unlock()
+
+	err := fun()
+	group.mux.Lock()
+	delete(group.loads, identifier)
+	load.err = err
+	group.mux.Unlock()
+	close(load.done)
+	return err
+}
+
+// start runs loadFun in the background. It must be called with group.mux held.
+func (group *modelLoadGroup) start(identifier ModelIdentifier, loadFun func(ctx context.Context) error) *modelLoad {
+	loadCtx, cancel := context.WithCancel(context.Background())
+	load := &modelLoad{
+		done:   make(chan struct{}),
+		ctx:    loadCtx,
+		cancel: cancel,
+	}
+	group.loads[identifier] = load
+	go func() {
+		err := loadFun(loadCtx)
+		group.mux.Lock()
+		delete(group.loads, identifier)
+		load.err = err
+		group.mux.Unlock()
+		cancel()
+		close(load.done)
+	}()
+	return load
+}
@@ -0,0 +1,199 @@
+package cachemanager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadGroupDeduplicatesConcurrentLoads(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	var numLoads int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = group.Do(context.Background(), identifier, func(ctx context.Context) error {
+				atomic.AddInt32(&numLoads, 1)
+				<-release
+				return errors.New("load failed")
+			})
+		}(i)
+	}
+	// Give all callers time to join the in-flight load
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if numLoads != 1 {
+		t.Errorf("Expected model to be loaded once, but was loaded %d times", numLoads)
+	}
+	for i := range errs {
+		if errs[i] == nil || errs[i].Error() != "load failed" {
+			t.Errorf("Expected all callers to receive the load error, but got: %v", errs[i])
+		}
+	}
+}
+
+func TestLoadGroupDoesNotBlockOtherModels(t *testing.T) {
+	group := newModelLoadGroup()
+	release := make(chan struct{})
+	defer close(release)
+	go group.Do(context.Background(), ModelIdentifier{ModelName: "foo", Version: 1}, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- group.Do(context.Background(), ModelIdentifier{ModelName: "bar", Version: 1}, func(ctx context.Context) error {
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Load of one model was blocked by the load of another model")
+	}
+}
+
+func TestLoadGroupLoadsAgainAfterCompletion(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	numLoads := 0
+	for i := 0; i < 3; i++ {
+		group.Do(context.Background(), identifier, func(ctx context.Context) error {
+			numLoads++
+			return nil
+		})
+	}
+	if numLoads != 3 {
+		t.Errorf("Expected sequential loads to run 3 times, but ran %d times", numLoads)
+	}
+}
+
+func TestLoadGroupReturnsWhenCallerGivesUp(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	loadCancelled := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := group.Do(ctx, identifier, func(loadCtx context.Context) error {
+		<-loadCtx.Done()
+		close(loadCancelled)
+		return loadCtx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected caller to receive its context error, but got: %v", err)
+	}
+	select {
+	case <-loadCancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Expected load to be cancelled when no callers are waiting")
+	}
+}
+
+func TestLoadGroupContinuesWhileCallersAreWaiting(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var loadErr error
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go group.Do(ctx, identifier, func(loadCtx context.Context) error {
+		close(started)
+		select {
+		case <-release:
+			return nil
+		case <-loadCtx.Done():
+			loadErr = loadCtx.Err()
+			return loadErr
+		}
+	})
+	<-started
+	done := make(chan error)
+	go func() {
+		done <- group.Do(context.Background(), identifier, func(ctx context.Context) error {
+			t.Errorf("Expected second caller to join the in-flight load")
+			return nil
+		})
+	}()
+	// Give the second caller time to join the in-flight load
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected load to finish for the remaining caller, but got: %v", err)
+	}
+	if loadErr != nil {
+		t.Errorf("Load was cancelled while a caller was waiting: %v", loadErr)
+	}
+}
+
+func TestLoadGroupLoadsAgainAfterAbandonedLoad(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	group.Do(ctx, identifier, func(loadCtx context.Context) error {
+		<-loadCtx.Done()
+		return loadCtx.Err()
+	})
+
+	loaded := false
+	err := group.Do(context.Background(), identifier, func(ctx context.Context) error {
+		loaded = true
+		return nil
+	})
+	if err != nil || !loaded {
+		t.Errorf("Expected model to be loaded again after an abandoned load. Loaded: %t, error: %v", loaded, err)
+	}
+}
+
+func TestLoadGroupLoadsWaitForExclusive(t *testing.T) {
+	group := newModelLoadGroup()
+	identifier := ModelIdentifier{ModelName: "foo", Version: 42}
+	release := make(chan struct{})
+	exclusiveDone := make(chan struct{})
+	go func() {
+		group.Exclusive(identifier, func() error {
+			<-release
+			return errors.New("evicted")
+		})
+		close(exclusiveDone)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var loaded int32
+	loadDone := make(chan error)
+	go func() {
+		loadDone <- group.Do(context.Background(), identifier, func(ctx context.Context) error {
+			atomic.StoreInt32(&loaded, 1)
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&loaded) != 0 {
+		t.Errorf("Expected load to wait for the exclusive operation")
+	}
+	close(release)
+	<-exclusiveDone
+	if err := <-loadDone; err != nil || atomic.LoadInt32(&loaded) != 1 {
+		t.Errorf("Expected model to be loaded after the exclusive operation, but got: %v", err)
+	}
+}
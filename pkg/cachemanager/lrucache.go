@@ -2,12 +2,15 @@ package cachemanager
 
 import (
 	"container/list"
-	"os"
 	"path"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// ModelCache keeps track of the models stored on local disk.
+// Implementations must be safe for concurrent use.
 type ModelCache interface {
 	BaseDir() string
 	ModelPath(model Model) string
@@ -15,36 +18,92 @@ type ModelCache interface {
 	Get(item ModelIdentifier) (Model, bool)
 	ListModels() []*Model
 	EnsureFreeBytes(bytes int64)
+	// Reserve deletes models until the number of bytes are available, and keeps
+	// them available for a model that is being fetched until they are released
+	Reserve(bytes int64)
+	// Release releases bytes reserved with Reserve
+	Release(bytes int64)
+	// Pin makes sure that the model is never evicted from the cache
+	Pin(item ModelIdentifier)
+	// Hold keeps the model from being evicted until Unhold is called. Holds
+	// are counted, and the model may be held before it is added to the cache.
+	Hold(item ModelIdentifier)
+	// Unhold releases a hold taken with Hold
+	Unhold(item ModelIdentifier)
+	// FlushAccessTimes writes the last access times of the models accessed since
+	// the last flush to disk, such that they are restored after a restart
+	FlushAccessTimes()
+	// Remove deletes a model from the cache and from disk. It
+	// returns false if the model is not in the cache.
+	Remove(item ModelIdentifier) bool
 }
 
 type LRUCache struct {
+	mux         sync.Mutex
 	baseDir     string
 	lruList     *list.List
 	modelMap    map[ModelIdentifier]*list.Element
+	pinned      map[ModelIdentifier]bool
 	Capacity    int64
 	currentSize int64
+	// reserved is the number of bytes reserved for models being fetched
+	reserved int64
+	// held counts the holds of models that are being loaded
+	held map[ModelIdentifier]int
+	// accessed holds the models accessed since the access times were flushed
+	accessed map[ModelIdentifier]bool
 }
 
-func NewLRUCache(dir string, capacityInBytes int64) LRUCache {
-	cache := LRUCache{
+// NewLRUCache creates a new LRUCache in the given directory. Models
+// already present in the directory are added to the cache.
+func NewLRUCache(dir string, capacityInBytes int64) *LRUCache {
+	cache := &LRUCache{
 		baseDir:     dir,
 		lruList:     list.New(),
 		modelMap:    map[ModelIdentifier]*list.Element{},
+		pinned:      map[ModelIdentifier]bool{},
+		held:        map[ModelIdentifier]int{},
+		accessed:    map[ModelIdentifier]bool{},
 		Capacity:    capacityInBytes,
 		currentSize: 0,
 	}
+	cache.restore()
 	return cache
 }
 
+// restore adds the models present in the cache dir to the
+// cache, such that the least recently used is at the back.
+func (cache *LRUCache) restore() {
+	if cache.baseDir == "" {
+		return
+	}
+	models := scanCacheDir(cache.baseDir)
+	for _, model := range models {
+		cache.modelMap[model.Identifier] = cache.lruList.PushFront(model)
+		cache.currentSize += model.SizeOnDisk
+	}
+	if len(models) > 0 {
+		log.Infof("Restored %d models (%d bytes) from cache dir: %s", len(models), cache.currentSize, cache.baseDir)
+	}
+	// The capacity may have been decreased since the models were stored
+	cache.ensureFreeBytes(0)
+}
+
 // Retrieves an item from the cache as well as a bool
 // indicating whether the item was present or not.
 // If the item is not present, the zero value of
 // the type is returned.
 func (cache *LRUCache) Get(item ModelIdentifier) (Model, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
 	val, isContained := cache.modelMap[item]
 	if isContained {
 		cache.lruList.MoveToFront(val)
-		return val.Value.(Model), true
+		model := val.Value.(Model)
+		model.LastAccessed = time.Now()
+		val.Value = model
+		cache.accessed[item] = true
+		return model, true
 	} else {
 		return Model{}, false
 	}
@@ -52,10 +111,14 @@ func (cache *LRUCache) Get(item ModelIdentifier) (Model, bool) {
 
 // Adds an item to the cache (if it does not already exist)
 func (cache *LRUCache) Put(item ModelIdentifier, model Model) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
 	existingElement, isContained := cache.modelMap[item]
 	if !isContained {
 		// Cleanup space
-		cache.EnsureFreeBytes(model.SizeOnDisk)
+		cache.ensureFreeBytes(model.SizeOnDisk)
+		model.LastAccessed = time.Now()
+		markModelComplete(cache.ModelPath(model))
 		newElement := cache.lruList.PushFront(model)
 		cache.modelMap[item] = newElement
 		cache.currentSize += model.SizeOnDisk
@@ -66,27 +129,62 @@ func (cache *LRUCache) Put(item ModelIdentifier, model Model) {
 
 // Deletes LRU models until number of bytes are available
 func (cache *LRUCache) EnsureFreeBytes(bytes int64) {
-	for cache.lruList.Len() > 0 && cache.Capacity-cache.currentSize < bytes {
-		lruModelElement := cache.lruList.Back()
-		lruModel := lruModelElement.Value.(Model)
-		log.Infof("Removing model: %s:%d (%s)", lruModel.Identifier.ModelName, lruModel.Identifier.Version, lruModel.Path)
-		if fileOrDirExists(lruModel.Path) {
-			// Delete file
-			err := os.Remove(lruModel.Path)
-			if err != nil {
-				log.Fatalf("Could not delete file: %s - %s", lruModel.Path, err)
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.ensureFreeBytes(bytes)
+}
+
+func (cache *LRUCache) Reserve(bytes int64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.ensureFreeBytes(bytes)
+	cache.reserved += bytes
+}
+
+func (cache *LRUCache) Release(bytes int64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.reserved -= bytes
+}
+
+func (cache *LRUCache) ensureFreeBytes(bytes int64) {
+	cache.removeLRUWhile(func(model Model) bool {
+		return cache.Capacity-cache.currentSize-cache.reserved < bytes
+	})
+	if cache.Capacity-cache.currentSize-cache.reserved < bytes {
+		log.Errorf("Cannot allocate requested number of bytes. Capacity: %d, request: %d", cache.Capacity, bytes)
+	}
+}
+
+// removeLRUWhile deletes LRU models as long as they satisfy the given
+// predicate. Pinned and held models are skipped.
+func (cache *LRUCache) removeLRUWhile(predicate func(model Model) bool) {
+	element := cache.lruList.Back()
+	for element != nil {
+		prev := element.Prev()
+		model := element.Value.(Model)
+		if !cache.pinned[model.Identifier] && cache.held[model.Identifier] == 0 {
+			if !predicate(model) {
+				return
 			}
+			cache.remove(element)
 		}
-		cache.currentSize -= lruModel.SizeOnDisk
-		cache.lruList.Remove(lruModelElement)
-		delete(cache.modelMap, lruModel.Identifier)
-	}
-	if cache.lruList.Len() > 0 && cache.Capacity-cache.currentSize < bytes {
-		log.Errorf("Cannot allocate requested number of bytes. Capacity: %d, request: %d", cache.Capacity, bytes)
+		element = prev
 	}
 }
 
+// remove deletes a model from the cache and from disk
+func (cache *LRUCache) remove(element *list.Element) {
+	model := element.Value.(Model)
+	deleteModelFromDisk(cache.ModelPath(model), model)
+	cache.currentSize -= model.SizeOnDisk
+	cache.lruList.Remove(element)
+	delete(cache.modelMap, model.Identifier)
+}
+
 func (cache *LRUCache) ListModels() []*Model {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
 	res := []*Model{}
 	for e := cache.lruList.Front(); e != nil; e = e.Next() {
 		model := e.Value.(Model)
@@ -96,6 +194,54 @@ func (cache *LRUCache) ListModels() []*Model {
 
 }
 
+func (cache *LRUCache) Remove(item ModelIdentifier) bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	element, isContained := cache.modelMap[item]
+	if !isContained {
+		return false
+	}
+	cache.remove(element)
+	delete(cache.pinned, item)
+	return true
+}
+
+func (cache *LRUCache) Pin(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.pinned[item] = true
+}
+
+func (cache *LRUCache) Hold(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.held[item]++
+}
+
+func (cache *LRUCache) Unhold(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.held[item]--
+	if cache.held[item] <= 0 {
+		delete(cache.held, item)
+	}
+}
+
+func (cache *LRUCache) FlushAccessTimes() {
+	cache.mux.Lock()
+	accessTimes := map[string]time.Time{}
+	for item := range cache.accessed {
+		if element, isContained := cache.modelMap[item]; isContained {
+			model := element.Value.(Model)
+			accessTimes[cache.ModelPath(model)] = model.LastAccessed
+		}
+	}
+	cache.accessed = map[ModelIdentifier]bool{}
+	cache.mux.Unlock()
+	// The files are written without holding the lock, such that they do not block lookups
+	touchModels(accessTimes)
+}
+
 func (cache *LRUCache) BaseDir() string {
 	return cache.baseDir
 }
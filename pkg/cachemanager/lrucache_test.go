@@ -1,7 +1,12 @@
 package cachemanager
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCacheAddGet(t *testing.T) {
@@ -114,3 +119,207 @@ func TestCacheRemovesLRUVarSizes(t *testing.T) {
 	}
 
 }
+
+func createCachedModel(t *testing.T, baseDir string, name string, version string, size int, accessTime time.Time, complete bool) {
+	modelDir := filepath.Join(baseDir, name, version)
+	err := os.MkdirAll(filepath.Join(modelDir, "variables"), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error creating model dir: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(modelDir, "variables", "variables.data"), make([]byte, size), 0666)
+	if err != nil {
+		t.Fatalf("Error creating model file: %v", err)
+	}
+	if complete {
+		marker := filepath.Join(modelDir, modelMarkerFile)
+		err = ioutil.WriteFile(marker, []byte{}, 0666)
+		if err != nil {
+			t.Fatalf("Error creating model marker: %v", err)
+		}
+		os.Chtimes(marker, accessTime, accessTime)
+	}
+}
+
+func TestCacheRestoresModelsFromDisk(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	now := time.Now()
+	createCachedModel(t, cacheDir, "foo", "1", 10, now.Add(-3*time.Hour), true)
+	createCachedModel(t, cacheDir, "foo", "2", 20, now.Add(-1*time.Hour), true)
+	createCachedModel(t, cacheDir, "bar", "1", 30, now.Add(-2*time.Hour), true)
+	createCachedModel(t, cacheDir, "bar", "2", 40, now, false)
+	createCachedModel(t, cacheDir, "baz", "1", 40, now, false)
+
+	cache := NewLRUCache(cacheDir, 1024)
+
+	if cache.currentSize != 60 {
+		t.Errorf("Expected cache size of %d but was %d", 60, cache.currentSize)
+	}
+	models := cache.ListModels()
+	expectedOrder := []ModelIdentifier{{"foo", 2}, {"bar", 1}, {"foo", 1}}
+	if len(models) != len(expectedOrder) {
+		t.Fatalf("Expected %d restored models, but found %d", len(expectedOrder), len(models))
+	}
+	for i := range expectedOrder {
+		if models[i].Identifier != expectedOrder[i] {
+			t.Errorf("Expected model %v at position %d, but found %v", expectedOrder[i], i, models[i].Identifier)
+		}
+	}
+	if models[0].SizeOnDisk != 20 || models[0].Path != filepath.Join("foo", "2") {
+		t.Errorf("Restored model has wrong size or path: %d, %s", models[0].SizeOnDisk, models[0].Path)
+	}
+	if fileOrDirExists(filepath.Join(cacheDir, "bar", "2")) {
+		t.Errorf("Expected incomplete model to be removed from disk")
+	}
+	if fileOrDirExists(filepath.Join(cacheDir, "baz")) {
+		t.Errorf("Expected orphaned model dir to be removed from disk")
+	}
+}
+
+func TestCacheRestoreEvictsWhenOverCapacity(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	now := time.Now()
+	createCachedModel(t, cacheDir, "foo", "1", 10, now.Add(-2*time.Hour), true)
+	createCachedModel(t, cacheDir, "foo", "2", 10, now.Add(-1*time.Hour), true)
+
+	cache := NewLRUCache(cacheDir, 15)
+
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 1}); avail {
+		t.Errorf("Expected least recently used model to be evicted")
+	}
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 2}); !avail {
+		t.Errorf("Expected most recently used model to be restored")
+	}
+	if fileOrDirExists(filepath.Join(cacheDir, "foo", "1")) {
+		t.Errorf("Expected evicted model to be removed from disk")
+	}
+}
+
+func TestCacheRestoresModelsAddedBeforeRestart(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cache := NewLRUCache(cacheDir, 1024)
+	for i := 1; i <= 2; i++ {
+		createCachedModel(t, cacheDir, "foo", strconv.Itoa(i), 10, time.Time{}, false)
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: filepath.Join("foo", strconv.Itoa(i)), SizeOnDisk: 10})
+	}
+
+	restoredCache := NewLRUCache(cacheDir, 1024)
+	if len(restoredCache.ListModels()) != 2 {
+		t.Errorf("Expected 2 models to be restored, but found %d", len(restoredCache.ListModels()))
+	}
+}
+
+func TestCacheDoesNotRemovePinnedModels(t *testing.T) {
+	cache := NewLRUCache("./cache", 30)
+	pinned := ModelIdentifier{ModelName: "pinned", Version: 1}
+	cache.Pin(pinned)
+	cache.Put(pinned, Model{Identifier: pinned, Path: "/some/path", SizeOnDisk: 10})
+	for i := 1; i <= 5; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+
+	if _, avail := cache.Get(pinned); !avail {
+		t.Errorf("Pinned model was removed from cache")
+	}
+	if len(cache.ListModels()) != 3 {
+		t.Errorf("Expected number of cache items to be 3, but it is %d", len(cache.ListModels()))
+	}
+	if cache.currentSize != 30 {
+		t.Errorf("Expected cache size of %d but was %d", 30, cache.currentSize)
+	}
+}
+
+func TestCacheRemove(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cache := NewLRUCache(cacheDir, 1024)
+	createCachedModel(t, cacheDir, "foo", "1", 10, time.Time{}, false)
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+	cache.Put(identifier, Model{Identifier: identifier, Path: filepath.Join("foo", "1"), SizeOnDisk: 10})
+
+	if !cache.Remove(identifier) {
+		t.Errorf("Expected model to be removed")
+	}
+	if _, avail := cache.Get(identifier); avail {
+		t.Errorf("Removed model is still in the cache")
+	}
+	if cache.currentSize != 0 {
+		t.Errorf("Expected cache size of %d but was %d", 0, cache.currentSize)
+	}
+	if fileOrDirExists(filepath.Join(cacheDir, "foo")) {
+		t.Errorf("Expected removed model to be deleted from disk")
+	}
+	if cache.Remove(identifier) {
+		t.Errorf("Expected removal of model not in cache to fail")
+	}
+}
+
+func TestCacheReservesBytesForConcurrentFetches(t *testing.T) {
+	cache := NewLRUCache("./cache", 100)
+	for i := 1; i <= 5; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 20})
+	}
+
+	// Two fetches of 30 bytes each must not share the same free space
+	cache.Reserve(30)
+	cache.Reserve(30)
+	if cache.currentSize != 40 {
+		t.Errorf("Expected cache size of %d but was %d", 40, cache.currentSize)
+	}
+
+	cache.Release(30)
+	identifier := ModelIdentifier{ModelName: "bar", Version: 1}
+	cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 30})
+	if cache.currentSize+cache.reserved > cache.Capacity {
+		t.Errorf("Expected cache size and reservations to be within capacity, but was %d", cache.currentSize+cache.reserved)
+	}
+	cache.Release(30)
+	if cache.reserved != 0 {
+		t.Errorf("Expected no reserved bytes, but was %d", cache.reserved)
+	}
+}
+
+func TestCacheFlushesAccessTimes(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", ".testCacheDir")
+	if err != nil {
+		t.Fatalf("Error creating cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	now := time.Now()
+	createCachedModel(t, cacheDir, "foo", "1", 10, now.Add(-2*time.Hour), true)
+	createCachedModel(t, cacheDir, "foo", "2", 10, now.Add(-1*time.Hour), true)
+	marker := filepath.Join(cacheDir, "foo", "1", modelMarkerFile)
+
+	cache := NewLRUCache(cacheDir, 1024)
+	cache.Get(ModelIdentifier{ModelName: "foo", Version: 1})
+	if info, err := os.Stat(marker); err != nil || info.ModTime().After(now) {
+		t.Errorf("Expected access time not to be written on access")
+	}
+	cache.FlushAccessTimes()
+	if info, err := os.Stat(marker); err != nil || info.ModTime().Before(now) {
+		t.Errorf("Expected access time to be written on flush")
+	}
+
+	restoredCache := NewLRUCache(cacheDir, 1024)
+	models := restoredCache.ListModels()
+	if len(models) != 2 || models[0].Identifier.Version != 1 {
+		t.Errorf("Expected the accessed model to be restored as the most recently used")
+	}
+}
@@ -3,5 +3,7 @@ package cachemanager
 type ModelProvider interface {
 	LoadModel(modelName string, modelVersion int64, destinationDir string) (*Model, error)
 	ModelSize(modelName string, modelVersion int64) (int64, error)
+	// ModelVersions returns the available versions of a model
+	ModelVersions(modelName string) ([]int64, error)
 	Check() bool
 }
@@ -0,0 +1,328 @@
+// Package archive extracts models that are stored as a single archive, such as
+// a .tar.gz, .tar.zst or .zip file, for the model providers.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits bounds the files extracted for a model, such that an archive that expands
+// to much more than its own size, e.g. a zip bomb, is aborted
+type Limits struct {
+	// MaxSize is the max total size in bytes of the extracted files. Zero means no limit.
+	MaxSize int64
+	// MaxEntries is the max number of archive entries. Zero means no limit.
+	MaxEntries int
+}
+
+// Limiter counts the size and entries extracted for a model and returns an error
+// once its limits are exceeded. A limiter may be shared by several archives
+// that are extracted into the same model dir.
+type Limiter struct {
+	limits  Limits
+	size    int64
+	entries int
+}
+
+// NewLimiter returns a limiter with the given limits
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{limits: limits}
+}
+
+// addEntry counts an archive entry
+func (limiter *Limiter) addEntry(name string) error {
+	limiter.entries++
+	if limiter.limits.MaxEntries > 0 && limiter.entries > limiter.limits.MaxEntries {
+		return fmt.Errorf("Archive has more than %d entries. Aborted at: %s", limiter.limits.MaxEntries, name)
+	}
+	return nil
+}
+
+// Format is the format of a model archive
+type Format string
+
+const (
+	Tar    Format = "tar"
+	TarGz  Format = "tar.gz"
+	TarZst Format = "tar.zst"
+	Zip    Format = "zip"
+)
+
+// extensions maps file extensions to archive formats. Longer extensions come
+// first, such that .tar.gz is not detected as .gz.
+var extensions = []struct {
+	extension string
+	format    Format
+}{
+	{".tar.gz", TarGz},
+	{".tgz", TarGz},
+	{".tar.zst", TarZst},
+	{".tzst", TarZst},
+	{".tar", Tar},
+	{".zip", Zip},
+}
+
+// FormatFromName returns the archive format of a file name, URL path or object
+// key based on its extension.
+func FormatFromName(name string) (Format, bool) {
+	name = strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext.extension) {
+			return ext.format, true
+		}
+	}
+	return "", false
+}
+
+// ParseVersion returns the model version and archive format of an archive name
+// relative to the model, e.g. 1 and TarGz for "1.tar.gz".
+func ParseVersion(relativeName string) (int64, Format, bool) {
+	format, ok := FormatFromName(relativeName)
+	if !ok {
+		return 0, "", false
+	}
+	version, err := strconv.ParseInt(TrimExtension(relativeName), 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return version, format, true
+}
+
+// TrimExtension returns the name without its archive extension
+func TrimExtension(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lower, ext.extension) {
+			return name[:len(name)-len(ext.extension)]
+		}
+	}
+	return name
+}
+
+// Extract extracts the archive read from r into destDir and returns the total
+// size of the extracted files. Entries that would be written outside of destDir
+// are rejected, and links are skipped. If the archive only contains a single
+// directory, the contents of that directory are moved to destDir, such that
+// archives of both the model files and of the model directory are supported.
+// Extraction is aborted when the limits are exceeded. If extraction fails,
+// destDir is removed.
+func Extract(r io.Reader, format Format, destDir string, limits Limits) (int64, error) {
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return 0, err
+	}
+	size, err := Unpack(r, format, destDir, NewLimiter(limits))
+	if err == nil {
+		err = FlattenSingleDir(destDir)
+	}
+	if err != nil {
+		if removeErr := os.RemoveAll(destDir); removeErr != nil {
+			log.WithError(removeErr).Errorf("Could not remove partially extracted model: %s", destDir)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// Unpack extracts the archive read from r into destDir like Extract, but leaves
+// the directory layout of the archive as is, and does not remove destDir if
+// extraction fails. It allows several archives to be extracted into destDir,
+// counted by the same limiter.
+func Unpack(r io.Reader, format Format, destDir string, limiter *Limiter) (int64, error) {
+	switch format {
+	case Tar:
+		return extractTar(r, destDir, limiter)
+	case TarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		return extractTar(gz, destDir, limiter)
+	case TarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		return extractTar(zr, destDir, limiter)
+	case Zip:
+		return extractZip(r, destDir, limiter)
+	default:
+		return 0, fmt.Errorf("Unsupported archive format: %s", format)
+	}
+}
+
+func extractTar(r io.Reader, destDir string, limiter *Limiter) (int64, error) {
+	tr := tar.NewReader(r)
+	totalSize := int64(0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return totalSize, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := limiter.addEntry(header.Name); err != nil {
+			return 0, err
+		}
+		target, err := entryPath(destDir, header.Name)
+		if err != nil {
+			return 0, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0777)
+		case tar.TypeReg:
+			var size int64
+			size, err = writeFile(target, tr, limiter)
+			totalSize += size
+		default:
+			log.Warnf("Skipping unsupported archive entry: %s", header.Name)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func extractZip(r io.Reader, destDir string, limiter *Limiter) (int64, error) {
+	// Zip archives can only be read with random access, so the archive is buffered in a file
+	f, err := ioutil.TempFile("", ".tfservingcache-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	archiveSize, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+	zr, err := zip.NewReader(f, archiveSize)
+	if err != nil {
+		return 0, err
+	}
+
+	totalSize := int64(0)
+	for _, entry := range zr.File {
+		if err := limiter.addEntry(entry.Name); err != nil {
+			return 0, err
+		}
+		target, err := entryPath(destDir, entry.Name)
+		if err != nil {
+			return 0, err
+		}
+		mode := entry.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			log.Warnf("Skipping unsupported archive entry: %s", entry.Name)
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return 0, err
+		}
+		size, err := writeFile(target, rc, limiter)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		totalSize += size
+	}
+	return totalSize, nil
+}
+
+// WriteFile writes the file read from r to the given relative path in destDir
+// and returns its size. Paths outside of destDir are rejected.
+func WriteFile(destDir string, name string, r io.Reader, limiter *Limiter) (int64, error) {
+	if err := limiter.addEntry(name); err != nil {
+		return 0, err
+	}
+	target, err := entryPath(destDir, name)
+	if err != nil {
+		return 0, err
+	}
+	return writeFile(target, r, limiter)
+}
+
+// entryPath returns the path in destDir of an archive entry, and an error if the
+// entry would be written outside of destDir
+func entryPath(destDir string, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("Archive entry has absolute path: %s", name)
+	}
+	target := filepath.Join(destDir, name)
+	if target != filepath.Clean(destDir) && !strings.HasPrefix(target, filepath.Clean(destDir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Archive entry is outside of destination dir: %s", name)
+	}
+	return target, nil
+}
+
+// writeFile writes the file read from r to target. At most one byte more than
+// the remaining size of the limiter is read, such that writing stops as soon as
+// the limit is exceeded.
+func writeFile(target string, r io.Reader, limiter *Limiter) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	if limiter.limits.MaxSize > 0 {
+		r = io.LimitReader(r, limiter.limits.MaxSize-limiter.size+1)
+	}
+	size, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	limiter.size += size
+	if err == nil && limiter.limits.MaxSize > 0 && limiter.size > limiter.limits.MaxSize {
+		err = fmt.Errorf("Extracted model is larger than %d bytes", limiter.limits.MaxSize)
+	}
+	return size, err
+}
+
+// FlattenSingleDir moves the contents of the only entry in dir to dir, if that entry is a directory
+func FlattenSingleDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return nil
+	}
+	// The directory is renamed first, since it may contain an entry with its own name
+	root := filepath.Join(dir, ".archive-root")
+	if err := os.Rename(filepath.Join(dir, entries[0].Name()), root); err != nil {
+		return err
+	}
+	children, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := os.Rename(filepath.Join(root, child.Name()), filepath.Join(dir, child.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(root)
+}
@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testEntry struct {
+	name     string
+	content  string
+	typeflag byte
+}
+
+func tarGzArchive(t *testing.T, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: entry.typeflag}
+		if entry.typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if entry.typeflag == tar.TypeSymlink {
+			header.Linkname = entry.content
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte(entry.content))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry.content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func assertFile(t *testing.T, path string, expected string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != expected {
+		t.Errorf("Expected %s to contain %q, but got %q (err: %v)", path, expected, string(content), err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", ".testArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFormatFromName(t *testing.T) {
+	for name, expected := range map[string]Format{
+		"models/foo/1.tar.gz": TarGz,
+		"1.TGZ":               TarGz,
+		"1.tar":               Tar,
+		"1.tar.zst":           TarZst,
+		"1.zip":               Zip,
+	} {
+		if format, ok := FormatFromName(name); !ok || format != expected {
+			t.Errorf("Expected format of %s to be %s, but was %s", name, expected, format)
+		}
+	}
+	if _, ok := FormatFromName("saved_model.pb"); ok {
+		t.Errorf("Expected no format for file that is not an archive")
+	}
+	if name := TrimExtension("models/foo/1.tar.gz"); name != "models/foo/1" {
+		t.Errorf("Expected extension to be trimmed, but got %s", name)
+	}
+	if version, format, ok := ParseVersion("42.zip"); !ok || version != 42 || format != Zip {
+		t.Errorf("Expected version 42 of zip archive, but got %d, %s", version, format)
+	}
+	for _, name := range []string{"latest.tar.gz", "42", "42/saved_model.pb"} {
+		if _, _, ok := ParseVersion(name); ok {
+			t.Errorf("Expected %s not to be a version archive", name)
+		}
+	}
+}
+
+func TestExtractTarZst(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "saved_model.pb", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	tw.Write([]byte("model"))
+	tw.Close()
+	zw, _ := zstd.NewWriter(nil)
+	data := zw.EncodeAll(buf.Bytes(), nil)
+
+	size, err := Extract(bytes.NewReader(data), TarZst, dir, Limits{})
+	if err != nil || size != 5 {
+		t.Fatalf("Error extracting archive: %v", err)
+	}
+	assertFile(t, filepath.Join(dir, "saved_model.pb"), "model")
+}
+
+func TestExtractTarGz(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destDir := filepath.Join(dir, "foo", "1")
+
+	data := tarGzArchive(t,
+		testEntry{name: "saved_model.pb", content: "model"},
+		testEntry{name: "variables/", typeflag: tar.TypeDir},
+		testEntry{name: "variables/variables.index", content: "index"},
+		testEntry{name: "link", content: "/etc/passwd", typeflag: tar.TypeSymlink})
+	size, err := Extract(bytes.NewReader(data), TarGz, destDir, Limits{})
+	if err != nil {
+		t.Fatalf("Error extracting archive: %v", err)
+	}
+	if size != int64(len("model")+len("index")) {
+		t.Errorf("Unexpected size of extracted files: %d", size)
+	}
+	assertFile(t, filepath.Join(destDir, "saved_model.pb"), "model")
+	assertFile(t, filepath.Join(destDir, "variables", "variables.index"), "index")
+	if _, err := os.Lstat(filepath.Join(destDir, "link")); !os.IsNotExist(err) {
+		t.Errorf("Expected symlink to be skipped")
+	}
+}
+
+func TestExtractZipWithSingleDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destDir := filepath.Join(dir, "foo", "1")
+
+	// The archive contains the model dir, which has a subdir with the same name
+	data := zipArchive(t,
+		testEntry{name: "1/saved_model.pb", content: "model"},
+		testEntry{name: "1/1/file", content: "nested"})
+	if _, err := Extract(bytes.NewReader(data), Zip, destDir, Limits{}); err != nil {
+		t.Fatalf("Error extracting archive: %v", err)
+	}
+	assertFile(t, filepath.Join(destDir, "saved_model.pb"), "model")
+	assertFile(t, filepath.Join(destDir, "1", "file"), "nested")
+}
+
+func TestExtractRejectsPathTraversal(t *testing.T) {
+	for _, name := range []string{"../evil", "variables/../../evil", "/evil"} {
+		dir := tempDir(t)
+		destDir := filepath.Join(dir, "foo", "1")
+		for format, data := range map[Format][]byte{
+			TarGz: tarGzArchive(t, testEntry{name: "saved_model.pb", content: "model"}, testEntry{name: name, content: "evil"}),
+			Zip:   zipArchive(t, testEntry{name: "saved_model.pb", content: "model"}, testEntry{name: name, content: "evil"}),
+		} {
+			if _, err := Extract(bytes.NewReader(data), format, destDir, Limits{}); err == nil {
+				t.Errorf("Expected %s archive with entry %s to be rejected", format, name)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+				t.Errorf("Expected no file outside of destination dir for entry %s", name)
+			}
+			if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+				t.Errorf("Expected partially extracted model to be removed")
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractAbortsWhenLimitsAreExceeded(t *testing.T) {
+	limits := Limits{MaxSize: 10, MaxEntries: 3}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destDir := filepath.Join(dir, "foo", "1")
+	for name, data := range map[string][]byte{
+		"too large tar":  tarGzArchive(t, testEntry{name: "saved_model.pb", content: "model"}, testEntry{name: "variables/data", content: "variables"}),
+		"too large zip":  zipArchive(t, testEntry{name: "saved_model.pb", content: "model"}, testEntry{name: "variables/data", content: "variables"}),
+		"too many files": tarGzArchive(t, testEntry{name: "a", content: "a"}, testEntry{name: "b", content: "b"}, testEntry{name: "c", content: "c"}, testEntry{name: "d", content: "d"}),
+	} {
+		format := TarGz
+		if name == "too large zip" {
+			format = Zip
+		}
+		if _, err := Extract(bytes.NewReader(data), format, destDir, limits); err == nil {
+			t.Errorf("Expected %s archive to be rejected", name)
+		}
+		if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+			t.Errorf("Expected partially extracted model to be removed")
+		}
+	}
+
+	size, err := Extract(bytes.NewReader(tarGzArchive(t, testEntry{name: "saved_model.pb", content: "model"}, testEntry{name: "data", content: "data"})), TarGz, destDir, limits)
+	if err != nil || size != 9 {
+		t.Errorf("Expected archive within limits to be extracted, but got size %d (err: %v)", size, err)
+	}
+
+	// A limiter is shared by the archives extracted into the same dir
+	limiter := NewLimiter(limits)
+	if _, err := WriteFile(destDir, "a", bytes.NewReader([]byte("123456")), limiter); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if _, err := WriteFile(destDir, "b", bytes.NewReader([]byte("123456")), limiter); err == nil {
+		t.Errorf("Expected files exceeding the limit to be rejected")
+	}
+}
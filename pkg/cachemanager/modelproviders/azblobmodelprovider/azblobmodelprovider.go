@@ -15,6 +15,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
 )
 
 type AZBlobLocation struct {
@@ -27,6 +28,8 @@ type AZBlobModelProvider struct {
 	pipeline     pipeline.Pipeline
 	ContainerURL *url.URL
 	ModelBaseDir string
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
 }
 
 func NewAZBlobModelProvider(container string, modelBaseDir string, accountName string, accountKey string) (*AZBlobModelProvider, error) {
@@ -62,7 +65,15 @@ func (provider AZBlobModelProvider) LoadModel(modelName string, modelVersion int
 	modelLocation := provider.getKeyForModel(modelName, modelVersion)
 
 	destPath := path.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
-	err := os.MkdirAll(destPath, 0777)
+	archiveBlob, format, err := provider.findArchive(modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model: %s", modelLocation.KeyPrefix)
+		return nil, err
+	}
+	if archiveBlob != nil {
+		return provider.extractModel(modelName, modelVersion, archiveBlob, format, destPath)
+	}
+	err = os.MkdirAll(destPath, 0777)
 	if err != nil {
 		log.WithError(err).Errorf("Could not create model dir: %s", destPath)
 		return nil, err
@@ -106,7 +117,68 @@ func (provider AZBlobModelProvider) LoadModel(modelName string, modelVersion int
 	}, nil
 }
 
+// extractModel downloads the model archive and extracts it to destPath
+func (provider AZBlobModelProvider) extractModel(modelName string, modelVersion int64, blob *azblob.BlobItemInternal, format archive.Format, destPath string) (*cachemanager.Model, error) {
+	blobUrl, _ := url.Parse(fmt.Sprintf("%s/%s", provider.ContainerURL.String(), blob.Name))
+	ctx := context.Background()
+	res, err := azblob.NewBlobURL(*blobUrl, provider.pipeline).Download(ctx, 0, azblob.CountToEnd,
+		azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model archive: %s", blob.Name)
+		return nil, err
+	}
+	body := res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	modelSize, err := archive.Extract(body, format, destPath, provider.ArchiveLimits)
+	if err != nil {
+		log.WithError(err).Errorf("Could not extract model archive: %s", blob.Name)
+		return nil, err
+	}
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       path.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: modelSize,
+	}, nil
+}
+
+// findArchive returns the archive blob of a model version, e.g. <model>/1.tar.gz,
+// or nil if the model version is not stored as a single archive
+func (provider AZBlobModelProvider) findArchive(modelName string, modelVersion int64) (*azblob.BlobItemInternal, archive.Format, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	// The prefix matches the archives of the version, but not the blobs in version "folders"
+	prefix := modelPrefix + strconv.FormatInt(modelVersion, 10)
+	containerURL := azblob.NewContainerURL(*provider.ContainerURL, provider.pipeline)
+	ctx := context.Background()
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		blobs, err := containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			log.WithError(err).Errorf("Could not list model archives: %s", prefix)
+			return nil, "", err
+		}
+		for i := range blobs.Segment.BlobItems {
+			blob := blobs.Segment.BlobItems[i]
+			version, format, ok := archive.ParseVersion(strings.TrimPrefix(blob.Name, modelPrefix))
+			if ok && version == modelVersion {
+				return &blob, format, nil
+			}
+		}
+		marker = blobs.NextMarker
+	}
+	return nil, "", nil
+}
+
+// ModelSize returns the size of the model blobs, or the size of the archive if
+// the model is stored as a single archive
 func (provider AZBlobModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	archiveBlob, _, err := provider.findArchive(modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
+		return 0, err
+	}
+	if archiveBlob != nil {
+		return *archiveBlob.Properties.ContentLength, nil
+	}
 	modelLocation := provider.getKeyForModel(modelName, modelVersion)
 	totalSize := int64(0)
 	countSizeFunc := func(relativeKey string, obj *azblob.BlobItemInternal, url *url.URL) error {
@@ -114,7 +186,7 @@ func (provider AZBlobModelProvider) ModelSize(modelName string, modelVersion int
 		return nil
 	}
 
-	err := provider.modelObjectApply(modelLocation, countSizeFunc)
+	err = provider.modelObjectApply(modelLocation, countSizeFunc)
 	if err != nil {
 		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
 		return 0, err
@@ -122,6 +194,35 @@ func (provider AZBlobModelProvider) ModelSize(modelName string, modelVersion int
 	return totalSize, nil
 }
 
+func (provider AZBlobModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	containerURL := azblob.NewContainerURL(*provider.ContainerURL, provider.pipeline)
+	ctx := context.Background()
+
+	versions := []int64{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		blobs, err := containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{Prefix: modelPrefix})
+		if err != nil {
+			log.WithError(err).Errorf("Could not list model versions: %s", modelPrefix)
+			return nil, err
+		}
+		for _, prefix := range blobs.Segment.BlobPrefixes {
+			versionStr := strings.TrimSuffix(strings.TrimPrefix(prefix.Name, modelPrefix), "/")
+			version, err := strconv.ParseInt(versionStr, 10, 64)
+			if err == nil {
+				versions = append(versions, version)
+			}
+		}
+		for _, blob := range blobs.Segment.BlobItems {
+			if version, _, ok := archive.ParseVersion(strings.TrimPrefix(blob.Name, modelPrefix)); ok {
+				versions = append(versions, version)
+			}
+		}
+		marker = blobs.NextMarker
+	}
+	return versions, nil
+}
+
 func (provider *AZBlobModelProvider) modelObjectApply(modelLocation AZBlobLocation,
 	applyFun func(string, *azblob.BlobItemInternal, *url.URL) error) error {
 	containerURL := azblob.NewContainerURL(*provider.ContainerURL, provider.pipeline)
@@ -162,13 +263,18 @@ func (provider *AZBlobModelProvider) modelObjectApply(modelLocation AZBlobLocati
 }
 
 func (provider AZBlobModelProvider) getKeyForModel(modelName string, modelVersion int64) AZBlobLocation {
+	return AZBlobLocation{
+		KeyPrefix: fmt.Sprintf("%s%d/", provider.getKeyForModelName(modelName), modelVersion),
+	}
+}
+
+// getKeyForModelName returns the key prefix of all versions of a model
+func (provider AZBlobModelProvider) getKeyForModelName(modelName string) string {
 	modelPrefix := provider.ModelBaseDir
 	if len(modelPrefix) > 0 {
 		modelPrefix = fmt.Sprintf("%s/", modelPrefix)
 	}
-	return AZBlobLocation{
-		KeyPrefix: fmt.Sprintf("%s%s/%d/", modelPrefix, modelName, modelVersion),
-	}
+	return fmt.Sprintf("%s%s/", modelPrefix, modelName)
 }
 
 func (provider AZBlobModelProvider) Check() bool {
@@ -11,26 +11,32 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
 )
 
 type DiskModelProvider struct {
 	BaseDir string
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
 }
 
 func (provider DiskModelProvider) LoadModel(modelName string, modelVersion int64, destinationDir string) (*cachemanager.Model, error) {
 	log.Infof("Copying model %s:%d", modelName, modelVersion)
+	destPath := path.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
+	if archivePath, format, found := findArchiveForModel(path.Join(provider.BaseDir, modelName), modelVersion); found {
+		return provider.extractModel(modelName, modelVersion, archivePath, format, destPath)
+	}
 	srcPath, err := findSrcPathForModel(path.Join(provider.BaseDir, modelName), modelVersion)
 	if err != nil {
 		log.WithError(err).Errorf("Could not load model %s:%d", modelName, modelVersion)
 		return nil, err
 	}
-	destPath := path.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
 	err = copy.Copy(srcPath, destPath)
 	if err != nil {
 		log.WithError(err).Errorf("Could not load model %s:%d", modelName, modelVersion)
 		return nil, err
 	}
-	modelSize, err := provider.ModelSize(modelName, modelVersion)
+	modelSize, err := cachemanager.DirSize(destPath)
 	if err != nil {
 		log.WithError(err).Errorf("Could not load model size %s:%d", modelName, modelVersion)
 		return nil, err
@@ -43,6 +49,42 @@ func (provider DiskModelProvider) LoadModel(modelName string, modelVersion int64
 	}, nil
 }
 
+// extractModel extracts the model archive at archivePath to destPath
+func (provider DiskModelProvider) extractModel(modelName string, modelVersion int64, archivePath string, format archive.Format, destPath string) (*cachemanager.Model, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		log.WithError(err).Errorf("Could not load model %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	defer f.Close()
+	modelSize, err := archive.Extract(f, format, destPath, provider.ArchiveLimits)
+	if err != nil {
+		log.WithError(err).Errorf("Could not extract model %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       path.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: modelSize,
+	}, nil
+}
+
+// findArchiveForModel returns the path and format of the archive of a model version,
+// e.g. <modelDir>/1.tar.gz, if the model version is stored as a single archive
+func findArchiveForModel(modelDir string, modelVersion int64) (string, archive.Format, bool) {
+	files, err := ioutil.ReadDir(modelDir)
+	if err != nil {
+		return "", "", false
+	}
+	for _, file := range files {
+		version, format, ok := archive.ParseVersion(file.Name())
+		if ok && version == modelVersion && !file.IsDir() {
+			return path.Join(modelDir, file.Name()), format, true
+		}
+	}
+	return "", "", false
+}
+
 func findSrcPathForModel(modelDir string, modelVersion int64) (string, error) {
 	files, err := ioutil.ReadDir(modelDir)
 	if err != nil {
@@ -68,18 +110,38 @@ func findSrcPathForModel(modelDir string, modelVersion int64) (string, error) {
 	}
 }
 
+// ModelSize returns the size of the model files, or the size of the archive if
+// the model is stored as a single archive
 func (provider DiskModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	if archivePath, _, found := findArchiveForModel(path.Join(provider.BaseDir, modelName), modelVersion); found {
+		fi, err := os.Stat(archivePath)
+		if err != nil {
+			return -1, err
+		}
+		return fi.Size(), nil
+	}
 	srcPath, err := findSrcPathForModel(path.Join(provider.BaseDir, modelName), modelVersion)
 	if err != nil {
 		return -1, err
 	}
-	fi, err := os.Stat(srcPath)
+	return cachemanager.DirSize(srcPath)
+}
+
+func (provider DiskModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	files, err := ioutil.ReadDir(path.Join(provider.BaseDir, modelName))
 	if err != nil {
-		return -1, err
+		log.WithError(err).Errorf("Could not list model versions: %s", modelName)
+		return nil, err
+	}
+	versions := make([]int64, 0, len(files))
+	for _, file := range files {
+		if version, err := strconv.ParseInt(file.Name(), 10, 64); err == nil && file.IsDir() {
+			versions = append(versions, version)
+		} else if version, _, ok := archive.ParseVersion(file.Name()); ok && !file.IsDir() {
+			versions = append(versions, version)
+		}
 	}
-	// get the size
-	size := fi.Size()
-	return size, nil
+	return versions, nil
 }
 
 func (provider DiskModelProvider) Check() bool {
@@ -1,13 +1,19 @@
 package diskmodelprovider
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
 )
 
 func createDummyModelFile(modelRepo string, name string, version string) {
@@ -85,3 +91,93 @@ func TestDiskModelProviderLoadsCanMatchPrefixZeros(t *testing.T) {
 		t.Errorf("Wrong model version after load")
 	}
 }
+
+func TestDiskModelProviderListsModelVersions(t *testing.T) {
+	modelDir, err := ioutil.TempDir("", ".testModelDir")
+	if err != nil {
+		log.WithError(err).Panicf("Error creating model file")
+	}
+	defer os.RemoveAll(modelDir)
+	createDummyModelFile(modelDir, "myModel", "1")
+	createDummyModelFile(modelDir, "myModel", "0042")
+	createDummyModelFile(modelDir, "myModel", "notAVersion")
+	createDummyModelFile(modelDir, "someDifferentModel", "22")
+
+	provider := DiskModelProvider{BaseDir: modelDir}
+
+	versions, err := provider.ModelVersions("myModel")
+	if err != nil {
+		t.Fatalf("Error listing model versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) != 2 || versions[0] != 1 || versions[1] != 42 {
+		t.Errorf("Wrong model versions: %v", versions)
+	}
+}
+
+func TestDiskModelProviderLoadsModelArchive(t *testing.T) {
+	modelDir, err := ioutil.TempDir("", ".testModelDir")
+	if err != nil {
+		log.WithError(err).Panicf("Error creating model file")
+	}
+	modelDestDir, err := ioutil.TempDir("", ".testModelDestDir")
+	defer os.RemoveAll(modelDir)
+	defer os.RemoveAll(modelDestDir)
+	createDummyModelFile(modelDir, "myModel", "1")
+	err = ioutil.WriteFile(filepath.Join(modelDir, "myModel", "1", "saved_model.pb"), make([]byte, 100), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "saved_model.pb", Mode: 0644, Size: 1000, Typeflag: tar.TypeReg})
+	tw.Write(make([]byte, 1000))
+	tw.Close()
+	gz.Close()
+	archivePath := filepath.Join(modelDir, "myModel", "2.tar.gz")
+	if err := ioutil.WriteFile(archivePath, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := DiskModelProvider{BaseDir: modelDir}
+	versions, err := provider.ModelVersions("myModel")
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if err != nil || len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Wrong model versions: %v", versions)
+	}
+
+	// The size of a model dir is the size of its files
+	size, err := provider.ModelSize("myModel", 1)
+	if err != nil || size != 100 {
+		t.Errorf("Expected model size 100, but got %d (err: %v)", size, err)
+	}
+	model, err := provider.LoadModel("myModel", 1, modelDestDir)
+	if err != nil || model.SizeOnDisk != 100 {
+		t.Errorf("Expected loaded model size 100, but got %v (err: %v)", model, err)
+	}
+
+	// The size of an archive is its compressed size, while the loaded model has the extracted size
+	size, err = provider.ModelSize("myModel", 2)
+	if err != nil || size != int64(buf.Len()) {
+		t.Errorf("Expected model size %d, but got %d (err: %v)", buf.Len(), size, err)
+	}
+	model, err = provider.LoadModel("myModel", 2, modelDestDir)
+	if err != nil {
+		t.Fatalf("Error loading model archive: %v", err)
+	}
+	if model.SizeOnDisk != 1000 || model.Path != filepath.Join("myModel", "2") {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	if fi, err := os.Stat(filepath.Join(modelDestDir, model.Path, "saved_model.pb")); err != nil || fi.Size() != 1000 {
+		t.Errorf("Expected model archive to be extracted (err: %v)", err)
+	}
+
+	// The extracted files may not exceed the archive limits of the provider
+	limited := DiskModelProvider{BaseDir: modelDir, ArchiveLimits: archive.Limits{MaxSize: 500}}
+	os.RemoveAll(filepath.Join(modelDestDir, model.Path))
+	if _, err := limited.LoadModel("myModel", 2, modelDestDir); err == nil {
+		t.Errorf("Expected model archive exceeding the limits to be rejected")
+	}
+}
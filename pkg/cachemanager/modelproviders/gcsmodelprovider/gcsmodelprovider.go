@@ -0,0 +1,256 @@
+package gcsmodelprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
+)
+
+// checkTimeout is the max time to wait for GCS when checking the health of the provider
+const checkTimeout = 10 * time.Second
+
+// GCSModelProvider fetches models from Google Cloud Storage. Models are stored
+// as <ModelBaseDir>/<model name>/<version>/, like in the S3 model provider, or
+// as a single archive, e.g. <ModelBaseDir>/<model name>/<version>.tar.gz.
+type GCSModelProvider struct {
+	client       *storage.Client
+	Bucket       string
+	ModelBaseDir string
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
+}
+
+// NewGCSModelProvider creates a model provider for the given bucket. Without
+// options, the client authenticates with Application Default Credentials, which
+// includes workload identity on GKE. Use option.WithCredentialsFile to
+// authenticate with a service account key instead.
+func NewGCSModelProvider(bucket string, modelBaseDir string, opts ...option.ClientOption) (*GCSModelProvider, error) {
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		log.WithError(err).Error("Could not create GCS client")
+		return nil, err
+	}
+	return &GCSModelProvider{
+		client:       client,
+		Bucket:       bucket,
+		ModelBaseDir: strings.Trim(modelBaseDir, "/"),
+	}, nil
+}
+
+func (provider GCSModelProvider) LoadModel(modelName string, modelVersion int64, destinationDir string) (*cachemanager.Model, error) {
+	log.Infof("Fetching model from GCS %s:%d", modelName, modelVersion)
+	modelPrefix := provider.getKeyForModel(modelName, modelVersion)
+
+	destPath := filepath.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
+	ctx := context.Background()
+	archiveObj, format, objects, err := provider.modelObjects(ctx, modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model: %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	if archiveObj != nil {
+		return provider.extractModel(ctx, modelName, modelVersion, archiveObj, format, destPath)
+	}
+	err = os.MkdirAll(destPath, 0777)
+	if err != nil {
+		log.WithError(err).Errorf("Could not create model dir: %s", destPath)
+		return nil, err
+	}
+
+	totalSize := int64(0)
+	for _, obj := range objects {
+		fname := filepath.Join(destPath, filepath.FromSlash(strings.TrimPrefix(obj.Name, modelPrefix)))
+		if !strings.HasPrefix(fname, destPath+string(filepath.Separator)) {
+			err = fmt.Errorf("Object is outside of model dir: %s", obj.Name)
+			log.WithError(err).Errorf("Could not download model: %s:%d", modelName, modelVersion)
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+			log.WithError(err).Errorf("Could not create object dir: %s", filepath.Dir(fname))
+			return nil, err
+		}
+		size, err := provider.download(ctx, obj.Name, fname)
+		if err != nil {
+			log.WithError(err).Errorf("Could not download object file: %s", obj.Name)
+			return nil, err
+		}
+		totalSize += size
+	}
+
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       filepath.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: totalSize,
+	}, nil
+}
+
+// download writes the object with the given name to the file fname and returns its size
+func (provider GCSModelProvider) download(ctx context.Context, name string, fname string) (int64, error) {
+	reader, err := provider.client.Bucket(provider.Bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	f, err := os.Create(fname)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// extractModel downloads the model archive and extracts it to destPath
+func (provider GCSModelProvider) extractModel(ctx context.Context, modelName string, modelVersion int64,
+	obj *storage.ObjectAttrs, format archive.Format, destPath string) (*cachemanager.Model, error) {
+	reader, err := provider.client.Bucket(provider.Bucket).Object(obj.Name).NewReader(ctx)
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model archive: %s", obj.Name)
+		return nil, err
+	}
+	defer reader.Close()
+	modelSize, err := archive.Extract(reader, format, destPath, provider.ArchiveLimits)
+	if err != nil {
+		log.WithError(err).Errorf("Could not extract model archive: %s", obj.Name)
+		return nil, err
+	}
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       filepath.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: modelSize,
+	}, nil
+}
+
+// modelObjects lists the objects of a model version with a single listing of the
+// prefix <model>/<version>. Objects are listed in lexicographic order, so the archives
+// of the version (<version>.tar.gz) come before the objects in the version "folder"
+// (<version>/...), which come before the objects of other versions with the same
+// prefix (<version>0/...). It returns the archive if the model version is stored as
+// a single archive, and otherwise the objects in the version folder.
+func (provider GCSModelProvider) modelObjects(ctx context.Context, modelName string, modelVersion int64) (*storage.ObjectAttrs, archive.Format, []*storage.ObjectAttrs, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	versionPrefix := modelPrefix + strconv.FormatInt(modelVersion, 10)
+	query := &storage.Query{Prefix: versionPrefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return nil, "", nil, err
+	}
+	objects := []*storage.ObjectAttrs{}
+	it := provider.client.Bucket(provider.Bucket).Objects(ctx, query)
+	for {
+		obj, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil, "", objects, nil
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Error accessing model on GCS. Bucket: %s, prefix: %s", provider.Bucket, versionPrefix)
+			return nil, "", nil, err
+		}
+		rest := strings.TrimPrefix(obj.Name, versionPrefix)
+		switch {
+		case strings.HasPrefix(rest, "/"):
+			if !strings.HasSuffix(rest, "/") {
+				// Is not a folder
+				objects = append(objects, obj)
+			}
+		case rest > "/":
+			// All following objects belong to other versions
+			return nil, "", objects, nil
+		default:
+			if version, format, ok := archive.ParseVersion(strings.TrimPrefix(obj.Name, modelPrefix)); ok && version == modelVersion {
+				return obj, format, nil, nil
+			}
+		}
+	}
+}
+
+// ModelSize returns the size of the model objects, or the size of the archive if
+// the model is stored as a single archive
+func (provider GCSModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	archiveObj, _, objects, err := provider.modelObjects(context.Background(), modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
+		return 0, err
+	}
+	if archiveObj != nil {
+		return archiveObj.Size, nil
+	}
+	totalSize := int64(0)
+	for _, obj := range objects {
+		totalSize += obj.Size
+	}
+	return totalSize, nil
+}
+
+func (provider GCSModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	query := &storage.Query{Prefix: modelPrefix, Delimiter: "/"}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	versions := []int64{}
+	it := provider.client.Bucket(provider.Bucket).Objects(context.Background(), query)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Error listing model versions on GCS. Bucket: %s, prefix: %s", provider.Bucket, modelPrefix)
+			return nil, err
+		}
+		// Versions are either archives or "folders" of the model, which are returned as prefixes
+		if attrs.Prefix == "" {
+			if version, _, ok := archive.ParseVersion(strings.TrimPrefix(attrs.Name, modelPrefix)); ok {
+				versions = append(versions, version)
+			}
+			continue
+		}
+		versionStr := strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, modelPrefix), "/")
+		if version, err := strconv.ParseInt(versionStr, 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+func (provider GCSModelProvider) getKeyForModel(modelName string, modelVersion int64) string {
+	return fmt.Sprintf("%s%d/", provider.getKeyForModelName(modelName), modelVersion)
+}
+
+// getKeyForModelName returns the prefix of all versions of a model
+func (provider GCSModelProvider) getKeyForModelName(modelName string) string {
+	if provider.ModelBaseDir == "" {
+		return modelName + "/"
+	}
+	return fmt.Sprintf("%s/%s/", provider.ModelBaseDir, modelName)
+}
+
+func (provider GCSModelProvider) Check() bool {
+	// List a single object to check that the bucket is accessible. Unlike reading the
+	// bucket metadata, this only requires the permissions needed to fetch models.
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	query := &storage.Query{Prefix: provider.ModelBaseDir}
+	_, err := provider.client.Bucket(provider.Bucket).Objects(ctx, query).Next()
+	if err != nil && !errors.Is(err, iterator.Done) {
+		log.WithError(err).Errorf("Error accessing models on GCS. Bucket: %s", provider.Bucket)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,277 @@
+package gcsmodelprovider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// fakeGCS is a minimal GCS server that supports listing and downloading objects.
+// It returns at most pageSize objects per page to test pagination.
+type fakeGCS struct {
+	bucket   string
+	objects  map[string]string
+	pageSize int
+	// lists is the number of list requests
+	lists int32
+}
+
+type fakeObject struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	Size   string `json:"size"`
+}
+
+func (gcs *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	listPath := "/storage/v1/b/" + gcs.bucket + "/o"
+	switch {
+	case r.URL.Path == listPath:
+		gcs.list(w, r)
+	case strings.HasPrefix(r.URL.Path, "/download"+listPath+"/"):
+		gcs.download(w, strings.TrimPrefix(r.URL.Path, "/download"+listPath+"/"))
+	case strings.HasPrefix(r.URL.Path, "/"+gcs.bucket+"/"):
+		gcs.download(w, strings.TrimPrefix(r.URL.Path, "/"+gcs.bucket+"/"))
+	default:
+		http.Error(w, `{"error": {"code": 404, "message": "Not found"}}`, http.StatusNotFound)
+	}
+}
+
+func (gcs *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&gcs.lists, 1)
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	names := make([]string, 0, len(gcs.objects))
+	for name := range gcs.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := []fakeObject{}
+	prefixes := []string{}
+	seenPrefixes := map[string]bool{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+1]
+				if !seenPrefixes[p] {
+					seenPrefixes[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		items = append(items, fakeObject{Bucket: gcs.bucket, Name: name, Size: strconv.Itoa(len(gcs.objects[name]))})
+	}
+
+	res := map[string]interface{}{"kind": "storage#objects", "prefixes": prefixes}
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	end := start + gcs.pageSize
+	if end < len(items) {
+		res["nextPageToken"] = strconv.Itoa(end)
+	} else {
+		end = len(items)
+	}
+	res["items"] = items[start:end]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (gcs *fakeGCS) download(w http.ResponseWriter, name string) {
+	content, exists := gcs.objects[name]
+	if !exists {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Write([]byte(content))
+}
+
+func modelArchive(t *testing.T, files map[string]string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.String()
+}
+
+func setupFakeGCS(t *testing.T, basePath string) (*GCSModelProvider, *fakeGCS, func()) {
+	gcs := &fakeGCS{
+		bucket:   "models",
+		pageSize: 2,
+		objects: map[string]string{
+			"base/foo/1/saved_model.pb":                  "v1",
+			"base/foo/2/":                                "",
+			"base/foo/2/saved_model.pb":                  "model",
+			"base/foo/2/variables/variables.index":       "index",
+			"base/foo/2/variables/variables.data-0-of-1": "data",
+			"base/foo/10/saved_model.pb":                 "v10",
+			"base/foo/3.tar.gz": modelArchive(t, map[string]string{
+				"saved_model.pb":            "archived",
+				"variables/variables.index": "index",
+			}),
+			"base/foo/notaversion/saved_model.pb": "x",
+			"base/foobar/3/saved_model.pb":        "other",
+			"other/foo/4/saved_model.pb":          "other",
+		},
+	}
+	server := httptest.NewServer(gcs)
+	provider, err := NewGCSModelProvider(gcs.bucket, basePath,
+		option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Error creating provider: %v", err)
+	}
+	return provider, gcs, func() {
+		provider.client.Close()
+		server.Close()
+	}
+}
+
+func TestGCSModelProviderLoadsModel(t *testing.T) {
+	provider, _, cleanup := setupFakeGCS(t, "base")
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatalf("Error creating dest dir: %v", err)
+	}
+	defer os.RemoveAll(destDir)
+
+	model, err := provider.LoadModel("foo", 2, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.Path != filepath.Join("foo", "2") || model.SizeOnDisk != int64(len("model")+len("index")+len("data")) {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	for file, expected := range map[string]string{
+		"saved_model.pb":                  "model",
+		"variables/variables.index":       "index",
+		"variables/variables.data-0-of-1": "data",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(destDir, model.Path, file))
+		if err != nil || string(content) != expected {
+			t.Errorf("Expected %s to contain %q, but got %q (err: %v)", file, expected, string(content), err)
+		}
+	}
+
+	size, err := provider.ModelSize("foo", 2)
+	if err != nil || size != model.SizeOnDisk {
+		t.Errorf("Expected model size %d, but got %d (err: %v)", model.SizeOnDisk, size, err)
+	}
+	if _, err := provider.LoadModel("foo", 1, filepath.Join(destDir, "missing", "\x00")); err == nil {
+		t.Errorf("Expected error when loading to invalid dir")
+	}
+}
+
+func TestGCSModelProviderLoadsModelArchive(t *testing.T) {
+	provider, gcs, cleanup := setupFakeGCS(t, "base")
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatalf("Error creating dest dir: %v", err)
+	}
+	defer os.RemoveAll(destDir)
+
+	size, err := provider.ModelSize("foo", 3)
+	if archiveSize := int64(len(gcs.objects["base/foo/3.tar.gz"])); err != nil || size != archiveSize {
+		t.Errorf("Expected model size %d, but got %d (err: %v)", archiveSize, size, err)
+	}
+	model, err := provider.LoadModel("foo", 3, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.Path != filepath.Join("foo", "3") || model.SizeOnDisk != int64(len("archived")+len("index")) {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(destDir, model.Path, "variables", "variables.index"))
+	if err != nil || string(content) != "index" {
+		t.Errorf("Expected model archive to be extracted, but got %q (err: %v)", string(content), err)
+	}
+}
+
+func TestGCSModelProviderListsModelOnce(t *testing.T) {
+	provider, gcs, cleanup := setupFakeGCS(t, "base")
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatalf("Error creating dest dir: %v", err)
+	}
+	defer os.RemoveAll(destDir)
+
+	// The archive is found in the first page of the listing
+	if _, err := provider.LoadModel("foo", 3, destDir); err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if lists := atomic.LoadInt32(&gcs.lists); lists != 1 {
+		t.Errorf("Expected 1 list request when loading an archive, but got %d", lists)
+	}
+
+	// Version 10 shares the prefix of version 1, but is not part of it
+	atomic.StoreInt32(&gcs.lists, 0)
+	model, err := provider.LoadModel("foo", 1, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.SizeOnDisk != int64(len("v1")) {
+		t.Errorf("Expected only the objects of version 1, but got size %d", model.SizeOnDisk)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "foo", "1", "0")); !os.IsNotExist(err) {
+		t.Errorf("Expected objects of version 10 not to be downloaded")
+	}
+	if lists := atomic.LoadInt32(&gcs.lists); lists != 1 {
+		t.Errorf("Expected 1 list request when loading a model folder, but got %d", lists)
+	}
+}
+
+func TestGCSModelProviderListsVersions(t *testing.T) {
+	provider, _, cleanup := setupFakeGCS(t, "base")
+	defer cleanup()
+
+	versions, err := provider.ModelVersions("foo")
+	if err != nil {
+		t.Fatalf("Error listing versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) != 4 || versions[0] != 1 || versions[1] != 2 || versions[2] != 3 || versions[3] != 10 {
+		t.Errorf("Expected versions [1 2 3 10], but got %v", versions)
+	}
+}
+
+func TestGCSModelProviderCheck(t *testing.T) {
+	provider, gcs, cleanup := setupFakeGCS(t, "base")
+	defer cleanup()
+	if !provider.Check() {
+		t.Errorf("Expected check to succeed")
+	}
+	provider.Bucket = "missing"
+	if provider.Check() {
+		t.Errorf("Expected check to fail for inaccessible bucket")
+	}
+	provider.Bucket = gcs.bucket
+	provider.ModelBaseDir = "empty"
+	if !provider.Check() {
+		t.Errorf("Expected check to succeed for empty bucket")
+	}
+}
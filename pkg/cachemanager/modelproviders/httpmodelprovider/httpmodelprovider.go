@@ -0,0 +1,234 @@
+package httpmodelprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
+)
+
+// checkTimeout is the max time to wait for the server when checking the health of the provider
+const checkTimeout = 10 * time.Second
+
+// ErrVersionsNotSupported is returned when listing model versions without a versions URL
+var ErrVersionsNotSupported = errors.New("Listing model versions requires a versions URL")
+
+// HTTPModelProvider fetches models as archives over HTTP(S). The URL of a model
+// is built from URLTemplate, where {name} and {version} are replaced by the
+// model name and version, e.g. https://host/models/{name}/{version}.tar.gz
+type HTTPModelProvider struct {
+	client      *http.Client
+	URLTemplate string
+	// VersionsURLTemplate is the URL of a JSON list of the versions of a model,
+	// where {name} is replaced by the model name. Optional.
+	VersionsURLTemplate string
+	// CheckURL is requested to check the health of the provider. Optional.
+	CheckURL string
+	// Format is the archive format. If empty, it is detected from the model URL.
+	Format archive.Format
+	// BearerToken, or Username and Password, authenticate the requests
+	BearerToken string
+	Username    string
+	Password    string
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
+}
+
+// NewHTTPModelProvider creates a model provider for the given URL template. The
+// timeout is the max time to wait for the response headers, while downloads
+// may take longer. 0 means no timeout.
+func NewHTTPModelProvider(urlTemplate string, timeout time.Duration) (*HTTPModelProvider, error) {
+	if !strings.Contains(urlTemplate, "{name}") || !strings.Contains(urlTemplate, "{version}") {
+		return nil, fmt.Errorf("URL template must contain {name} and {version}: %s", urlTemplate)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	return &HTTPModelProvider{
+		client:      &http.Client{Transport: transport},
+		URLTemplate: urlTemplate,
+	}, nil
+}
+
+func (provider HTTPModelProvider) LoadModel(modelName string, modelVersion int64, destinationDir string) (*cachemanager.Model, error) {
+	modelURL := provider.modelURL(modelName, modelVersion)
+	log.Infof("Fetching model from %s", modelURL)
+	format, err := provider.format(modelURL)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := provider.do(context.Background(), http.MethodGet, modelURL)
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model: %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	destPath := filepath.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
+	size, err := archive.Extract(res.Body, format, destPath, provider.ArchiveLimits)
+	if err != nil {
+		log.WithError(err).Errorf("Could not extract model: %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       filepath.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: size,
+	}, nil
+}
+
+// ModelSize returns the size of the model archive. If the server does not send
+// the Content-Length of a HEAD request, the size is read from the Content-Range of
+// a request for the first byte of the archive. The size is an error if it is unknown.
+func (provider HTTPModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	modelURL := provider.modelURL(modelName, modelVersion)
+	res, err := provider.do(context.Background(), http.MethodHead, modelURL)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
+		return 0, err
+	}
+	res.Body.Close()
+	if res.ContentLength >= 0 {
+		return res.ContentLength, nil
+	}
+	size, err := provider.rangeSize(modelURL)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
+		return 0, err
+	}
+	return size, nil
+}
+
+// rangeSize returns the size of the resource at the given URL from the response
+// to a request for its first byte
+func (provider HTTPModelProvider) rangeSize(reqURL string) (int64, error) {
+	req, err := provider.newRequest(context.Background(), http.MethodGet, reqURL)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	res, err := provider.send(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/<size>
+		contentRange := res.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+		return 0, fmt.Errorf("Unknown size in Content-Range of %s: %s", reqURL, contentRange)
+	}
+	if res.ContentLength >= 0 {
+		// The server ignored the range
+		return res.ContentLength, nil
+	}
+	return 0, fmt.Errorf("Server sends neither Content-Length nor Content-Range: %s", reqURL)
+}
+
+func (provider HTTPModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	if provider.VersionsURLTemplate == "" {
+		return nil, ErrVersionsNotSupported
+	}
+	versionsURL := strings.ReplaceAll(provider.VersionsURLTemplate, "{name}", url.PathEscape(modelName))
+	res, err := provider.do(context.Background(), http.MethodGet, versionsURL)
+	if err != nil {
+		log.WithError(err).Errorf("Error listing model versions: %s", versionsURL)
+		return nil, err
+	}
+	defer res.Body.Close()
+	versions := []int64{}
+	if err := json.NewDecoder(res.Body).Decode(&versions); err != nil {
+		log.WithError(err).Errorf("Invalid model versions: %s", versionsURL)
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (provider HTTPModelProvider) Check() bool {
+	if provider.CheckURL == "" {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	res, err := provider.do(ctx, http.MethodGet, provider.CheckURL)
+	if err != nil {
+		log.WithError(err).Errorf("Error accessing model server: %s", provider.CheckURL)
+		return false
+	}
+	res.Body.Close()
+	return true
+}
+
+func (provider HTTPModelProvider) modelURL(modelName string, modelVersion int64) string {
+	return strings.NewReplacer(
+		"{name}", url.PathEscape(modelName),
+		"{version}", strconv.FormatInt(modelVersion, 10),
+	).Replace(provider.URLTemplate)
+}
+
+// format returns the archive format of the model at the given URL
+func (provider HTTPModelProvider) format(modelURL string) (archive.Format, error) {
+	if provider.Format != "" {
+		return provider.Format, nil
+	}
+	u, err := url.Parse(modelURL)
+	if err != nil {
+		return "", err
+	}
+	format, ok := archive.FormatFromName(u.Path)
+	if !ok {
+		return "", fmt.Errorf("Unknown archive format of model URL: %s", modelURL)
+	}
+	return format, nil
+}
+
+// do sends an authenticated request and returns an error if the response is not successful
+func (provider HTTPModelProvider) do(ctx context.Context, method string, reqURL string) (*http.Response, error) {
+	req, err := provider.newRequest(ctx, method, reqURL)
+	if err != nil {
+		return nil, err
+	}
+	return provider.send(req)
+}
+
+// newRequest creates an authenticated request
+func (provider HTTPModelProvider) newRequest(ctx context.Context, method string, reqURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if provider.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.BearerToken)
+	} else if provider.Username != "" {
+		req.SetBasicAuth(provider.Username, provider.Password)
+	}
+	return req, nil
+}
+
+// send sends a request and returns an error if the response is not successful
+func (provider HTTPModelProvider) send(req *http.Request) (*http.Response, error) {
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status from %s: %s", req.URL, res.Status)
+	}
+	return res, nil
+}
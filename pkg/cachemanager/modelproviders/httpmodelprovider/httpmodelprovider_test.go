@@ -0,0 +1,180 @@
+package httpmodelprovider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func modelArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// setupModelServer serves the given archives at /models/<name>/<version>.tar.gz
+// and requires the given authorization header
+func setupModelServer(t *testing.T, authorization string, archives map[string][]byte) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/models/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		data, exists := archives[r.URL.Path]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	})
+	mux.HandleFunc("/versions/foo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[1, 2]"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHTTPModelProviderLoadsModel(t *testing.T) {
+	data := modelArchive(t, map[string]string{
+		"saved_model.pb":            "model",
+		"variables/variables.index": "index",
+	})
+	server := setupModelServer(t, "Bearer secret", map[string][]byte{"/models/foo/2.tar.gz": data})
+	defer server.Close()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	provider, err := NewHTTPModelProvider(server.URL+"/models/{name}/{version}.tar.gz", 0)
+	if err != nil {
+		t.Fatalf("Error creating provider: %v", err)
+	}
+	if _, err := provider.LoadModel("foo", 2, destDir); err == nil {
+		t.Errorf("Expected unauthenticated request to fail")
+	}
+
+	provider.BearerToken = "secret"
+	size, err := provider.ModelSize("foo", 2)
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("Expected model size %d, but got %d (err: %v)", len(data), size, err)
+	}
+	model, err := provider.LoadModel("foo", 2, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.Path != filepath.Join("foo", "2") || model.SizeOnDisk != int64(len("model")+len("index")) {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(destDir, "foo", "2", "variables", "variables.index"))
+	if err != nil || string(content) != "index" {
+		t.Errorf("Expected model files to be extracted, but got %q (err: %v)", string(content), err)
+	}
+
+	if _, err := provider.LoadModel("foo", 3, destDir); err == nil {
+		t.Errorf("Expected error when loading missing model")
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "foo", "3")); !os.IsNotExist(err) {
+		t.Errorf("Expected no model dir for missing model")
+	}
+}
+
+func TestHTTPModelProviderBasicAuth(t *testing.T) {
+	data := modelArchive(t, map[string]string{"saved_model.pb": "model"})
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("user", "pass")
+	server := setupModelServer(t, req.Header.Get("Authorization"), map[string][]byte{"/models/foo/1.tar.gz": data})
+	defer server.Close()
+
+	provider, _ := NewHTTPModelProvider(server.URL+"/models/{name}/{version}.tar.gz", 0)
+	provider.Username = "user"
+	provider.Password = "pass"
+	if size, err := provider.ModelSize("foo", 1); err != nil || size != int64(len(data)) {
+		t.Errorf("Expected model size %d, but got %d (err: %v)", len(data), size, err)
+	}
+}
+
+func TestHTTPModelProviderVersionsAndCheck(t *testing.T) {
+	server := setupModelServer(t, "", nil)
+	defer server.Close()
+
+	provider, _ := NewHTTPModelProvider(server.URL+"/models/{name}/{version}.tar.gz", 0)
+	if _, err := provider.ModelVersions("foo"); err != ErrVersionsNotSupported {
+		t.Errorf("Expected listing versions without versions URL to fail, but got: %v", err)
+	}
+	provider.VersionsURLTemplate = server.URL + "/versions/{name}"
+	versions, err := provider.ModelVersions("foo")
+	if err != nil || len(versions) != 2 || versions[1] != 2 {
+		t.Errorf("Expected versions [1 2], but got %v (err: %v)", versions, err)
+	}
+
+	if !provider.Check() {
+		t.Errorf("Expected check without check URL to succeed")
+	}
+	provider.CheckURL = server.URL + "/versions/foo"
+	if !provider.Check() {
+		t.Errorf("Expected check to succeed")
+	}
+	provider.CheckURL = server.URL + "/missing"
+	if provider.Check() {
+		t.Errorf("Expected check to fail")
+	}
+
+	if _, err := NewHTTPModelProvider(server.URL+"/models/{name}.tar.gz", 0); err == nil {
+		t.Errorf("Expected URL template without version to be rejected")
+	}
+}
+
+func TestHTTPModelProviderSizeWithoutContentLength(t *testing.T) {
+	data := modelArchive(t, map[string]string{"saved_model.pb": "model"})
+	mux := http.NewServeMux()
+	// Supports range requests, but does not send the Content-Length of HEAD requests
+	mux.HandleFunc("/ranged/foo/1.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		http.ServeContent(w, r, "1.tar.gz", time.Time{}, bytes.NewReader(data))
+	})
+	// Streams the archive without a known size
+	mux.HandleFunc("/streamed/foo/1.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write(data[:1])
+			w.(http.Flusher).Flush()
+			w.Write(data[1:])
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider, _ := NewHTTPModelProvider(server.URL+"/ranged/{name}/{version}.tar.gz", 0)
+	size, err := provider.ModelSize("foo", 1)
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("Expected model size %d from the Content-Range, but got %d (err: %v)", len(data), size, err)
+	}
+
+	provider, _ = NewHTTPModelProvider(server.URL+"/streamed/{name}/{version}.tar.gz", 0)
+	if size, err := provider.ModelSize("foo", 1); err == nil {
+		t.Errorf("Expected error for unknown model size, but got %d", size)
+	}
+}
@@ -0,0 +1,311 @@
+package ocimodelprovider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
+)
+
+const (
+	// checkTimeout is the max time to wait for the registry when checking the health of the provider
+	checkTimeout = 10 * time.Second
+	// titleAnnotation is the file name of a layer, as set by e.g. ORAS
+	titleAnnotation = "org.opencontainers.image.title"
+	// unpackAnnotation is set by ORAS on layers that are a tar.gz archive of a directory
+	unpackAnnotation = "io.deis.oras.content.unpack"
+)
+
+// OCIModelProvider fetches models stored as OCI artifacts or images in a registry.
+// A model version is stored as <Repository>/<model name>:<version>. The layers of
+// the manifest are either tar archives, which are extracted into the model
+// directory, or files named by their org.opencontainers.image.title annotation.
+type OCIModelProvider struct {
+	Repository name.Repository
+	// Auth authenticates with the registry. If nil, the credentials of the
+	// Docker config file are used, e.g. from docker login.
+	Auth        authn.Authenticator
+	nameOptions []name.Option
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
+}
+
+// NewOCIModelProvider creates a model provider for the given repository, e.g.
+// registry.example.com/models. If insecure is true, the registry may be accessed
+// over plain HTTP.
+func NewOCIModelProvider(repository string, auth authn.Authenticator, insecure bool) (*OCIModelProvider, error) {
+	var nameOptions []name.Option
+	if insecure {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	repo, err := name.NewRepository(repository, nameOptions...)
+	if err != nil {
+		log.WithError(err).Errorf("Invalid OCI repository: %s", repository)
+		return nil, err
+	}
+	return &OCIModelProvider{
+		Repository:  repo,
+		Auth:        auth,
+		nameOptions: nameOptions,
+	}, nil
+}
+
+func (provider OCIModelProvider) LoadModel(modelName string, modelVersion int64, destinationDir string) (*cachemanager.Model, error) {
+	log.Infof("Fetching model from OCI registry %s:%d", modelName, modelVersion)
+	img, manifest, err := provider.image(modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model manifest: %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+
+	destPath := filepath.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
+	if err := os.MkdirAll(destPath, 0777); err != nil {
+		log.WithError(err).Errorf("Could not create model dir: %s", destPath)
+		return nil, err
+	}
+	totalSize, err := provider.unpackLayers(img, manifest, destPath)
+	if err == nil {
+		err = archive.FlattenSingleDir(destPath)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Could not unpack model: %s:%d", modelName, modelVersion)
+		if removeErr := os.RemoveAll(destPath); removeErr != nil {
+			log.WithError(removeErr).Errorf("Could not remove partially fetched model: %s", destPath)
+		}
+		return nil, err
+	}
+
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       filepath.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: totalSize,
+	}, nil
+}
+
+// unpackLayers writes all layers of the manifest to destPath and returns the size of the written files
+func (provider OCIModelProvider) unpackLayers(img v1.Image, manifest *v1.Manifest, destPath string) (int64, error) {
+	totalSize := int64(0)
+	limiter := archive.NewLimiter(provider.ArchiveLimits)
+	for _, desc := range manifest.Layers {
+		size, err := provider.unpackLayer(img, desc, destPath, limiter)
+		if err != nil {
+			return 0, fmt.Errorf("Could not unpack layer %s: %w", desc.Digest, err)
+		}
+		totalSize += size
+	}
+	return totalSize, nil
+}
+
+// unpackLayer writes the layer to destPath and returns the size of the written files.
+// The digest of the layer is verified after it has been read completely.
+func (provider OCIModelProvider) unpackLayer(img v1.Image, desc v1.Descriptor, destPath string, limiter *archive.Limiter) (int64, error) {
+	layer, err := img.LayerByDigest(desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	reader, err := newVerifyingReader(rc, desc)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	title := desc.Annotations[titleAnnotation]
+	if desc.Annotations[unpackAnnotation] == "true" {
+		// A directory pushed by ORAS, which is always a tar.gz archive regardless of the media type
+		size, err = archive.Unpack(reader, archive.TarGz, destPath, limiter)
+	} else if title != "" {
+		// A file pushed by e.g. ORAS. Archives are extracted, while other files are written as is
+		if format, ok := archive.FormatFromName(title); ok {
+			size, err = archive.Unpack(reader, format, destPath, limiter)
+		} else {
+			size, err = archive.WriteFile(destPath, title, reader, limiter)
+		}
+	} else if format, ok := layerFormat(desc.MediaType); ok {
+		size, err = archive.Unpack(reader, format, destPath, limiter)
+	} else {
+		err = fmt.Errorf("Unsupported layer media type: %s", desc.MediaType)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, reader.verify()
+}
+
+// layerFormat returns the archive format of a layer media type
+func layerFormat(mediaType types.MediaType) (archive.Format, bool) {
+	switch mediaType {
+	case types.OCILayer, types.DockerLayer:
+		return archive.TarGz, true
+	case types.OCILayerZStd:
+		return archive.TarZst, true
+	case types.OCIUncompressedLayer, types.DockerUncompressedLayer:
+		return archive.Tar, true
+	}
+	return "", false
+}
+
+// verifyingReader computes the digest of the data read from a layer
+type verifyingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+	desc   v1.Descriptor
+}
+
+func newVerifyingReader(r io.Reader, desc v1.Descriptor) (*verifyingReader, error) {
+	if desc.Digest.Algorithm != "sha256" {
+		return nil, fmt.Errorf("Unsupported digest algorithm: %s", desc.Digest.Algorithm)
+	}
+	return &verifyingReader{reader: r, hash: sha256.New(), desc: desc}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+// verify reads the rest of the layer, and returns an error if its size or digest
+// do not match the descriptor
+func (r *verifyingReader) verify() error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if r.size != r.desc.Size {
+		return fmt.Errorf("Size of layer %s is %d, but expected %d", r.desc.Digest, r.size, r.desc.Size)
+	}
+	if digest := hex.EncodeToString(r.hash.Sum(nil)); digest != r.desc.Digest.Hex {
+		return fmt.Errorf("Digest of layer %s does not match: sha256:%s", r.desc.Digest, digest)
+	}
+	return nil
+}
+
+// ModelSize returns the total size of the layers of the model
+func (provider OCIModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	_, manifest, err := provider.image(modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
+		return 0, err
+	}
+	totalSize := int64(0)
+	for _, layer := range manifest.Layers {
+		totalSize += layer.Size
+	}
+	return totalSize, nil
+}
+
+// ModelVersions returns the tags of the model that are versions
+func (provider OCIModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	repo, err := provider.modelRepository(modelName)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := remote.List(repo, provider.remoteOptions(context.Background(), repo)...)
+	if err != nil {
+		log.WithError(err).Errorf("Could not list model versions: %s", repo)
+		return nil, err
+	}
+	versions := make([]int64, 0, len(tags))
+	for _, tag := range tags {
+		if version, err := strconv.ParseInt(tag, 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// Check checks that the registry is reachable and that the provider can authenticate with it
+func (provider OCIModelProvider) Check() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	registry := provider.Repository.Registry
+	tr, err := transport.NewWithContext(ctx, registry, provider.authenticator(provider.Repository),
+		http.DefaultTransport, []string{provider.Repository.Scope(transport.PullScope)})
+	if err != nil {
+		log.WithError(err).Errorf("Could not access OCI registry: %s", registry.RegistryStr())
+		return false
+	}
+	// Basic auth is not verified when creating the transport, so an authenticated
+	// request is sent to the API base endpoint
+	url := fmt.Sprintf("%s://%s/v2/", registry.Scheme(), registry.RegistryStr())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.WithError(err).Errorf("Could not create request to OCI registry: %s", url)
+		return false
+	}
+	res, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		log.WithError(err).Errorf("Could not access OCI registry: %s", registry.RegistryStr())
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Errorf("Could not access OCI registry: %s. Status: %s", registry.RegistryStr(), res.Status)
+		return false
+	}
+	return true
+}
+
+// image returns the image of a model version and its manifest
+func (provider OCIModelProvider) image(modelName string, modelVersion int64) (v1.Image, *v1.Manifest, error) {
+	repo, err := provider.modelRepository(modelName)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref := repo.Tag(strconv.FormatInt(modelVersion, 10))
+	img, err := remote.Image(ref, provider.remoteOptions(context.Background(), repo)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, manifest, nil
+}
+
+// modelRepository returns the repository of all versions of a model
+func (provider OCIModelProvider) modelRepository(modelName string) (name.Repository, error) {
+	return name.NewRepository(strings.TrimSuffix(provider.Repository.String(), "/")+"/"+modelName, provider.nameOptions...)
+}
+
+func (provider OCIModelProvider) remoteOptions(ctx context.Context, repo name.Repository) []remote.Option {
+	return []remote.Option{remote.WithContext(ctx), remote.WithAuth(provider.authenticator(repo))}
+}
+
+func (provider OCIModelProvider) authenticator(repo name.Repository) authn.Authenticator {
+	if provider.Auth != nil {
+		return provider.Auth
+	}
+	auth, err := authn.DefaultKeychain.Resolve(repo)
+	if err != nil {
+		log.WithError(err).Warnf("Could not resolve credentials of OCI registry: %s", repo.RegistryStr())
+		return authn.Anonymous
+	}
+	return auth
+}
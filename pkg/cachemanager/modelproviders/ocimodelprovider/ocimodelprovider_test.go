@@ -0,0 +1,254 @@
+package ocimodelprovider
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testRegistry is an in-process registry that requires basic auth, and can
+// corrupt the blobs it serves
+type testRegistry struct {
+	handler http.Handler
+	mux     sync.Mutex
+	corrupt bool
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	reg.mux.Lock()
+	corrupt := reg.corrupt
+	reg.mux.Unlock()
+	if corrupt && r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+		rec := httptest.NewRecorder()
+		reg.handler.ServeHTTP(rec, r)
+		body := rec.Body.Bytes()
+		body[len(body)-1] ^= 0xff
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+		return
+	}
+	reg.handler.ServeHTTP(w, r)
+}
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func push(t *testing.T, ref string, addenda ...mutate.Addendum) v1.Image {
+	img, err := mutate.Append(empty.Image, addenda...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatalf("Error pushing %s: %v", ref, err)
+	}
+	return img
+}
+
+func setupRegistry(t *testing.T) (*OCIModelProvider, *testRegistry, func()) {
+	reg := &testRegistry{handler: registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))}
+	server := httptest.NewServer(reg)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Version 1 is a single tar.gz layer with the model dir
+	push(t, host+"/models/foo:1", mutate.Addendum{
+		Layer: static.NewLayer(tarGz(t, map[string]string{
+			"model/saved_model.pb":            "model",
+			"model/variables/variables.index": "index",
+		}), types.OCILayer),
+	})
+	// Version 2 is pushed like ORAS does, with a file and a directory
+	push(t, host+"/models/foo:2",
+		mutate.Addendum{
+			Layer:       static.NewLayer([]byte("model2"), "application/vnd.tfservingcache.file"),
+			Annotations: map[string]string{titleAnnotation: "saved_model.pb"},
+		},
+		mutate.Addendum{
+			Layer: static.NewLayer(tarGz(t, map[string]string{"variables/variables.index": "index2"}), types.OCIUncompressedLayer),
+			Annotations: map[string]string{
+				titleAnnotation:  "variables",
+				unpackAnnotation: "true",
+			},
+		})
+	// A layer must not be written outside of the model dir
+	push(t, host+"/models/foo:3", mutate.Addendum{
+		Layer:       static.NewLayer([]byte("evil"), "application/vnd.tfservingcache.file"),
+		Annotations: map[string]string{titleAnnotation: "../evil"},
+	})
+	push(t, host+"/models/foo:latest", mutate.Addendum{
+		Layer: static.NewLayer(tarGz(t, map[string]string{"saved_model.pb": "x"}), types.OCILayer),
+	})
+
+	provider, err := NewOCIModelProvider(host+"/models", &authn.Basic{Username: "user", Password: "pass"}, true)
+	if err != nil {
+		t.Fatalf("Error creating provider: %v", err)
+	}
+	return provider, reg, server.Close
+}
+
+func assertFile(t *testing.T, path string, expected string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != expected {
+		t.Errorf("Expected %s to contain %q, but got %q (err: %v)", path, expected, string(content), err)
+	}
+}
+
+func TestOCIModelProviderLoadsModels(t *testing.T) {
+	provider, _, cleanup := setupRegistry(t)
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	model, err := provider.LoadModel("foo", 1, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.Path != filepath.Join("foo", "1") || model.SizeOnDisk != int64(len("model")+len("index")) {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	assertFile(t, filepath.Join(destDir, "foo", "1", "saved_model.pb"), "model")
+	assertFile(t, filepath.Join(destDir, "foo", "1", "variables", "variables.index"), "index")
+
+	model, err = provider.LoadModel("foo", 2, destDir)
+	if err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if model.SizeOnDisk != int64(len("model2")+len("index2")) {
+		t.Errorf("Unexpected model: %+v", model)
+	}
+	assertFile(t, filepath.Join(destDir, "foo", "2", "saved_model.pb"), "model2")
+	assertFile(t, filepath.Join(destDir, "foo", "2", "variables", "variables.index"), "index2")
+
+	if _, err := provider.LoadModel("foo", 3, destDir); err == nil {
+		t.Errorf("Expected layer outside of model dir to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "foo", "evil")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside of model dir")
+	}
+	if _, err := provider.LoadModel("foo", 4, destDir); err == nil {
+		t.Errorf("Expected error when loading missing model")
+	}
+}
+
+func TestOCIModelProviderVerifiesDigest(t *testing.T) {
+	provider, reg, cleanup := setupRegistry(t)
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	reg.mux.Lock()
+	reg.corrupt = true
+	reg.mux.Unlock()
+	if _, err := provider.LoadModel("foo", 2, destDir); err == nil {
+		t.Errorf("Expected corrupted layer to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "foo", "2")); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupted model to be removed")
+	}
+}
+
+func TestOCIModelProviderSizeVersionsAndCheck(t *testing.T) {
+	provider, _, cleanup := setupRegistry(t)
+	defer cleanup()
+
+	size, err := provider.ModelSize("foo", 2)
+	if err != nil {
+		t.Fatalf("Error getting model size: %v", err)
+	}
+	_, manifest, _ := provider.image("foo", 2)
+	if expected := manifest.Layers[0].Size + manifest.Layers[1].Size; size != expected {
+		t.Errorf("Expected model size %d, but got %d", expected, size)
+	}
+
+	versions, err := provider.ModelVersions("foo")
+	if err != nil {
+		t.Fatalf("Error listing versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) != 3 || versions[0] != 1 || versions[2] != 3 {
+		t.Errorf("Expected versions [1 2 3], but got %v", versions)
+	}
+
+	if !provider.Check() {
+		t.Errorf("Expected check to succeed")
+	}
+	provider.Auth = &authn.Basic{Username: "user", Password: "wrong"}
+	if provider.Check() {
+		t.Errorf("Expected check with wrong credentials to fail")
+	}
+	if _, err := provider.ModelSize("foo", 1); err == nil {
+		t.Errorf("Expected request with wrong credentials to fail")
+	}
+}
+
+func TestOCIModelProviderRemovesModelWhenFlatteningFails(t *testing.T) {
+	provider, _, cleanup := setupRegistry(t)
+	defer cleanup()
+	destDir, err := ioutil.TempDir("", ".testModelDestDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destDir)
+
+	// The single dir of the layer contains an entry with the name used while flattening it
+	push(t, provider.Repository.String()+"/foo:5", mutate.Addendum{
+		Layer: static.NewLayer(tarGz(t, map[string]string{
+			"model/.archive-root/saved_model.pb": "model",
+		}), types.OCILayer),
+	})
+	if _, err := provider.LoadModel("foo", 5, destDir); err == nil {
+		t.Fatalf("Expected error when the model dir cannot be flattened")
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "foo", "5")); !os.IsNotExist(err) {
+		t.Errorf("Expected partially fetched model to be removed")
+	}
+}
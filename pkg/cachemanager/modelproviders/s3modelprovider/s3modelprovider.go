@@ -13,6 +13,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
+	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/archive"
 )
 
 type S3Location struct {
@@ -27,6 +28,8 @@ type S3ModelProvider struct {
 	s3           *s3.S3
 	Bucket       string
 	ModelBaseDir string
+	// ArchiveLimits bounds the files extracted from a model archive. Zero means no limit.
+	ArchiveLimits archive.Limits
 }
 
 func NewS3ModelProvider(bucket string, modelBaseDir string) (*S3ModelProvider, error) {
@@ -53,15 +56,23 @@ func (provider S3ModelProvider) LoadModel(modelName string, modelVersion int64,
 	modelLocation := provider.getKeyForModel(modelName, modelVersion)
 
 	destPath := path.Join(destinationDir, modelName, strconv.FormatInt(modelVersion, 10))
-	err := os.MkdirAll(destPath, 0777)
+	archiveObj, format, objects, err := provider.modelObjects(modelName, modelVersion)
+	if err != nil {
+		log.WithError(err).Errorf("Could not download model: %s:%d", modelName, modelVersion)
+		return nil, err
+	}
+	if archiveObj != nil {
+		return provider.extractModel(modelName, modelVersion, archiveObj, format, destPath)
+	}
+	err = os.MkdirAll(destPath, 0777)
 	if err != nil {
 		log.WithError(err).Errorf("Could not create model dir: %s", destPath)
 		return nil, err
 	}
 
 	totalSize := int64(0)
-
-	downloadObjFunc := func(relativeKey string, obj *s3.Object) error {
+	for _, obj := range objects {
+		relativeKey := strings.TrimPrefix(*obj.Key, modelLocation.KeyPrefix)
 		if strings.Contains(relativeKey, "/") {
 			// Make sure dir is created
 			paths := strings.Split(relativeKey, "/")
@@ -69,7 +80,7 @@ func (provider S3ModelProvider) LoadModel(modelName string, modelVersion int64,
 			err := os.MkdirAll(objFolder, 0777)
 			if err != nil {
 				log.WithError(err).Errorf("Could not create object dir: %s", objFolder)
-				return err
+				return nil, err
 			}
 		}
 		// Download to file
@@ -77,96 +88,162 @@ func (provider S3ModelProvider) LoadModel(modelName string, modelVersion int64,
 		f, err := os.Create(fname)
 		if err != nil {
 			log.WithError(err).Errorf("Could not create object file: %s", fname)
-			return err
+			return nil, err
 		}
 		sizeOnDisk, err := provider.downloader.Download(f, &s3.GetObjectInput{
 			Bucket: &modelLocation.Bucket,
 			Key:    obj.Key,
 		})
+		f.Close()
 		if err != nil {
 			log.WithError(err).Errorf("Could not download object file: %s", *obj.Key)
-			return err
+			return nil, err
 		}
 		totalSize += sizeOnDisk
-
-		return nil
 	}
 
-	err = provider.modelObjectApply(modelLocation, downloadObjFunc)
+	return &cachemanager.Model{
+		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       path.Join(modelName, strconv.FormatInt(modelVersion, 10)),
+		SizeOnDisk: totalSize,
+	}, nil
+}
+
+// extractModel downloads the model archive and extracts it to destPath
+func (provider S3ModelProvider) extractModel(modelName string, modelVersion int64, obj *s3.Object, format archive.Format, destPath string) (*cachemanager.Model, error) {
+	res, err := provider.s3.GetObject(&s3.GetObjectInput{
+		Bucket: &provider.Bucket,
+		Key:    obj.Key,
+	})
 	if err != nil {
-		log.WithError(err).Errorf("Could not download model: %s:%d", modelName, modelVersion)
+		log.WithError(err).Errorf("Could not download model archive: %s", *obj.Key)
+		return nil, err
+	}
+	defer res.Body.Close()
+	modelSize, err := archive.Extract(res.Body, format, destPath, provider.ArchiveLimits)
+	if err != nil {
+		log.WithError(err).Errorf("Could not extract model archive: %s", *obj.Key)
 		return nil, err
 	}
-
 	return &cachemanager.Model{
 		Identifier: cachemanager.ModelIdentifier{ModelName: modelName, Version: modelVersion},
 		Path:       path.Join(modelName, strconv.FormatInt(modelVersion, 10)),
-		SizeOnDisk: totalSize,
+		SizeOnDisk: modelSize,
 	}, nil
 }
 
-func (provider S3ModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
-	modelLocation := provider.getKeyForModel(modelName, modelVersion)
-	totalSize := int64(0)
-	countSizeFunc := func(relativeKey string, obj *s3.Object) error {
-		totalSize += *obj.Size
-		return nil
+// modelObjects lists the objects of a model version with a single listing of the
+// prefix <model>/<version>. Keys are listed in lexicographic order, so the archives
+// of the version (<version>.tar.gz) come before the objects in the version "folder"
+// (<version>/...), which come before the objects of other versions with the same
+// prefix (<version>0/...). It returns the archive if the model version is stored as
+// a single archive, and otherwise the objects in the version folder.
+func (provider S3ModelProvider) modelObjects(modelName string, modelVersion int64) (*s3.Object, archive.Format, []*s3.Object, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	versionPrefix := modelPrefix + strconv.FormatInt(modelVersion, 10)
+	objects := []*s3.Object{}
+	isTruncated := true
+	var continuationToken *string = nil
+	for isTruncated {
+		res, err := provider.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            &provider.Bucket,
+			Prefix:            &versionPrefix,
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			log.WithError(err).Errorf("Error accessing model on S3. Bucket: %s, keyPrefix: %s", provider.Bucket, versionPrefix)
+			return nil, "", nil, err
+		}
+		for _, obj := range res.Contents {
+			rest := strings.TrimPrefix(*obj.Key, versionPrefix)
+			switch {
+			case strings.HasPrefix(rest, "/"):
+				if !strings.HasSuffix(rest, "/") {
+					// Is not a folder
+					objects = append(objects, obj)
+				}
+			case rest > "/":
+				// All following objects belong to other versions
+				return nil, "", objects, nil
+			default:
+				if version, format, ok := archive.ParseVersion(strings.TrimPrefix(*obj.Key, modelPrefix)); ok && version == modelVersion {
+					return obj, format, nil, nil
+				}
+			}
+		}
+		isTruncated = *res.IsTruncated
+		continuationToken = res.NextContinuationToken
 	}
+	return nil, "", objects, nil
+}
 
-	err := provider.modelObjectApply(modelLocation, countSizeFunc)
+// ModelSize returns the size of the model objects, or the size of the archive if
+// the model is stored as a single archive
+func (provider S3ModelProvider) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	archiveObj, _, objects, err := provider.modelObjects(modelName, modelVersion)
 	if err != nil {
 		log.WithError(err).Errorf("Could not get model size: %s:%d", modelName, modelVersion)
 		return 0, err
 	}
+	if archiveObj != nil {
+		return *archiveObj.Size, nil
+	}
+	totalSize := int64(0)
+	for _, obj := range objects {
+		totalSize += *obj.Size
+	}
 	return totalSize, nil
 }
 
-func (provider *S3ModelProvider) modelObjectApply(modelLocation S3Location,
-	applyFun func(string, *s3.Object) error) error {
-	// Download from s3
+func (provider S3ModelProvider) ModelVersions(modelName string) ([]int64, error) {
+	modelPrefix := provider.getKeyForModelName(modelName)
+	delimiter := "/"
+	versions := []int64{}
 	isTruncated := true
 	var continuationToken *string = nil
 	for isTruncated {
-		modelObjects, err := provider.s3.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            &modelLocation.Bucket,
-			Prefix:            &modelLocation.KeyPrefix,
+		res, err := provider.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            &provider.Bucket,
+			Prefix:            &modelPrefix,
+			Delimiter:         &delimiter,
 			ContinuationToken: continuationToken,
 		})
-
 		if err != nil {
-			log.WithError(err).Errorf("Error accessing model on S3. Bucket: %s, keyPrefix: %s", modelLocation.Bucket, modelLocation.KeyPrefix)
-			return err
+			log.WithError(err).Errorf("Error listing model versions on S3. Bucket: %s, keyPrefix: %s", provider.Bucket, modelPrefix)
+			return nil, err
 		}
-
-		// download files
-		for _, object := range modelObjects.Contents {
-
-			relativeName := strings.TrimPrefix(*object.Key, modelLocation.KeyPrefix)
-			if !strings.HasSuffix(relativeName, "/") {
-				// Is not a folder
-				err = applyFun(relativeName, object)
-				if err != nil {
-					log.WithError(err).Errorf("Apply func returned error on key: %s", *object.Key)
-					return err
-				}
+		for _, prefix := range res.CommonPrefixes {
+			versionStr := strings.TrimSuffix(strings.TrimPrefix(*prefix.Prefix, modelPrefix), "/")
+			version, err := strconv.ParseInt(versionStr, 10, 64)
+			if err == nil {
+				versions = append(versions, version)
 			}
 		}
-
-		isTruncated = *modelObjects.IsTruncated
-		continuationToken = modelObjects.ContinuationToken
+		for _, obj := range res.Contents {
+			if version, _, ok := archive.ParseVersion(strings.TrimPrefix(*obj.Key, modelPrefix)); ok {
+				versions = append(versions, version)
+			}
+		}
+		isTruncated = *res.IsTruncated
+		continuationToken = res.NextContinuationToken
 	}
-	return nil
+	return versions, nil
 }
 
 func (provider S3ModelProvider) getKeyForModel(modelName string, modelVersion int64) S3Location {
+	return S3Location{
+		Bucket:    provider.Bucket,
+		KeyPrefix: fmt.Sprintf("%s%d/", provider.getKeyForModelName(modelName), modelVersion),
+	}
+}
+
+// getKeyForModelName returns the key prefix of all versions of a model
+func (provider S3ModelProvider) getKeyForModelName(modelName string) string {
 	modelPrefix := provider.ModelBaseDir
 	if len(modelPrefix) > 0 {
 		modelPrefix = fmt.Sprintf("%s/", modelPrefix)
 	}
-	return S3Location{
-		Bucket:    provider.Bucket,
-		KeyPrefix: fmt.Sprintf("%s%s/%d/", modelPrefix, modelName, modelVersion),
-	}
+	return fmt.Sprintf("%s%s/", modelPrefix, modelName)
 }
 
 func (provider S3ModelProvider) Check() bool {
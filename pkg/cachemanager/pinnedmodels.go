@@ -0,0 +1,107 @@
+package cachemanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pinnedModelRetryInterval is the time between attempts to load pinned models that failed to load
+const pinnedModelRetryInterval = 10 * time.Second
+
+// PinnedModel is a model that is loaded on startup and never evicted from the cache.
+// Version is either a version number or "latest".
+type PinnedModel struct {
+	Name    string
+	Version string
+}
+
+// LoadPinnedModels pins the given models in the cache and loads them into serving
+// in the background. Models that fail to load are retried until they succeed.
+// The cache is not reported healthy until all pinned models are available.
+func (cache *CacheManager) LoadPinnedModels(models []PinnedModel) {
+	if len(models) >= cache.MaxConcurrentModels {
+		log.Warnf("Number of pinned models (%d) is not less than the max number of concurrent models (%d)",
+			len(models), cache.MaxConcurrentModels)
+	}
+	cache.pinnedMux.Lock()
+	cache.numPendingPinnedModels = len(models)
+	cache.pinnedMux.Unlock()
+	go cache.loadPinnedModels(models)
+}
+
+func (cache *CacheManager) loadPinnedModels(models []PinnedModel) {
+	pending := models
+	for {
+		failed := []PinnedModel{}
+		for _, model := range pending {
+			err := cache.loadPinnedModel(model)
+			if err != nil {
+				log.WithError(err).Errorf("Could not load pinned model %s:%s. Retrying in %s", model.Name, model.Version, pinnedModelRetryInterval)
+				failed = append(failed, model)
+			}
+		}
+		cache.pinnedMux.Lock()
+		cache.numPendingPinnedModels = len(failed)
+		cache.pinnedMux.Unlock()
+		if len(failed) == 0 {
+			log.Infof("All %d pinned models loaded", len(models))
+			return
+		}
+		pending = failed
+		time.Sleep(pinnedModelRetryInterval)
+	}
+}
+
+func (cache *CacheManager) loadPinnedModel(model PinnedModel) error {
+	version, err := cache.resolvePinnedVersion(model)
+	if err != nil {
+		return err
+	}
+	identifier := ModelIdentifier{ModelName: model.Name, Version: version}
+	log.Infof("Loading pinned model %s:%d", identifier.ModelName, identifier.Version)
+	cache.LocalCache.Pin(identifier)
+	cache.pinnedMux.Lock()
+	cache.pinnedModels[identifier] = true
+	cache.pinnedMux.Unlock()
+	return cache.fetchModel(context.Background(), identifier)
+}
+
+func (cache *CacheManager) resolvePinnedVersion(model PinnedModel) (int64, error) {
+	if model.Version != "latest" {
+		return strconv.ParseInt(model.Version, 10, 64)
+	}
+	return cache.VersionResolver.LatestVersion(model.Name)
+}
+
+// isPinned reports whether the given model is pinned
+func (cache *CacheManager) isPinned(identifier ModelIdentifier) bool {
+	cache.pinnedMux.RLock()
+	defer cache.pinnedMux.RUnlock()
+	return cache.pinnedModels[identifier]
+}
+
+// checkPinnedModels returns an error if not all pinned models are loaded and available in serving
+func (cache *CacheManager) checkPinnedModels() error {
+	cache.pinnedMux.RLock()
+	numPending := cache.numPendingPinnedModels
+	pinned := make([]ModelIdentifier, 0, len(cache.pinnedModels))
+	for identifier := range cache.pinnedModels {
+		pinned = append(pinned, identifier)
+	}
+	cache.pinnedMux.RUnlock()
+
+	if numPending > 0 {
+		return fmt.Errorf("Waiting for %d pinned models to load", numPending)
+	}
+	for _, identifier := range pinned {
+		state, err := cache.ServingController.GetModelStatus(Model{Identifier: identifier})
+		if err != nil || state != ModelVersionStatus_AVAILABLE {
+			return fmt.Errorf("Pinned model %s:%d is not available", identifier.ModelName, identifier.Version)
+		}
+	}
+	return nil
+}
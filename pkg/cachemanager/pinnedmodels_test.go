@@ -0,0 +1,131 @@
+package cachemanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type modelProviderMock struct {
+	versions          map[string][]int64
+	numVersionQueries int
+	unhealthy         bool
+	loadErr           error
+	// extractedSize is the size of loaded models, if it differs from the reported size
+	extractedSize int64
+	// block makes LoadModel wait until it is closed, if set
+	block   chan struct{}
+	loading int32
+}
+
+func (provider *modelProviderMock) isLoading() bool {
+	return atomic.LoadInt32(&provider.loading) > 0
+}
+
+func (provider *modelProviderMock) LoadModel(modelName string, modelVersion int64, destinationDir string) (*Model, error) {
+	if provider.loadErr != nil {
+		return nil, provider.loadErr
+	}
+	if provider.block != nil {
+		atomic.AddInt32(&provider.loading, 1)
+		<-provider.block
+		atomic.AddInt32(&provider.loading, -1)
+	}
+	modelPath := filepath.Join(modelName, strconv.FormatInt(modelVersion, 10))
+	err := os.MkdirAll(filepath.Join(destinationDir, modelPath), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(destinationDir, modelPath, "saved_model.pb"), make([]byte, 10), 0666)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(10)
+	if provider.extractedSize > 0 {
+		size = provider.extractedSize
+	}
+	return &Model{
+		Identifier: ModelIdentifier{ModelName: modelName, Version: modelVersion},
+		Path:       modelPath,
+		SizeOnDisk: size,
+	}, nil
+}
+
+func (provider *modelProviderMock) ModelSize(modelName string, modelVersion int64) (int64, error) {
+	return 10, nil
+}
+
+func (provider *modelProviderMock) ModelVersions(modelName string) ([]int64, error) {
+	provider.numVersionQueries++
+	return provider.versions[modelName], nil
+}
+
+func (provider *modelProviderMock) Check() bool {
+	return !provider.unhealthy
+}
+
+func TestServingModelsIncludesPinnedModels(t *testing.T) {
+	cache := &CacheManager{
+		LocalCache:          NewLRUCache("./cache", 1024),
+		MaxConcurrentModels: 3,
+		pinnedModels:        map[ModelIdentifier]bool{},
+	}
+	pinned := ModelIdentifier{ModelName: "pinned", Version: 1}
+	cache.pinnedModels[pinned] = true
+	cache.LocalCache.Put(pinned, Model{Identifier: pinned, Path: "/some/path", SizeOnDisk: 10})
+	for i := 1; i <= 5; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.LocalCache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+
+	models := cache.servingModels()
+	expected := []ModelIdentifier{pinned, {"foo", 5}, {"foo", 4}}
+	if len(models) != len(expected) {
+		t.Fatalf("Expected %d serving models, but found %d", len(expected), len(models))
+	}
+	for i := range expected {
+		if models[i].Identifier != expected[i] {
+			t.Errorf("Expected serving model %v at position %d, but found %v", expected[i], i, models[i].Identifier)
+		}
+	}
+}
+
+func TestServingModelsLeavesSlotForRequestedModel(t *testing.T) {
+	cache := &CacheManager{
+		LocalCache:          NewLRUCache("./cache", 1024),
+		MaxConcurrentModels: 1,
+		pinnedModels:        map[ModelIdentifier]bool{},
+	}
+	pinned := ModelIdentifier{ModelName: "pinned", Version: 1}
+	requested := ModelIdentifier{ModelName: "foo", Version: 1}
+	cache.pinnedModels[pinned] = true
+	cache.LocalCache.Put(pinned, Model{Identifier: pinned, Path: "/some/path", SizeOnDisk: 10})
+	cache.LocalCache.Put(requested, Model{Identifier: requested, Path: "/some/path", SizeOnDisk: 10})
+
+	models := cache.servingModels()
+	if len(models) != 2 || models[1].Identifier != requested {
+		t.Errorf("Expected requested model to be served along with pinned model")
+	}
+}
+
+func TestResolvePinnedVersion(t *testing.T) {
+	cache := &CacheManager{
+		VersionResolver: NewVersionResolver(&modelProviderMock{versions: map[string][]int64{"foo": {3, 42, 7}}}, time.Minute),
+	}
+	version, err := cache.resolvePinnedVersion(PinnedModel{Name: "foo", Version: "latest"})
+	if err != nil || version != 42 {
+		t.Errorf("Expected latest version to be 42, but was %d (err: %v)", version, err)
+	}
+	version, err = cache.resolvePinnedVersion(PinnedModel{Name: "foo", Version: "7"})
+	if err != nil || version != 7 {
+		t.Errorf("Expected version to be 7, but was %d (err: %v)", version, err)
+	}
+	_, err = cache.resolvePinnedVersion(PinnedModel{Name: "bar", Version: "latest"})
+	if err == nil {
+		t.Errorf("Expected error when resolving latest version of model without versions")
+	}
+}
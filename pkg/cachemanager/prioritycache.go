@@ -0,0 +1,317 @@
+package cachemanager
+
+import (
+	"container/heap"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PriorityCache is a ModelCache that evicts the model with the lowest
+// priority first. The priority of a model is computed by a priority
+// function every time the model is accessed, which makes it possible
+// to implement several eviction policies, such as LFU and GDSF.
+type PriorityCache struct {
+	mux      sync.Mutex
+	baseDir  string
+	entries  priorityHeap
+	modelMap map[ModelIdentifier]*priorityEntry
+	pinned   map[ModelIdentifier]bool
+	// held counts the holds of models that are being loaded
+	held     map[ModelIdentifier]int
+	priority priorityFunc
+	// inflation is the priority of the most recently evicted model.
+	// It is used to age models that are no longer accessed.
+	inflation   float64
+	accessCount uint64
+	Capacity    int64
+	currentSize int64
+	// reserved is the number of bytes reserved for models being fetched
+	reserved int64
+	// accessed holds the models accessed since the access times were flushed
+	accessed map[ModelIdentifier]bool
+}
+
+// priorityFunc computes the priority of a cache entry given the current inflation value
+type priorityFunc func(entry *priorityEntry, inflation float64) float64
+
+type priorityEntry struct {
+	model    Model
+	hits     int64
+	priority float64
+	// lastAccess is used for ordering models by recency and
+	// for evicting the least recently used of equal priority.
+	lastAccess uint64
+	index      int
+}
+
+// NewLFUCache creates a new cache that evicts the least frequently used model first.
+// Models already present in the directory are added to the cache.
+func NewLFUCache(dir string, capacityInBytes int64) *PriorityCache {
+	return newPriorityCache(dir, capacityInBytes, func(entry *priorityEntry, inflation float64) float64 {
+		return float64(entry.hits)
+	})
+}
+
+// NewGDSFCache creates a new cache implementing the Greedy-Dual-Size-Frequency policy.
+// The priority of a model is its access frequency multiplied by the cost of fetching it,
+// relative to its size. This favours keeping small models and models that are
+// expensive to fetch. Models already present in the directory are added to the cache.
+func NewGDSFCache(dir string, capacityInBytes int64) *PriorityCache {
+	return newPriorityCache(dir, capacityInBytes, func(entry *priorityEntry, inflation float64) float64 {
+		// The fetch cost is unknown for restored models
+		cost := entry.model.FetchDuration.Seconds()
+		if cost <= 0 {
+			cost = 1.0
+		}
+		size := float64(entry.model.SizeOnDisk)
+		if size < 1 {
+			size = 1
+		}
+		return inflation + float64(entry.hits)*cost/size
+	})
+}
+
+func newPriorityCache(dir string, capacityInBytes int64, priority priorityFunc) *PriorityCache {
+	cache := &PriorityCache{
+		baseDir:  dir,
+		entries:  priorityHeap{},
+		modelMap: map[ModelIdentifier]*priorityEntry{},
+		pinned:   map[ModelIdentifier]bool{},
+		held:     map[ModelIdentifier]int{},
+		accessed: map[ModelIdentifier]bool{},
+		priority: priority,
+		Capacity: capacityInBytes,
+	}
+	cache.restore()
+	return cache
+}
+
+// restore adds the models present in the cache dir to the cache
+func (cache *PriorityCache) restore() {
+	if cache.baseDir == "" {
+		return
+	}
+	models := scanCacheDir(cache.baseDir)
+	for _, model := range models {
+		cache.add(model)
+	}
+	if len(models) > 0 {
+		log.Infof("Restored %d models (%d bytes) from cache dir: %s", len(models), cache.currentSize, cache.baseDir)
+	}
+	// The capacity may have been decreased since the models were stored
+	cache.ensureFreeBytes(0)
+}
+
+// Retrieves an item from the cache as well as a bool
+// indicating whether the item was present or not.
+// If the item is not present, the zero value of
+// the type is returned.
+func (cache *PriorityCache) Get(item ModelIdentifier) (Model, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	entry, isContained := cache.modelMap[item]
+	if !isContained {
+		return Model{}, false
+	}
+	cache.access(entry)
+	cache.accessed[item] = true
+	return entry.model, true
+}
+
+// Adds an item to the cache (if it does not already exist)
+func (cache *PriorityCache) Put(item ModelIdentifier, model Model) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	existingEntry, isContained := cache.modelMap[item]
+	if !isContained {
+		// Cleanup space
+		cache.ensureFreeBytes(model.SizeOnDisk)
+		model.LastAccessed = time.Now()
+		markModelComplete(cache.ModelPath(model))
+		cache.add(model)
+	} else {
+		cache.access(existingEntry)
+	}
+}
+
+// Deletes models with the lowest priority until number of bytes are available
+func (cache *PriorityCache) EnsureFreeBytes(bytes int64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.ensureFreeBytes(bytes)
+}
+
+func (cache *PriorityCache) Reserve(bytes int64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.ensureFreeBytes(bytes)
+	cache.reserved += bytes
+}
+
+func (cache *PriorityCache) Release(bytes int64) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.reserved -= bytes
+}
+
+func (cache *PriorityCache) ensureFreeBytes(bytes int64) {
+	// Pinned and held models are skipped, and pushed back afterwards
+	skippedEntries := []*priorityEntry{}
+	for cache.entries.Len() > 0 && cache.Capacity-cache.currentSize-cache.reserved < bytes {
+		entry := heap.Pop(&cache.entries).(*priorityEntry)
+		if cache.pinned[entry.model.Identifier] || cache.held[entry.model.Identifier] > 0 {
+			skippedEntries = append(skippedEntries, entry)
+			continue
+		}
+		cache.inflation = entry.priority
+		cache.remove(entry)
+	}
+	for _, entry := range skippedEntries {
+		heap.Push(&cache.entries, entry)
+	}
+	if cache.Capacity-cache.currentSize-cache.reserved < bytes {
+		log.Errorf("Cannot allocate requested number of bytes. Capacity: %d, request: %d", cache.Capacity, bytes)
+	}
+}
+
+// ListModels returns the models in the cache, most recently used first
+func (cache *PriorityCache) ListModels() []*Model {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	entries := make([]*priorityEntry, len(cache.entries))
+	copy(entries, cache.entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess > entries[j].lastAccess
+	})
+	res := make([]*Model, 0, len(entries))
+	for _, entry := range entries {
+		model := entry.model
+		res = append(res, &model)
+	}
+	return res
+}
+
+func (cache *PriorityCache) Remove(item ModelIdentifier) bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	entry, isContained := cache.modelMap[item]
+	if !isContained {
+		return false
+	}
+	heap.Remove(&cache.entries, entry.index)
+	cache.remove(entry)
+	delete(cache.pinned, item)
+	return true
+}
+
+func (cache *PriorityCache) Pin(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.pinned[item] = true
+}
+
+func (cache *PriorityCache) Hold(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.held[item]++
+}
+
+func (cache *PriorityCache) Unhold(item ModelIdentifier) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.held[item]--
+	if cache.held[item] <= 0 {
+		delete(cache.held, item)
+	}
+}
+
+func (cache *PriorityCache) FlushAccessTimes() {
+	cache.mux.Lock()
+	accessTimes := map[string]time.Time{}
+	for item := range cache.accessed {
+		if entry, isContained := cache.modelMap[item]; isContained {
+			accessTimes[cache.ModelPath(entry.model)] = entry.model.LastAccessed
+		}
+	}
+	cache.accessed = map[ModelIdentifier]bool{}
+	cache.mux.Unlock()
+	// The files are written without holding the lock, such that they do not block lookups
+	touchModels(accessTimes)
+}
+
+func (cache *PriorityCache) BaseDir() string {
+	return cache.baseDir
+}
+
+func (cache *PriorityCache) ModelPath(model Model) string {
+	return path.Join(cache.baseDir, model.Path)
+}
+
+func (cache *PriorityCache) add(model Model) {
+	cache.accessCount++
+	entry := &priorityEntry{
+		model:      model,
+		hits:       1,
+		lastAccess: cache.accessCount,
+	}
+	entry.priority = cache.priority(entry, cache.inflation)
+	heap.Push(&cache.entries, entry)
+	cache.modelMap[model.Identifier] = entry
+	cache.currentSize += model.SizeOnDisk
+}
+
+// remove deletes a model that has been removed from the heap from the cache and from disk
+func (cache *PriorityCache) remove(entry *priorityEntry) {
+	deleteModelFromDisk(cache.ModelPath(entry.model), entry.model)
+	cache.currentSize -= entry.model.SizeOnDisk
+	delete(cache.modelMap, entry.model.Identifier)
+}
+
+func (cache *PriorityCache) access(entry *priorityEntry) {
+	cache.accessCount++
+	entry.hits++
+	entry.lastAccess = cache.accessCount
+	entry.model.LastAccessed = time.Now()
+	entry.priority = cache.priority(entry, cache.inflation)
+	heap.Fix(&cache.entries, entry.index)
+}
+
+// priorityHeap is a min-heap of cache entries implementing heap.Interface
+type priorityHeap []*priorityEntry
+
+func (h priorityHeap) Len() int {
+	return len(h)
+}
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].priority == h[j].priority {
+		return h[i].lastAccess < h[j].lastAccess
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h priorityHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *priorityHeap) Push(x interface{}) {
+	entry := x.(*priorityEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *priorityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
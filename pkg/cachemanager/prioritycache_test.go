@@ -0,0 +1,146 @@
+package cachemanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLFUCacheRemovesLeastFrequentlyUsed(t *testing.T) {
+	cache := NewLFUCache("./cache", 30)
+	for i := 1; i <= 3; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+	// Use model 1 and 3 more frequently than model 2
+	for i := 0; i < 3; i++ {
+		cache.Get(ModelIdentifier{ModelName: "foo", Version: 1})
+		cache.Get(ModelIdentifier{ModelName: "foo", Version: 3})
+	}
+
+	identifier := ModelIdentifier{ModelName: "foo", Version: 4}
+	cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 2}); avail {
+		t.Errorf("Expected least frequently used model to be removed")
+	}
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 1}); !avail {
+		t.Errorf("Expected frequently used model to be available")
+	}
+	if cache.currentSize != 30 {
+		t.Errorf("Expected cache size of %d but was %d", 30, cache.currentSize)
+	}
+}
+
+func TestLFUCacheRemovesLRUOnEqualFrequency(t *testing.T) {
+	cache := NewLFUCache("./cache", 30)
+	for i := 1; i <= 4; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 1}); avail {
+		t.Errorf("Expected least recently used model to be removed")
+	}
+	if len(cache.ListModels()) != 3 {
+		t.Errorf("Expected number of cache items to be 3, but it is %d", len(cache.ListModels()))
+	}
+}
+
+func TestGDSFCacheKeepsSmallModels(t *testing.T) {
+	cache := NewGDSFCache("./cache", 100)
+	for i := 1; i <= 5; i++ {
+		identifier := ModelIdentifier{ModelName: "small", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 5, FetchDuration: time.Second})
+	}
+	big := ModelIdentifier{ModelName: "big", Version: 1}
+	cache.Put(big, Model{Identifier: big, Path: "/some/path", SizeOnDisk: 70, FetchDuration: time.Second})
+
+	// A scan of another big model should evict the other big model rather than the small ones
+	otherBig := ModelIdentifier{ModelName: "big", Version: 2}
+	cache.Put(otherBig, Model{Identifier: otherBig, Path: "/some/path", SizeOnDisk: 70, FetchDuration: time.Second})
+
+	if _, avail := cache.Get(big); avail {
+		t.Errorf("Expected big model to be removed")
+	}
+	for i := 1; i <= 5; i++ {
+		if _, avail := cache.Get(ModelIdentifier{ModelName: "small", Version: int64(i)}); !avail {
+			t.Errorf("Expected small model %d to be available", i)
+		}
+	}
+}
+
+func TestGDSFCacheKeepsExpensiveModels(t *testing.T) {
+	cache := NewGDSFCache("./cache", 20)
+	cheap := ModelIdentifier{ModelName: "cheap", Version: 1}
+	expensive := ModelIdentifier{ModelName: "expensive", Version: 1}
+	cache.Put(expensive, Model{Identifier: expensive, Path: "/some/path", SizeOnDisk: 10, FetchDuration: time.Minute})
+	cache.Put(cheap, Model{Identifier: cheap, Path: "/some/path", SizeOnDisk: 10, FetchDuration: time.Second})
+
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+	cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10, FetchDuration: time.Second})
+
+	if _, avail := cache.Get(cheap); avail {
+		t.Errorf("Expected cheap model to be removed")
+	}
+	if _, avail := cache.Get(expensive); !avail {
+		t.Errorf("Expected expensive model to be available")
+	}
+}
+
+func TestPriorityCacheListsMostRecentlyUsedFirst(t *testing.T) {
+	cache := NewLFUCache("./cache", 100)
+	for i := 1; i <= 3; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+	cache.Get(ModelIdentifier{ModelName: "foo", Version: 1})
+
+	models := cache.ListModels()
+	expectedVersions := []int64{1, 3, 2}
+	for i := range expectedVersions {
+		if models[i].Identifier.Version != expectedVersions[i] {
+			t.Errorf("Expected version %d at position %d, but found %d", expectedVersions[i], i, models[i].Identifier.Version)
+		}
+	}
+}
+
+func TestPriorityCacheDoesNotRemovePinnedModels(t *testing.T) {
+	cache := NewLFUCache("./cache", 30)
+	pinned := ModelIdentifier{ModelName: "pinned", Version: 1}
+	cache.Pin(pinned)
+	cache.Put(pinned, Model{Identifier: pinned, Path: "/some/path", SizeOnDisk: 10})
+	for i := 1; i <= 5; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+		cache.Get(identifier)
+	}
+
+	if _, avail := cache.Get(pinned); !avail {
+		t.Errorf("Pinned model was removed from cache")
+	}
+	if len(cache.ListModels()) != 3 {
+		t.Errorf("Expected number of cache items to be 3, but it is %d", len(cache.ListModels()))
+	}
+}
+
+func TestPriorityCacheRemove(t *testing.T) {
+	cache := NewLFUCache("./cache", 100)
+	for i := 1; i <= 3; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+	removed := ModelIdentifier{ModelName: "foo", Version: 2}
+	if !cache.Remove(removed) {
+		t.Errorf("Expected model to be removed")
+	}
+	if _, avail := cache.Get(removed); avail {
+		t.Errorf("Removed model is still in the cache")
+	}
+	if len(cache.ListModels()) != 2 || cache.currentSize != 20 {
+		t.Errorf("Expected 2 models of size 20 in cache, but found %d of size %d", len(cache.ListModels()), cache.currentSize)
+	}
+	// The heap must still be consistent after removal
+	cache.EnsureFreeBytes(90)
+	if len(cache.ListModels()) != 1 {
+		t.Errorf("Expected 1 model in cache after eviction, but found %d", len(cache.ListModels()))
+	}
+}
@@ -85,8 +85,10 @@ func (server *TFServingController) Close() error {
 	return server.grpcClient.Close()
 }
 
-func (server *TFServingController) ReloadConfig(models []*Model, tfServingServerModelDir string) error {
-	configs := createModelConfig(models, tfServingServerModelDir)
+// ReloadConfig sets the models to serve. versionLabels maps model names to
+// the labels of the model, which must refer to available versions.
+func (server *TFServingController) ReloadConfig(models []*Model, tfServingServerModelDir string, versionLabels map[string]map[string]int64) error {
+	configs := createModelConfig(models, tfServingServerModelDir, versionLabels)
 
 	request := &serving.ReloadConfigRequest{
 		Config: &serving.ModelServerConfig{
@@ -156,7 +158,7 @@ func (server *TFServingController) GetModelStates() ([]ModelVersionStatus_State,
 	return models, nil
 }
 
-func createModelConfig(models []*Model, tfServingServerModelDir string) []*serving.ModelConfig {
+func createModelConfig(models []*Model, tfServingServerModelDir string, versionLabels map[string]map[string]int64) []*serving.ModelConfig {
 	distinctModels := map[string]*serving.FileSystemStoragePathSourceConfig_ServableVersionPolicy_Specific{}
 	// Number of configs will be at most len(models) large (also the expected val)
 	var configs = make([]*serving.ModelConfig, 0, len(models))
@@ -180,6 +182,7 @@ func createModelConfig(models []*Model, tfServingServerModelDir string) []*servi
 						Specific: modelVersions,
 					},
 				},
+				VersionLabels: versionLabels[model.Identifier.ModelName],
 			})
 		}
 	}
@@ -0,0 +1,38 @@
+package cachemanager
+
+import (
+	"testing"
+)
+
+func TestCreateModelConfigGroupsVersions(t *testing.T) {
+	models := []*Model{
+		{Identifier: ModelIdentifier{ModelName: "foo", Version: 1}},
+		{Identifier: ModelIdentifier{ModelName: "bar", Version: 1}},
+		{Identifier: ModelIdentifier{ModelName: "foo", Version: 2}},
+	}
+	configs := createModelConfig(models, "/models", nil)
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 model configs, but was %d", len(configs))
+	}
+	if configs[0].Name != "foo" || configs[0].BasePath != "/models/foo" {
+		t.Errorf("Unexpected config for model foo: %v", configs[0])
+	}
+	versions := configs[0].GetModelVersionPolicy().GetSpecific().GetVersions()
+	if len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Expected versions [1 2] of model foo, but was %v", versions)
+	}
+}
+
+func TestCreateModelConfigSetsVersionLabels(t *testing.T) {
+	models := []*Model{
+		{Identifier: ModelIdentifier{ModelName: "foo", Version: 1}},
+		{Identifier: ModelIdentifier{ModelName: "bar", Version: 1}},
+	}
+	configs := createModelConfig(models, "/models", map[string]map[string]int64{"foo": {"stable": 1}})
+	if configs[0].GetVersionLabels()["stable"] != 1 {
+		t.Errorf("Expected stable label of model foo to be 1, but was %v", configs[0].GetVersionLabels())
+	}
+	if len(configs[1].GetVersionLabels()) != 0 {
+		t.Errorf("Expected no labels for model bar, but was %v", configs[1].GetVersionLabels())
+	}
+}
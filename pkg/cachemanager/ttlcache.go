@@ -0,0 +1,132 @@
+package cachemanager
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TTLCache is an LRUCache that additionally evicts models that have
+// not been used for a given period, even when space is available.
+// Expired models are evicted by CacheManager.EvictExpiredModels.
+type TTLCache struct {
+	*LRUCache
+	TTL time.Duration
+}
+
+// expiringCache is a ModelCache that evicts models that have not been used for a while
+type expiringCache interface {
+	// ExpiredModels returns the models that have expired, least recently used first
+	ExpiredModels() []ModelIdentifier
+	// RemoveExpired deletes a model from the cache and from disk if it has expired.
+	// It returns false if the model is not in the cache or has not expired.
+	RemoveExpired(item ModelIdentifier) bool
+	// ExpiryInterval is the interval at which expired models should be evicted
+	ExpiryInterval() time.Duration
+}
+
+// NewTTLCache creates a new TTLCache in the given directory. Models
+// already present in the directory are added to the cache, and
+// the models that have expired are deleted.
+func NewTTLCache(dir string, capacityInBytes int64, ttl time.Duration) *TTLCache {
+	cache := &TTLCache{
+		LRUCache: NewLRUCache(dir, capacityInBytes),
+		TTL:      ttl,
+	}
+	for _, item := range cache.ExpiredModels() {
+		cache.RemoveExpired(item)
+	}
+	return cache
+}
+
+// ExpiredModels returns the models that have not been used within the TTL.
+// Pinned and held models never expire.
+func (cache *TTLCache) ExpiredModels() []ModelIdentifier {
+	expired := []ModelIdentifier{}
+	if cache.TTL <= 0 {
+		return expired
+	}
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	for element := cache.lruList.Back(); element != nil; element = element.Prev() {
+		model := element.Value.(Model)
+		if !cache.isExpired(model) {
+			// The remaining models have been used more recently
+			break
+		}
+		if !cache.pinned[model.Identifier] && cache.held[model.Identifier] == 0 {
+			expired = append(expired, model.Identifier)
+		}
+	}
+	return expired
+}
+
+// RemoveExpired deletes the model if it has not been used within the TTL
+func (cache *TTLCache) RemoveExpired(item ModelIdentifier) bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	element, isContained := cache.modelMap[item]
+	if !isContained || cache.pinned[item] || cache.held[item] > 0 || !cache.isExpired(element.Value.(Model)) {
+		return false
+	}
+	cache.remove(element)
+	return true
+}
+
+// isExpired reports whether the model has not been used within the TTL
+func (cache *TTLCache) isExpired(model Model) bool {
+	return cache.TTL > 0 && model.LastAccessed.Before(time.Now().Add(-cache.TTL))
+}
+
+// ExpiryInterval returns a tenth of the TTL, between one second and one minute
+func (cache *TTLCache) ExpiryInterval() time.Duration {
+	interval := cache.TTL / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+// EvictExpiredModels deletes expired models from the cache, if the cache expires models,
+// and removes them from serving such that TF Serving does not refer to deleted models.
+// Like EvictModel, each model is evicted while no load of the model is in-flight.
+func (cache *CacheManager) EvictExpiredModels() error {
+	expiring, ok := cache.LocalCache.(expiringCache)
+	if !ok {
+		return nil
+	}
+	numEvicted := 0
+	for _, identifier := range expiring.ExpiredModels() {
+		cache.modelLoads.Exclusive(identifier, func() error {
+			// The model may have been used since it was listed
+			if expiring.RemoveExpired(identifier) {
+				numEvicted++
+			}
+			return nil
+		})
+	}
+	if numEvicted == 0 {
+		return nil
+	}
+	log.Infof("Evicted %d expired models", numEvicted)
+	return cache.updateServingConfig()
+}
+
+// RunModelExpiry periodically evicts expired models, if the cache expires models.
+// It never returns if the cache expires models.
+func (cache *CacheManager) RunModelExpiry() {
+	expiring, ok := cache.LocalCache.(expiringCache)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(expiring.ExpiryInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := cache.EvictExpiredModels(); err != nil {
+			log.WithError(err).Error("Could not remove expired models from serving")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package cachemanager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTTLCacheRemovesExpiredModels(t *testing.T) {
+	cache := NewTTLCache("./cache", 1024, 200*time.Millisecond)
+	expiring := ModelIdentifier{ModelName: "foo", Version: 1}
+	used := ModelIdentifier{ModelName: "foo", Version: 2}
+	cache.Put(expiring, Model{Identifier: expiring, Path: "/some/path", SizeOnDisk: 10})
+	cache.Put(used, Model{Identifier: used, Path: "/some/path", SizeOnDisk: 10})
+
+	time.Sleep(120 * time.Millisecond)
+	cache.Get(used)
+	time.Sleep(120 * time.Millisecond)
+
+	// Models are not evicted when the cache is read
+	if len(cache.ListModels()) != 2 {
+		t.Errorf("Expected expired model to stay in the cache until it is evicted")
+	}
+	expired := cache.ExpiredModels()
+	if len(expired) != 1 || expired[0] != expiring {
+		t.Fatalf("Expected 1 expired model, but found %v", expired)
+	}
+	if cache.RemoveExpired(used) || !cache.RemoveExpired(expiring) {
+		t.Errorf("Expected only the expired model to be removed")
+	}
+	models := cache.ListModels()
+	if len(models) != 1 || models[0].Identifier != used {
+		t.Errorf("Expected only the recently used model to be in the cache, but found %d models", len(models))
+	}
+	if cache.currentSize != 10 {
+		t.Errorf("Expected cache size of %d but was %d", 10, cache.currentSize)
+	}
+}
+
+func TestTTLCacheRemovesLRUWhenFull(t *testing.T) {
+	cache := NewTTLCache("./cache", 20, time.Hour)
+	for i := 1; i <= 3; i++ {
+		identifier := ModelIdentifier{ModelName: "foo", Version: int64(i)}
+		cache.Put(identifier, Model{Identifier: identifier, Path: "/some/path", SizeOnDisk: 10})
+	}
+	if _, avail := cache.Get(ModelIdentifier{ModelName: "foo", Version: 1}); avail {
+		t.Errorf("Expected least recently used model to be removed")
+	}
+	if len(cache.ListModels()) != 2 {
+		t.Errorf("Expected number of cache items to be 2, but it is %d", len(cache.ListModels()))
+	}
+}
+
+func TestEvictExpiredModelsRemovesModelsFromServing(t *testing.T) {
+	cache, servingMock, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	cache.LocalCache = NewTTLCache(cache.LocalCache.BaseDir(), 1024, 100*time.Millisecond)
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+	if err := cache.loadModel(context.Background(), identifier); err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	if err := cache.EvictExpiredModels(); err != nil || !servingMock.isServing(identifier) {
+		t.Errorf("Expected model to be served until it expires (err: %v)", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := cache.EvictExpiredModels(); err != nil {
+		t.Fatalf("Error evicting expired models: %v", err)
+	}
+	if servingMock.isServing(identifier) {
+		t.Errorf("Expected expired model to be removed from serving")
+	}
+	if _, isPresent := cache.tryGetModelFromCache(identifier); isPresent {
+		t.Errorf("Expected expired model to be removed from the cache")
+	}
+}
+
+func TestEvictExpiredModelsWaitsForInFlightLoad(t *testing.T) {
+	cache, _, cleanup := setupTestCacheManager(t)
+	defer cleanup()
+	cache.LocalCache = NewTTLCache(cache.LocalCache.BaseDir(), 1024, 100*time.Millisecond)
+	identifier := ModelIdentifier{ModelName: "foo", Version: 1}
+	if err := cache.loadModel(context.Background(), identifier); err != nil {
+		t.Fatalf("Error loading model: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	release := make(chan struct{})
+	loading := make(chan struct{})
+	go cache.modelLoads.Do(context.Background(), identifier, func(ctx context.Context) error {
+		close(loading)
+		<-release
+		return nil
+	})
+	<-loading
+	evictErr := make(chan error)
+	go func() {
+		evictErr <- cache.EvictExpiredModels()
+	}()
+	select {
+	case err := <-evictErr:
+		t.Fatalf("Expected expiry to wait for the load, but it returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-evictErr; err != nil {
+		t.Fatalf("Error evicting expired models: %v", err)
+	}
+	if _, isPresent := cache.LocalCache.Get(identifier); isPresent {
+		t.Errorf("Expected expired model to be evicted after the load")
+	}
+}
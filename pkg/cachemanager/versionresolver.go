@@ -0,0 +1,113 @@
+package cachemanager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VersionResolver resolves the latest version of models using the
+// ModelProvider. Resolved versions are cached for a short period,
+// such that the provider is not queried on every request.
+// It also resolves version labels, such as "stable" or "canary".
+type VersionResolver struct {
+	provider ModelProvider
+	ttl      time.Duration
+	mux      sync.Mutex
+	versions map[string]resolvedVersion
+	labels   map[string]map[string]int64
+}
+
+// VersionLabel assigns a label to a version of a model
+type VersionLabel struct {
+	Name    string
+	Label   string
+	Version int64
+}
+
+type resolvedVersion struct {
+	version int64
+	expires time.Time
+}
+
+// NewVersionResolver creates a new VersionResolver that caches
+// resolved versions for the given duration.
+func NewVersionResolver(provider ModelProvider, ttl time.Duration) *VersionResolver {
+	return &VersionResolver{
+		provider: provider,
+		ttl:      ttl,
+		versions: make(map[string]resolvedVersion),
+		labels:   make(map[string]map[string]int64),
+	}
+}
+
+// SetVersionLabels replaces the version labels of all models
+func (resolver *VersionResolver) SetVersionLabels(labels []VersionLabel) {
+	modelLabels := make(map[string]map[string]int64)
+	for _, label := range labels {
+		if _, ok := modelLabels[label.Name]; !ok {
+			modelLabels[label.Name] = make(map[string]int64)
+		}
+		modelLabels[label.Name][label.Label] = label.Version
+	}
+	resolver.mux.Lock()
+	resolver.labels = modelLabels
+	resolver.mux.Unlock()
+}
+
+// LabelVersion returns the version that the given label of a model is assigned to
+func (resolver *VersionResolver) LabelVersion(modelName string, label string) (int64, error) {
+	resolver.mux.Lock()
+	defer resolver.mux.Unlock()
+	version, ok := resolver.labels[modelName][label]
+	if !ok {
+		return 0, fmt.Errorf("Unknown version label '%s' for model: %s", label, modelName)
+	}
+	return version, nil
+}
+
+// VersionLabels returns the labels of the given model version
+func (resolver *VersionResolver) VersionLabels(identifier ModelIdentifier) []string {
+	resolver.mux.Lock()
+	defer resolver.mux.Unlock()
+	labels := []string{}
+	for label, version := range resolver.labels[identifier.ModelName] {
+		if version == identifier.Version {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// LatestVersion returns the highest available version of the given model
+func (resolver *VersionResolver) LatestVersion(modelName string) (int64, error) {
+	resolver.mux.Lock()
+	resolved, ok := resolver.versions[modelName]
+	resolver.mux.Unlock()
+	if ok && time.Now().Before(resolved.expires) {
+		return resolved.version, nil
+	}
+
+	versions, err := resolver.provider.ModelVersions(modelName)
+	if err != nil {
+		log.WithError(err).Errorf("Could not list versions of model: %s", modelName)
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("No versions found for model: %s", modelName)
+	}
+	latest := versions[0]
+	for _, version := range versions {
+		if version > latest {
+			latest = version
+		}
+	}
+	log.Debugf("Resolved latest version of model %s: %d", modelName, latest)
+
+	resolver.mux.Lock()
+	resolver.versions[modelName] = resolvedVersion{version: latest, expires: time.Now().Add(resolver.ttl)}
+	resolver.mux.Unlock()
+	return latest, nil
+}
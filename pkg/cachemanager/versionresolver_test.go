@@ -0,0 +1,64 @@
+package cachemanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionResolverReturnsLatestVersion(t *testing.T) {
+	provider := &modelProviderMock{versions: map[string][]int64{"foo": {3, 42, 7}}}
+	resolver := NewVersionResolver(provider, time.Minute)
+	version, err := resolver.LatestVersion("foo")
+	if err != nil || version != 42 {
+		t.Errorf("Expected latest version to be 42, but was %d (err: %v)", version, err)
+	}
+}
+
+func TestVersionResolverCachesVersions(t *testing.T) {
+	provider := &modelProviderMock{versions: map[string][]int64{"foo": {1}}}
+	resolver := NewVersionResolver(provider, time.Minute)
+	for i := 0; i < 3; i++ {
+		resolver.LatestVersion("foo")
+	}
+	if provider.numVersionQueries != 1 {
+		t.Errorf("Expected provider to be queried once, but was queried %d times", provider.numVersionQueries)
+	}
+}
+
+func TestVersionResolverExpiresVersions(t *testing.T) {
+	provider := &modelProviderMock{versions: map[string][]int64{"foo": {1}}}
+	resolver := NewVersionResolver(provider, 0)
+	resolver.LatestVersion("foo")
+	provider.versions["foo"] = []int64{1, 2}
+	version, _ := resolver.LatestVersion("foo")
+	if version != 2 {
+		t.Errorf("Expected expired version to be resolved again, but was %d", version)
+	}
+}
+
+func TestVersionResolverNoVersionsCausesErr(t *testing.T) {
+	resolver := NewVersionResolver(&modelProviderMock{}, time.Minute)
+	if _, err := resolver.LatestVersion("foo"); err == nil {
+		t.Errorf("Expected error for model without versions")
+	}
+}
+
+func TestVersionResolverResolvesLabels(t *testing.T) {
+	resolver := NewVersionResolver(&modelProviderMock{}, time.Minute)
+	resolver.SetVersionLabels([]VersionLabel{
+		{Name: "foo", Label: "stable", Version: 1},
+		{Name: "foo", Label: "canary", Version: 2},
+		{Name: "bar", Label: "stable", Version: 3},
+	})
+	version, err := resolver.LabelVersion("foo", "canary")
+	if err != nil || version != 2 {
+		t.Errorf("Expected canary version to be 2, but was %d (err: %v)", version, err)
+	}
+	if _, err := resolver.LabelVersion("foo", "unknown"); err == nil {
+		t.Errorf("Expected error for unknown label")
+	}
+	labels := resolver.VersionLabels(ModelIdentifier{ModelName: "bar", Version: 3})
+	if len(labels) != 1 || labels[0] != "stable" {
+		t.Errorf("Expected labels of bar:3 to be [stable], but was %v", labels)
+	}
+}
@@ -0,0 +1,270 @@
+package taskhandler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var adminClusterURLMatch = regexp.MustCompile(`^/admin/cluster/models/(?P<modelName>[^/]+)(/versions/(?P<version>[0-9]+))?/?$`)
+
+// ClusterResult is the aggregated result of a cluster operation on a model
+type ClusterResult struct {
+	ModelName string
+	Version   int64
+	Nodes     []NodeResult
+}
+
+// NodeResult is the result of a cluster operation on a single node
+type NodeResult struct {
+	Node string
+	// Owner is true if the node is one of the nodes that serve the model
+	Owner bool
+	// State is the serving state of the model on the node. It is
+	// only set when looking up where a model is.
+	State   string `json:",omitempty"`
+	Message string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// cachedModel is the subset of the model info returned by the cache admin api used by the proxy
+type cachedModel struct {
+	Name    string
+	Version int64
+	State   string
+}
+
+// ServeAdmin returns the HTTP handler function for the cluster admin api:
+//
+//	GET    /admin/cluster/models/<model>/versions/<version>    finds the nodes that serve a model and the state of the model on them
+//	POST   /admin/cluster/models/<model>[/versions/<version>]  loads a model on all nodes that serve it, by default the latest version
+//	DELETE /admin/cluster/models/<model>/versions/<version>    evicts a model from all nodes in the cluster
+//
+// If an admin token is configured, requests must send it as a bearer token.
+// Otherwise, only GET requests are allowed.
+func (handler *TaskHandler) ServeAdmin() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !handler.authorizeAdmin(rw, req) {
+			return
+		}
+		matches := adminClusterURLMatch.FindStringSubmatch(req.URL.Path)
+		if len(matches) == 0 {
+			writeAdminError(rw, http.StatusNotFound, "Not found")
+			return
+		}
+		modelName, version := matches[1], matches[3]
+		if version == "" && req.Method != http.MethodPost {
+			writeAdminError(rw, http.StatusBadRequest, "Model version must be provided")
+			return
+		}
+		if version == "" {
+			if handler.versionResolver == nil {
+				writeAdminError(rw, http.StatusBadRequest, "Model version must be provided")
+				return
+			}
+			latest, err := handler.versionResolver.LatestVersion(modelName)
+			if err != nil {
+				writeAdminError(rw, http.StatusNotFound, fmt.Sprintf("Could not resolve version of model: %s", modelName))
+				return
+			}
+			version = strconv.FormatInt(latest, 10)
+		}
+
+		var result *ClusterResult
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			result, err = handler.LocateModel(modelName, version)
+		case http.MethodPost:
+			result, err = handler.PreloadModel(modelName, version)
+		case http.MethodDelete:
+			result, err = handler.EvictModel(modelName, version)
+		default:
+			writeAdminError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Error finding nodes for model")
+			writeAdminError(rw, http.StatusInternalServerError, fmt.Sprintf("Error finding nodes for model: %v", err))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(result)
+	}
+}
+
+// LocateModel returns the nodes that serve the given model along with the state of the model on each node
+func (handler *TaskHandler) LocateModel(modelName string, version string) (*ClusterResult, error) {
+	owners, err := handler.modelOwners(modelName, version)
+	if err != nil {
+		return nil, err
+	}
+	return handler.fanOut(modelName, version, owners, owners, func(node ServingService) (NodeResult, error) {
+		var models []cachedModel
+		err := handler.adminRequest(http.MethodGet, node, "/admin/models", &models)
+		if err != nil {
+			return NodeResult{}, err
+		}
+		res := NodeResult{State: "NOT_CACHED"}
+		for _, model := range models {
+			if model.Name == modelName && strconv.FormatInt(model.Version, 10) == version {
+				res.State = model.State
+			}
+		}
+		return res, nil
+	}), nil
+}
+
+// PreloadModel loads the given model on all nodes that serve it
+func (handler *TaskHandler) PreloadModel(modelName string, version string) (*ClusterResult, error) {
+	owners, err := handler.modelOwners(modelName, version)
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/admin/models/%s/versions/%s", url.PathEscape(modelName), version)
+	return handler.fanOut(modelName, version, owners, owners, func(node ServingService) (NodeResult, error) {
+		return handler.adminStatusRequest(http.MethodPost, node, path)
+	}), nil
+}
+
+// EvictModel evicts the given model from all nodes in the cluster. All nodes
+// are included, since nodes that used to serve the model before a membership
+// change may still have it cached.
+func (handler *TaskHandler) EvictModel(modelName string, version string) (*ClusterResult, error) {
+	owners, err := handler.modelOwners(modelName, version)
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/admin/models/%s/versions/%s", url.PathEscape(modelName), version)
+	return handler.fanOut(modelName, version, handler.Cluster.Members(), owners, func(node ServingService) (NodeResult, error) {
+		res, err := handler.adminStatusRequest(http.MethodDelete, node, path)
+		if err, ok := err.(*adminStatusError); ok && err.statusCode == http.StatusNotFound {
+			// The model was not cached on the node
+			return NodeResult{Message: err.message}, nil
+		}
+		return res, err
+	}), nil
+}
+
+func (handler *TaskHandler) modelOwners(modelName string, version string) ([]ServingService, error) {
+	return handler.Cluster.FindNodesForKey(modelName+"##"+version, handler.replicaCount(modelName, version))
+}
+
+// fanOut runs the given request concurrently on all the given nodes and aggregates the results
+func (handler *TaskHandler) fanOut(modelName string, version string, nodes []ServingService, owners []ServingService,
+	request func(node ServingService) (NodeResult, error)) *ClusterResult {
+	modelVersion, _ := strconv.ParseInt(version, 10, 64)
+	result := &ClusterResult{
+		ModelName: modelName,
+		Version:   modelVersion,
+		Nodes:     make([]NodeResult, len(nodes)),
+	}
+	isOwner := map[string]bool{}
+	for _, owner := range owners {
+		isOwner[owner.String()] = true
+	}
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := nodes[i]
+			res, err := request(node)
+			if err != nil {
+				log.WithError(err).Errorf("Admin request failed on node: %s", node.String())
+				res.Error = err.Error()
+			}
+			res.Node = node.String()
+			res.Owner = isOwner[res.Node]
+			result.Nodes[i] = res
+		}(i)
+	}
+	wg.Wait()
+	return result
+}
+
+// adminStatusError is returned when a cache node responds with an error status
+type adminStatusError struct {
+	statusCode int
+	message    string
+}
+
+func (err *adminStatusError) Error() string {
+	return fmt.Sprintf("Status %d: %s", err.statusCode, err.message)
+}
+
+// adminStatusRequest sends a request to the admin api of a cache node, which responds with a status message
+func (handler *TaskHandler) adminStatusRequest(method string, node ServingService, path string) (NodeResult, error) {
+	var status struct {
+		Status  string
+		Message string
+	}
+	err := handler.adminRequest(method, node, path, &status)
+	if err != nil {
+		return NodeResult{}, err
+	}
+	return NodeResult{Message: status.Message}, nil
+}
+
+// adminRequest sends a request to the admin api of a cache node and decodes the response into res
+func (handler *TaskHandler) adminRequest(method string, node ServingService, path string, res interface{}) error {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d%s", node.Host, node.RestPort, path), nil)
+	if err != nil {
+		return err
+	}
+	if handler.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+handler.adminToken)
+	}
+	resp, err := handler.adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var status struct {
+			Status  string
+			Message string
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return &adminStatusError{statusCode: resp.StatusCode, message: status.Message}
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// authorizeAdmin checks the admin token of the request, and writes an error response
+// if the request is not allowed. Without a configured token, only GET requests are allowed.
+func (handler *TaskHandler) authorizeAdmin(rw http.ResponseWriter, req *http.Request) bool {
+	if handler.adminToken == "" {
+		if req.Method != http.MethodGet {
+			writeAdminError(rw, http.StatusForbidden, "Admin token is not configured")
+			return false
+		}
+		return true
+	}
+	expected := []byte("Bearer " + handler.adminToken)
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminError(rw, http.StatusUnauthorized, "Invalid admin token")
+		return false
+	}
+	return true
+}
+
+func writeAdminError(rw http.ResponseWriter, statusCode int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(struct {
+		Status  string
+		Message string
+	}{
+		Status:  "Error",
+		Message: message,
+	})
+}
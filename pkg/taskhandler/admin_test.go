@@ -0,0 +1,279 @@
+package taskhandler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testAdminToken = "secret"
+
+// cacheNodeMock is a cache node that records the admin requests it receives
+type cacheNodeMock struct {
+	server   *httptest.Server
+	mux      sync.Mutex
+	requests []string
+	cached   bool
+}
+
+func newCacheNodeMock() *cacheNodeMock {
+	node := &cacheNodeMock{}
+	node.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		node.mux.Lock()
+		defer node.mux.Unlock()
+		if req.Header.Get("Authorization") != "Bearer "+testAdminToken {
+			rw.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(rw).Encode(struct{ Status, Message string }{"Error", "Invalid admin token"})
+			return
+		}
+		node.requests = append(node.requests, req.Method+" "+req.URL.Path)
+		if req.URL.RawQuery != "" {
+			node.requests = append(node.requests, "query "+req.URL.RawQuery)
+		}
+		switch req.Method {
+		case http.MethodGet:
+			models := []cachedModel{}
+			if node.cached {
+				models = append(models, cachedModel{Name: "foo", Version: 1, State: "AVAILABLE"})
+			}
+			json.NewEncoder(rw).Encode(models)
+		case http.MethodPost:
+			node.cached = true
+			json.NewEncoder(rw).Encode(struct{ Status, Message string }{"OK", "Loaded model"})
+		case http.MethodDelete:
+			if !node.cached {
+				rw.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(rw).Encode(struct{ Status, Message string }{"Error", "Model is not in the cache"})
+				return
+			}
+			node.cached = false
+			json.NewEncoder(rw).Encode(struct{ Status, Message string }{"OK", "Evicted model"})
+		}
+	}))
+	return node
+}
+
+func (node *cacheNodeMock) service() ServingService {
+	host, port, _ := net.SplitHostPort(node.server.Listener.Addr().String())
+	restPort, _ := strconv.Atoi(port)
+	return ServingService{Host: host, RestPort: restPort, GrpcPort: 1}
+}
+
+func (node *cacheNodeMock) receivedRequests() []string {
+	node.mux.Lock()
+	defer node.mux.Unlock()
+	return append([]string{}, node.requests...)
+}
+
+// connectTestCluster creates a TaskHandler connected to a cluster of the given members,
+// with two replicas per model
+func connectTestCluster(t *testing.T, members []ServingService) (*TaskHandler, func()) {
+	viper.Set("proxy.replicasPerModel", 2)
+	viper.Set("admin.token", testAdminToken)
+	dService := &DiscoveryServiceMock{
+		ListUpdatedChans: make(map[string]chan []ServingService, 0),
+	}
+	handler := NewTaskHandler(dService, nil)
+	if err := handler.ConnectToCluster(); err != nil {
+		t.Fatalf("Error connecting to cluster: %v", err)
+	}
+	dService.SetMembers(members)
+	// Send the member list again to make sure the first update has been applied
+	dService.SetMembers(members)
+	return handler, func() {
+		handler.DisconnectFromCluster()
+		viper.Set("proxy.replicasPerModel", nil)
+		viper.Set("admin.token", nil)
+	}
+}
+
+func setupAdminCluster(t *testing.T, numNodes int) (*TaskHandler, map[string]*cacheNodeMock, func()) {
+	nodes := map[string]*cacheNodeMock{}
+	members := []ServingService{}
+	for i := 0; i < numNodes; i++ {
+		node := newCacheNodeMock()
+		service := node.service()
+		nodes[service.String()] = node
+		members = append(members, service)
+	}
+	handler, disconnect := connectTestCluster(t, members)
+	return handler, nodes, func() {
+		disconnect()
+		for _, node := range nodes {
+			node.server.Close()
+		}
+	}
+}
+
+// newAdminRequest creates a request to the admin api with the admin token
+func newAdminRequest(method string, path string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func sendAdminRequest(t *testing.T, handler *TaskHandler, method string, path string) (int, ClusterResult) {
+	rec := httptest.NewRecorder()
+	handler.ServeAdmin()(rec, newAdminRequest(method, path))
+	var result ClusterResult
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatalf("Error decoding cluster result: %v", err)
+		}
+	}
+	return rec.Code, result
+}
+
+func TestAdminPreloadsModelOnAllReplicas(t *testing.T) {
+	handler, nodes, cleanup := setupAdminCluster(t, 4)
+	defer cleanup()
+
+	code, result := sendAdminRequest(t, handler, http.MethodPost, "/admin/cluster/models/foo/versions/1")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but was %d", code)
+	}
+	if len(result.Nodes) != 2 {
+		t.Fatalf("Expected model to be loaded on 2 nodes, but was loaded on %d", len(result.Nodes))
+	}
+	owners, _ := handler.Cluster.FindNodeForKey("foo##1")
+	for _, owner := range owners {
+		requests := nodes[owner.String()].receivedRequests()
+		if len(requests) != 1 || requests[0] != "POST /admin/models/foo/versions/1" {
+			t.Errorf("Expected node %s to receive preload request, but received: %v", owner.String(), requests)
+		}
+	}
+	for _, res := range result.Nodes {
+		if !res.Owner || res.Error != "" {
+			t.Errorf("Unexpected node result: %+v", res)
+		}
+	}
+
+	code, result = sendAdminRequest(t, handler, http.MethodGet, "/admin/cluster/models/foo/versions/1")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but was %d", code)
+	}
+	for _, res := range result.Nodes {
+		if res.State != "AVAILABLE" {
+			t.Errorf("Expected model to be available on node %s, but state was %s", res.Node, res.State)
+		}
+	}
+}
+
+func TestAdminEvictsModelFromAllNodes(t *testing.T) {
+	handler, nodes, cleanup := setupAdminCluster(t, 4)
+	defer cleanup()
+	for _, node := range nodes {
+		node.cached = true
+	}
+
+	code, result := sendAdminRequest(t, handler, http.MethodDelete, "/admin/cluster/models/foo/versions/1")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but was %d", code)
+	}
+	if len(result.Nodes) != 4 {
+		t.Fatalf("Expected model to be evicted from 4 nodes, but was evicted from %d", len(result.Nodes))
+	}
+	numOwners := 0
+	for _, res := range result.Nodes {
+		if res.Error != "" {
+			t.Errorf("Unexpected error on node %s: %s", res.Node, res.Error)
+		}
+		if res.Owner {
+			numOwners++
+		}
+	}
+	if numOwners != 2 {
+		t.Errorf("Expected 2 owners, but found %d", numOwners)
+	}
+	for name, node := range nodes {
+		if node.cached {
+			t.Errorf("Expected model to be evicted from node %s", name)
+		}
+	}
+}
+
+func TestAdminAggregatesNodeErrors(t *testing.T) {
+	handler, nodes, cleanup := setupAdminCluster(t, 2)
+	defer cleanup()
+	var stopped string
+	for name, node := range nodes {
+		node.server.Close()
+		stopped = name
+		break
+	}
+
+	code, result := sendAdminRequest(t, handler, http.MethodPost, "/admin/cluster/models/foo/versions/1")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but was %d", code)
+	}
+	for _, res := range result.Nodes {
+		if res.Node == stopped && res.Error == "" {
+			t.Errorf("Expected error for stopped node %s", res.Node)
+		}
+		if res.Node != stopped && res.Error != "" {
+			t.Errorf("Unexpected error for node %s: %s", res.Node, res.Error)
+		}
+	}
+}
+
+func TestAdminRequiresVersionWithoutResolver(t *testing.T) {
+	handler, _, cleanup := setupAdminCluster(t, 1)
+	defer cleanup()
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		code, _ := sendAdminRequest(t, handler, method, "/admin/cluster/models/foo")
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for %s, but was %d", method, code)
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	handler, nodes, cleanup := setupAdminCluster(t, 2)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	handler.ServeAdmin()(rec, httptest.NewRequest(http.MethodDelete, "/admin/cluster/models/foo/versions/1", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code 401 without token, but was %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeReplicas()(rec, httptest.NewRequest(http.MethodGet, "/admin/cluster/replicas", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code 401 without token, but was %d", rec.Code)
+	}
+	for _, node := range nodes {
+		if requests := node.receivedRequests(); len(requests) != 0 {
+			t.Errorf("Expected no requests to cache nodes, but got: %v", requests)
+		}
+	}
+
+	// Without a configured token, the admin api is read-only
+	handler.adminToken = ""
+	rec = httptest.NewRecorder()
+	handler.ServeAdmin()(rec, httptest.NewRequest(http.MethodPost, "/admin/cluster/models/foo/versions/1", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status code 403 without configured token, but was %d", rec.Code)
+	}
+}
+
+func TestAdminEscapesModelName(t *testing.T) {
+	handler, nodes, cleanup := setupAdminCluster(t, 2)
+	defer cleanup()
+
+	code, _ := sendAdminRequest(t, handler, http.MethodDelete, "/admin/cluster/models/foo%3Fbar=1/versions/1")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but was %d", code)
+	}
+	for _, node := range nodes {
+		requests := node.receivedRequests()
+		if len(requests) != 1 || requests[0] != "DELETE /admin/models/foo?bar=1/versions/1" {
+			t.Errorf("Expected model name to be escaped in request to cache node, but got: %v", requests)
+		}
+	}
+}
@@ -5,18 +5,27 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"stathat.com/c/consistent"
 )
 
 // ServingService contains network information of a
-// service that provides TF Serving
+// service that provides TF Serving, along with the
+// metadata it advertises through service discovery
 type ServingService struct {
 	Host     string
 	GrpcPort int
 	RestPort int
+	// CacheCapacity is the size of the model cache of the node in bytes. Zero means unknown.
+	CacheCapacity int64
+	// MaxConcurrentModels is the number of models the node serves simultaneously. Zero means unknown.
+	MaxConcurrentModels int
+	// Zone is the availability zone of the node
+	Zone string
+	// Version is the TFServingCache version of the node
+	Version string
 }
 
 // DiscoveryService is a service discovery provider.
@@ -42,17 +51,27 @@ const (
 // ClusterConnection represents a connection to a cluster,
 // and contains information such as the cluster membership list
 type ClusterConnection struct {
-	consistent       *consistent.Consistent
+	ring             hashRing
 	DiscoveryService DiscoveryService
 	State            ClusterState
 	memberUpdateChan chan []ServingService
+	membersMux       sync.RWMutex
+	members          []ServingService
+	membersByName    map[string]ServingService
+	done             chan struct{}
 }
 
 // NewClusterConnection creates a new ClusterConnection.
 // It does not connect to the cluster before Connect() is called.
 func NewClusterConnection(dService DiscoveryService) *ClusterConnection {
+	return newClusterConnection(dService, nil)
+}
+
+// newClusterConnection creates a new ClusterConnection whose hash ring
+// may use load to assign models to the nodes that are not overloaded
+func newClusterConnection(dService DiscoveryService, load *nodeLoad) *ClusterConnection {
 	cluster := &ClusterConnection{
-		consistent:       consistent.New(),
+		ring:             newHashRing(load),
 		DiscoveryService: dService,
 		State:            ClusterStateReady,
 	}
@@ -77,14 +96,17 @@ func (cluster *ClusterConnection) Connect() error {
 		return err
 	}
 	cluster.State = ClusterStateStarted
-	go clusterUpdated(cluster, cluster.memberUpdateChan)
+	cluster.done = make(chan struct{})
+	go clusterUpdated(cluster, cluster.memberUpdateChan, cluster.done)
 
 	return nil
 }
 
 // Disconnect removes this node from the cluster. Notice
 // that it is not necesarraily unregistered immediately,
-// depending on the discovery service implementation.
+// depending on the discovery service implementation. If the node
+// cannot be unregistered, the error is returned such that the caller
+// can continue shutting down.
 func (cluster *ClusterConnection) Disconnect() error {
 	if cluster.State != ClusterStateStarted {
 		return fmt.Errorf("Illegal cluster state: %s", cluster.State.String())
@@ -92,34 +114,63 @@ func (cluster *ClusterConnection) Disconnect() error {
 
 	cluster.DiscoveryService.RemoveNodeListUpdated("clusterChan")
 	cluster.State = ClusterStateReady
+	close(cluster.done)
 	err := cluster.DiscoveryService.UnregisterService()
 	if err != nil {
-		log.WithError(err).Fatal("Could not unregister discovery service")
-		return err
+		return fmt.Errorf("Could not unregister discovery service: %w", err)
 	}
 
 	return nil
 }
 
-func clusterUpdated(cluster *ClusterConnection, updateChan chan []ServingService) {
-	for cluster.State == ClusterStateStarted {
-		memberships := <-updateChan
-		services := make([]string, len(memberships))
-		for m := range memberships {
-			services[m] = memberships[m].String()
+func clusterUpdated(cluster *ClusterConnection, updateChan chan []ServingService, done chan struct{}) {
+	for {
+		var memberships []ServingService
+		select {
+		case memberships = <-updateChan:
+		case <-done:
+			return
 		}
-		cluster.consistent.Set(services)
+		membersByName := make(map[string]ServingService, len(memberships))
+		for _, member := range memberships {
+			membersByName[member.String()] = member
+		}
+		cluster.membersMux.Lock()
+		cluster.members = memberships
+		cluster.membersByName = membersByName
+		cluster.membersMux.Unlock()
+		cluster.ring.set(memberships)
 	}
 }
 
-// FindNodeForKey returns a node that can handle the model specified by the given key.
+// Members returns all nodes currently in the cluster
+func (cluster *ClusterConnection) Members() []ServingService {
+	cluster.membersMux.RLock()
+	defer cluster.membersMux.RUnlock()
+	members := make([]ServingService, len(cluster.members))
+	copy(members, cluster.members)
+	return members
+}
+
+// FindNodeForKey returns the proxy.replicasPerModel nodes that can handle the model specified by the given key.
 func (cluster *ClusterConnection) FindNodeForKey(key string) ([]ServingService, error) {
-	nodes, err := cluster.consistent.GetN(key, int(math.Max(viper.GetFloat64("proxy.replicasPerModel"), 1)))
+	return cluster.FindNodesForKey(key, int(math.Max(viper.GetFloat64("proxy.replicasPerModel"), 1)))
+}
+
+// FindNodesForKey returns the n nodes that can handle the model specified by the given key.
+func (cluster *ClusterConnection) FindNodesForKey(key string, n int) ([]ServingService, error) {
+	nodes, err := cluster.ring.getN(key, n)
 	if err != nil {
 		return nil, err
 	}
+	cluster.membersMux.RLock()
+	defer cluster.membersMux.RUnlock()
 	services := make([]ServingService, 0, len(nodes))
 	for n := range nodes {
+		if member, ok := cluster.membersByName[nodes[n]]; ok {
+			services = append(services, member)
+			continue
+		}
 		s, err := serviceFromString(nodes[n])
 		if err != nil {
 			log.WithError(err).Errorf("Invalid memmber in memberlist. Skipping: %s", nodes[n])
@@ -1,18 +1,22 @@
 package taskhandler
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"stathat.com/c/consistent"
 )
 
 type DiscoveryServiceMock struct {
 	ListUpdatedChans          map[string]chan []ServingService
 	NumRegisterServiceCalls   int
 	NumUnregisterServiceCalls int
+	UnregisterErr             error
 }
 
 func (dService *DiscoveryServiceMock) AddNodeListUpdated(name string, ch chan []ServingService) {
@@ -30,7 +34,7 @@ func (dService *DiscoveryServiceMock) RegisterService() error {
 
 func (dService *DiscoveryServiceMock) UnregisterService() error {
 	dService.NumUnregisterServiceCalls++
-	return nil
+	return dService.UnregisterErr
 }
 
 func (dService *DiscoveryServiceMock) GenerateMembers(numMembers int) {
@@ -43,12 +47,20 @@ func (dService *DiscoveryServiceMock) GenerateMembers(numMembers int) {
 			RestPort: 8000 + i,
 		}
 	}
+	dService.SetMembers(memberList)
+}
+
+func (dService *DiscoveryServiceMock) SetMembers(memberList []ServingService) {
 	for ch := range dService.ListUpdatedChans {
 		dService.ListUpdatedChans[ch] <- memberList
 	}
 }
 
 func TestConsistentHashingForNodes(t *testing.T) {
+	forEachHashRing(t, testConsistentHashingForNodes)
+}
+
+func testConsistentHashingForNodes(t *testing.T) {
 	dService := &DiscoveryServiceMock{
 		ListUpdatedChans: make(map[string]chan []ServingService, 0),
 	}
@@ -91,6 +103,9 @@ func TestConsistentHashingForNodes(t *testing.T) {
 	if len(nodeMap) != len(nodeNames) {
 		t.Errorf("Nodes not found in map")
 	}
+	if len(cluster.Members()) != 100 {
+		t.Errorf("Expected 100 cluster members, but found %d", len(cluster.Members()))
+	}
 
 	cluster.Disconnect()
 
@@ -100,6 +115,10 @@ func TestConsistentHashingForNodes(t *testing.T) {
 }
 
 func TestMembershipWithOneNode(t *testing.T) {
+	forEachHashRing(t, testMembershipWithOneNode)
+}
+
+func testMembershipWithOneNode(t *testing.T) {
 	dService := &DiscoveryServiceMock{
 		ListUpdatedChans: make(map[string]chan []ServingService, 0),
 	}
@@ -143,6 +162,10 @@ func TestMembershipWithOneNode(t *testing.T) {
 }
 
 func TestConsistentHashingForNodesDuringMembershipChange(t *testing.T) {
+	forEachHashRing(t, testConsistentHashingForNodesDuringMembershipChange)
+}
+
+func testConsistentHashingForNodesDuringMembershipChange(t *testing.T) {
 	dService := &DiscoveryServiceMock{
 		ListUpdatedChans: make(map[string]chan []ServingService, 0),
 	}
@@ -226,6 +249,230 @@ func TestConsistentHashingForNodesDuringMembershipChange(t *testing.T) {
 	}
 }
 
+func TestDisconnectReturnsUnregisterError(t *testing.T) {
+	dService := &DiscoveryServiceMock{
+		ListUpdatedChans: make(map[string]chan []ServingService, 0),
+		UnregisterErr:    errors.New("Connection refused"),
+	}
+	cluster := NewClusterConnection(dService)
+	if err := cluster.Connect(); err != nil {
+		t.Fatalf("Error connecting to cluster: %v", err)
+	}
+	err := cluster.Disconnect()
+	if !errors.Is(err, dService.UnregisterErr) {
+		t.Errorf("Expected the unregister error to be returned, but got: %v", err)
+	}
+	if cluster.State != ClusterStateReady {
+		t.Errorf("Expected cluster to be disconnected")
+	}
+}
+
+// forEachHashRing runs a test with each type of hash ring
+func forEachHashRing(t *testing.T, test func(t *testing.T)) {
+	for _, ringType := range []string{"consistent", "bounded"} {
+		t.Run(ringType, func(t *testing.T) {
+			viper.Set("proxy.hashRing.type", ringType)
+			defer viper.Set("proxy.hashRing.type", nil)
+			test(t)
+		})
+	}
+}
+
+func TestHashRingDistributionAndMovement(t *testing.T) {
+	forEachHashRing(t, func(t *testing.T) {
+		ring := newHashRing(nil)
+		ring.set(testMembers(20))
+		numKeys := 20000
+		assigned := make(map[string]string, numKeys)
+		loads := map[string]int{}
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("model_%d##1", i)
+			nodes, err := ring.getN(key, 1)
+			if err != nil {
+				t.Fatalf("Error resolving nodes: %v", err)
+			}
+			assigned[key] = nodes[0]
+			loads[nodes[0]]++
+		}
+		maxLoad := 0
+		for _, load := range loads {
+			if load > maxLoad {
+				maxLoad = load
+			}
+		}
+		avgLoad := float64(numKeys) / 20
+
+		// Add a node and measure how many keys are moved
+		ring.set(testMembers(21))
+		moved := 0
+		for key, node := range assigned {
+			nodes, _ := ring.getN(key, 1)
+			if nodes[0] != node {
+				moved++
+			}
+		}
+		movedRatio := float64(moved) / float64(numKeys)
+		t.Logf("Max load: %d (%.2fx average). Moved keys: %.1f%%", maxLoad, float64(maxLoad)/avgLoad, movedRatio*100)
+
+		if movedRatio > 0.1 {
+			t.Errorf("Expected at most 10%% of keys to move when adding a node, but %.1f%% moved", movedRatio*100)
+		}
+	})
+}
+
+func TestBoundedRingWeightsByCapacity(t *testing.T) {
+	members := testMembers(2)
+	members[0].CacheCapacity = 3000
+	members[1].CacheCapacity = 1000
+	ring := newBoundedRing(1.25, 100, func(members []ServingService) map[string]float64 {
+		return nodeWeights(members, nil, true)
+	})
+	ring.set(members)
+	loads := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		nodes, _ := ring.getN(fmt.Sprintf("model_%d##1", i), 1)
+		loads[nodes[0]]++
+	}
+	share := float64(loads[members[0].String()]) / 4000
+	if share < 0.65 || share > 0.85 {
+		t.Errorf("Expected node with 3x capacity to get 75%% of the keys, but got %.1f%%", share*100)
+	}
+}
+
+func TestConsistentRingWeightsByCapacity(t *testing.T) {
+	members := testMembers(2)
+	members[0].CacheCapacity = 3000
+	members[1].CacheCapacity = 1000
+	ring := newConsistentRing(false, func(members []ServingService) map[string]float64 {
+		return nodeWeights(members, nil, true)
+	})
+	ring.set(members)
+	loads := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		nodes, _ := ring.getN(fmt.Sprintf("model_%d##1", i), 1)
+		loads[nodes[0]]++
+	}
+	share := float64(loads[members[0].String()]) / 4000
+	if share < 0.6 || share > 0.9 {
+		t.Errorf("Expected node with 3x capacity to get 75%% of the keys, but got %.1f%%", share*100)
+	}
+
+	// Nodes of equal weight keep the placement of an unweighted ring
+	members = testMembers(5)
+	ring.set(members)
+	unweighted := consistent.New()
+	for _, member := range members {
+		unweighted.Add(member.String())
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("model_%d##1", i)
+		nodes, _ := ring.getN(key, 2)
+		expected, _ := unweighted.GetN(key, 2)
+		if !cmp.Equal(nodes, expected) {
+			t.Fatalf("Expected %s to be assigned to %v, but got %v", key, expected, nodes)
+		}
+	}
+}
+
+func TestBoundedRingReplicas(t *testing.T) {
+	ring := newBoundedRing(1.25, 100, func(members []ServingService) map[string]float64 {
+		return nodeWeights(members, nil, false)
+	})
+	if _, err := ring.getN("foo##1", 1); err != errEmptyRing {
+		t.Errorf("Expected error for empty ring, but got: %v", err)
+	}
+	ring.set(testMembers(5))
+	nodes, _ := ring.getN("foo##1", 3)
+	if len(nodes) != 3 || nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+		t.Errorf("Expected 3 distinct nodes, but got: %v", nodes)
+	}
+	more, _ := ring.getN("foo##1", 10)
+	if len(more) != 5 {
+		t.Errorf("Expected replicas to be capped by the number of nodes, but got %d", len(more))
+	}
+	// Unchanged membership keeps the assignment
+	ring.set(testMembers(5))
+	again, _ := ring.getN("foo##1", 5)
+	if !cmp.Equal(more, again) {
+		t.Errorf("Expected assignment to be unchanged, but was %v and %v", more, again)
+	}
+}
+
+func TestBoundedRingSkipsOverloadedNodes(t *testing.T) {
+	members := testMembers(4)
+	load := newNodeLoad()
+	ring := newBoundedRing(1.25, 100, func(members []ServingService) map[string]float64 {
+		return nodeWeights(members, nil, false)
+	})
+	ring.load = load
+	ring.set(members)
+	byName := map[string]ServingService{}
+	for _, member := range members {
+		byName[member.String()] = member
+	}
+
+	nodes, _ := ring.getN("foo##1", 1)
+	primary := nodes[0]
+	// A node may take up to 1.25 times the average number of in-flight requests,
+	// including the new request: ceil(1.25*(4+1)/4) = 2
+	dones := []func(){}
+	for i := 0; i < 4; i++ {
+		dones = append(dones, load.start(restAddress(byName[primary])))
+	}
+	nodes, _ = ring.getN("foo##1", 1)
+	if nodes[0] == primary {
+		t.Errorf("Expected overloaded node %s to be skipped", primary)
+	}
+	// When all nodes are equally busy, the key is assigned to its node again
+	for _, member := range members {
+		for i := 0; i < 4 && member.String() != primary; i++ {
+			dones = append(dones, load.start(restAddress(member)))
+		}
+	}
+	nodes, _ = ring.getN("foo##1", 1)
+	if nodes[0] != primary {
+		t.Errorf("Expected %s to be selected when all nodes are busy, but got %s", primary, nodes[0])
+	}
+	for _, done := range dones {
+		done()
+	}
+	nodes, _ = ring.getN("foo##1", 1)
+	if nodes[0] != primary {
+		t.Errorf("Expected %s to be selected when the load is gone, but got %s", primary, nodes[0])
+	}
+}
+
+func TestBoundedRingIsIndependentOfRequestOrder(t *testing.T) {
+	newRing := func() *boundedRing {
+		return newBoundedRing(1.25, 100, func(members []ServingService) map[string]float64 {
+			return nodeWeights(members, nil, false)
+		})
+	}
+	members := testMembers(10)
+	reversed := make([]ServingService, len(members))
+	for i := range members {
+		reversed[len(members)-1-i] = members[i]
+	}
+	ring1 := newRing()
+	ring1.set(members)
+	ring2 := newRing()
+	ring2.set(reversed)
+
+	// The proxies see the keys in different orders and with different replica counts
+	assigned := map[string][]string{}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("model_%d##1", i)
+		assigned[key], _ = ring1.getN(key, 2)
+	}
+	for i := 199; i >= 0; i-- {
+		key := fmt.Sprintf("model_%d##1", i)
+		nodes, _ := ring2.getN(key, 3)
+		if !cmp.Equal(assigned[key], nodes[:2]) {
+			t.Errorf("Expected key %s to be assigned to the same nodes, but was %v and %v", key, assigned[key], nodes)
+		}
+	}
+}
+
 func generateNodesAndWaitForMembership(dService *DiscoveryServiceMock, cluster *ClusterConnection, numNodes int) error {
 	// wait for nodes to become visible
 	dService.GenerateMembers(numNodes)
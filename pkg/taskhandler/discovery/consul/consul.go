@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -48,6 +49,7 @@ func NewDiscoveryService(healthCheck func() (bool, error)) (*ConsulDiscoveryServ
 
 func (consul *ConsulDiscoveryService) RegisterService() error {
 	agent := consul.ConsulClient.Agent()
+	local := taskhandler.LocalServingService("")
 	serviceDef := &api.AgentServiceRegistration{
 		Name: consul.ServiceName,
 		ID:   consul.ServiceID,
@@ -55,6 +57,7 @@ func (consul *ConsulDiscoveryService) RegisterService() error {
 			fmt.Sprintf("rest:%d", viper.GetInt("cacheRestPort")),
 			fmt.Sprintf("grpc:%d", viper.GetInt("cacheGrpcPort")),
 		},
+		Meta: local.Metadata(),
 		Check: &api.AgentServiceCheck{
 			TTL:                            consul.ttl.String(),
 			DeregisterCriticalServiceAfter: (consul.ttl * 100).String(),
@@ -101,11 +104,13 @@ func (consul *ConsulDiscoveryService) RegisterService() error {
 						addr = res[k].Node.Address
 					}
 					log.Debugf("Found node: %s: %s:%d:%d", id, addr, restPort, grpcPort)
-					passingNodes = append(passingNodes, taskhandler.ServingService{
+					node := taskhandler.ServingService{
 						Host:     addr,
 						RestPort: restPort,
 						GrpcPort: grpcPort,
-					})
+					}
+					node.SetMetadata(res[k].Service.Meta)
+					passingNodes = append(passingNodes, node)
 				}
 				for ch := range consul.ListUpdatedChans {
 					consul.ListUpdatedChans[ch] <- passingNodes
@@ -148,6 +153,9 @@ func (consul *ConsulDiscoveryService) update(check func() (bool, error)) {
 	checkId := "service:" + consul.ServiceID
 
 	if !ok {
+		if err == nil {
+			err = errors.New("Health check failed")
+		}
 		log.WithError(err).Warn("Health check failed")
 		if agentErr := a.UpdateTTL(checkId, err.Error(), "fail"); agentErr != nil {
 			log.WithError(agentErr).Error("Error updating TTL")
@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Resolver resolves DNS records. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscoveryService discovers the nodes by periodically resolving a DNS
+// name, e.g. a Kubernetes headless service. The nodes are either the A/AAAA
+// records of the name, with the ports from the configuration, or the targets
+// of its SRV records, with the ports from the records.
+type DNSDiscoveryService struct {
+	mux              sync.Mutex
+	ListUpdatedChans map[string]chan []taskhandler.ServingService
+	Resolver         Resolver
+	Name             string
+	// RecordType is either "A", for A/AAAA records, or "SRV"
+	RecordType string
+	// RestService and GrpcService are the SRV services of the ports, e.g.
+	// "httpcache" for _httpcache._tcp.<name>. If RestService is empty, the SRV
+	// records of the name itself are used. If GrpcService is empty, GrpcPort is used.
+	RestService string
+	GrpcService string
+	RestPort    int
+	GrpcPort    int
+	Interval    time.Duration
+	Timeout     time.Duration
+	nodes       []taskhandler.ServingService
+	stop        chan struct{}
+}
+
+func NewDiscoveryService() (*DNSDiscoveryService, error) {
+	service := &DNSDiscoveryService{
+		ListUpdatedChans: make(map[string]chan []taskhandler.ServingService, 0),
+		Resolver:         net.DefaultResolver,
+		Name:             viper.GetString("serviceDiscovery.dns.name"),
+		RecordType:       strings.ToUpper(viper.GetString("serviceDiscovery.dns.recordType")),
+		RestService:      viper.GetString("serviceDiscovery.dns.srv.restService"),
+		GrpcService:      viper.GetString("serviceDiscovery.dns.srv.grpcService"),
+		RestPort:         viper.GetInt("serviceDiscovery.dns.restPort"),
+		GrpcPort:         viper.GetInt("serviceDiscovery.dns.grpcPort"),
+		Interval:         viper.GetDuration("serviceDiscovery.dns.interval") * time.Second,
+		Timeout:          viper.GetDuration("serviceDiscovery.dns.timeout") * time.Second,
+	}
+	if service.Name == "" {
+		return nil, fmt.Errorf("serviceDiscovery.dns.name must be set")
+	}
+	if service.RestPort == 0 {
+		service.RestPort = viper.GetInt("cacheRestPort")
+	}
+	if service.GrpcPort == 0 {
+		service.GrpcPort = viper.GetInt("cacheGrpcPort")
+	}
+	if service.Interval <= 0 {
+		service.Interval = 5 * time.Second
+	}
+	switch service.RecordType {
+	case "":
+		service.RecordType = "A"
+	case "A", "SRV":
+	default:
+		return nil, fmt.Errorf("Unsupported DNS record type: %s", service.RecordType)
+	}
+	return service, nil
+}
+
+// RegisterService starts resolving the nodes. The node itself is
+// registered by whatever manages the DNS records.
+func (service *DNSDiscoveryService) RegisterService() error {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.stop != nil {
+		return nil
+	}
+	stop := make(chan struct{})
+	service.stop = stop
+	go func() {
+		ticker := time.NewTicker(service.Interval)
+		defer ticker.Stop()
+		for {
+			service.refresh()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (service *DNSDiscoveryService) UnregisterService() error {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.stop != nil {
+		close(service.stop)
+		service.stop = nil
+	}
+	return nil
+}
+
+func (service *DNSDiscoveryService) AddNodeListUpdated(key string, sub chan []taskhandler.ServingService) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	service.ListUpdatedChans[key] = sub
+}
+
+func (service *DNSDiscoveryService) RemoveNodeListUpdated(key string) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	delete(service.ListUpdatedChans, key)
+}
+
+// refresh resolves the nodes and publishes them if they changed
+func (service *DNSDiscoveryService) refresh() {
+	ctx := context.Background()
+	if service.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, service.Timeout)
+		defer cancel()
+	}
+	nodes, err := service.resolve(ctx)
+	if err != nil {
+		log.WithError(err).Errorf("Could not resolve nodes from %s", service.Name)
+		return
+	}
+
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if reflect.DeepEqual(nodes, service.nodes) {
+		return
+	}
+	log.Debugf("Nodes of %s changed: %v", service.Name, nodes)
+	service.nodes = nodes
+	for ch := range service.ListUpdatedChans {
+		memberList := make([]taskhandler.ServingService, len(nodes))
+		copy(memberList, nodes)
+		service.ListUpdatedChans[ch] <- memberList
+	}
+}
+
+// resolve returns the nodes of the DNS name, sorted by their address
+func (service *DNSDiscoveryService) resolve(ctx context.Context) ([]taskhandler.ServingService, error) {
+	var nodes []taskhandler.ServingService
+	if service.RecordType == "SRV" {
+		proto := "tcp"
+		if service.RestService == "" {
+			proto = ""
+		}
+		_, restRecords, err := service.Resolver.LookupSRV(ctx, service.RestService, proto, service.Name)
+		if err != nil {
+			return nil, err
+		}
+		grpcPorts := map[string]int{}
+		if service.GrpcService != "" {
+			_, grpcRecords, err := service.Resolver.LookupSRV(ctx, service.GrpcService, "tcp", service.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range grpcRecords {
+				grpcPorts[record.Target] = int(record.Port)
+			}
+		}
+		for _, record := range restRecords {
+			grpcPort := service.GrpcPort
+			if service.GrpcService != "" {
+				port, ok := grpcPorts[record.Target]
+				if !ok {
+					log.Warnf("No %s SRV record for %s. Skipping", service.GrpcService, record.Target)
+					continue
+				}
+				grpcPort = port
+			}
+			nodes = append(nodes, taskhandler.ServingService{
+				Host:     strings.TrimSuffix(record.Target, "."),
+				RestPort: int(record.Port),
+				GrpcPort: grpcPort,
+			})
+		}
+	} else {
+		addrs, err := service.Resolver.LookupIPAddr(ctx, service.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			host := addr.IP.String()
+			if addr.IP.To4() == nil {
+				// IPv6 addresses are bracketed, such that they can be joined with a port
+				host = "[" + host + "]"
+			}
+			nodes = append(nodes, taskhandler.ServingService{
+				Host:     host,
+				RestPort: service.RestPort,
+				GrpcPort: service.GrpcPort,
+			})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].String() < nodes[j].String()
+	})
+	return nodes, nil
+}
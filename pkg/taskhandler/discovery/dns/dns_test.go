@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+)
+
+type resolverMock struct {
+	mux   sync.Mutex
+	addrs []net.IPAddr
+	srv   map[string][]*net.SRV
+}
+
+func (resolver *resolverMock) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	resolver.mux.Lock()
+	defer resolver.mux.Unlock()
+	return resolver.addrs, nil
+}
+
+func (resolver *resolverMock) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", resolver.srv[service], nil
+}
+
+func newTestService(resolver Resolver, recordType string) *DNSDiscoveryService {
+	return &DNSDiscoveryService{
+		ListUpdatedChans: make(map[string]chan []taskhandler.ServingService, 0),
+		Resolver:         resolver,
+		Name:             "tfservingcache.default.svc.cluster.local",
+		RecordType:       recordType,
+		RestPort:         8094,
+		GrpcPort:         8095,
+		Interval:         10 * time.Millisecond,
+	}
+}
+
+func receiveNodes(t *testing.T, ch chan []taskhandler.ServingService) []taskhandler.ServingService {
+	select {
+	case nodes := <-ch:
+		return nodes
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for node list")
+		return nil
+	}
+}
+
+func TestResolveAddressRecords(t *testing.T) {
+	resolver := &resolverMock{addrs: []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("fd00::1")}}}
+	service := newTestService(resolver, "A")
+
+	nodes, err := service.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Error resolving nodes: %v", err)
+	}
+	expected := []taskhandler.ServingService{
+		{Host: "10.0.0.2", RestPort: 8094, GrpcPort: 8095},
+		{Host: "[fd00::1]", RestPort: 8094, GrpcPort: 8095},
+	}
+	if len(nodes) != 2 || nodes[0] != expected[0] || nodes[1] != expected[1] {
+		t.Errorf("Expected %v, but got %v", expected, nodes)
+	}
+}
+
+func TestResolveSRVRecords(t *testing.T) {
+	resolver := &resolverMock{srv: map[string][]*net.SRV{
+		"httpcache": {{Target: "pod-1.tfservingcache.", Port: 9094}, {Target: "pod-2.tfservingcache.", Port: 9094}},
+		"grpccache": {{Target: "pod-1.tfservingcache.", Port: 9095}},
+	}}
+	service := newTestService(resolver, "SRV")
+	service.RestService = "httpcache"
+	service.GrpcService = "grpccache"
+
+	nodes, err := service.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Error resolving nodes: %v", err)
+	}
+	// pod-2 has no gRPC port and is skipped
+	expected := taskhandler.ServingService{Host: "pod-1.tfservingcache", RestPort: 9094, GrpcPort: 9095}
+	if len(nodes) != 1 || nodes[0] != expected {
+		t.Errorf("Expected %v, but got %v", expected, nodes)
+	}
+
+	// Without a gRPC service, the configured gRPC port is used
+	service.GrpcService = ""
+	nodes, _ = service.resolve(context.Background())
+	if len(nodes) != 2 || nodes[1].GrpcPort != 8095 {
+		t.Errorf("Expected 2 nodes with the configured gRPC port, but got %v", nodes)
+	}
+}
+
+func TestPublishesOnlyChanges(t *testing.T) {
+	resolver := &resolverMock{addrs: []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}}}
+	service := newTestService(resolver, "A")
+	ch := make(chan []taskhandler.ServingService)
+	service.AddNodeListUpdated("test", ch)
+	if err := service.RegisterService(); err != nil {
+		t.Fatalf("Error registering service: %v", err)
+	}
+	defer service.UnregisterService()
+	defer service.RemoveNodeListUpdated("test")
+
+	if nodes := receiveNodes(t, ch); len(nodes) != 1 {
+		t.Errorf("Expected 1 node, but got %v", nodes)
+	}
+	select {
+	case nodes := <-ch:
+		t.Errorf("Expected no update for unchanged records, but got %v", nodes)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resolver.mux.Lock()
+	resolver.addrs = append(resolver.addrs, net.IPAddr{IP: net.ParseIP("10.0.0.3")})
+	resolver.mux.Unlock()
+	if nodes := receiveNodes(t, ch); len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes, but got %v", nodes)
+	}
+}
@@ -2,6 +2,7 @@ package etcd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
@@ -23,6 +24,7 @@ type EtcdDiscoveryService struct {
 	ttl              time.Duration
 	HealthCheckFun   func() (bool, error)
 	serviceKey       string
+	metaKey          string
 	outboundIp       string
 }
 
@@ -51,6 +53,7 @@ func NewDiscoveryService(healthCheck func() (bool, error)) (*EtcdDiscoveryServic
 	}
 
 	service.serviceKey = fmt.Sprintf("/service/%s/%s", service.ServiceName, service.ServiceId)
+	service.metaKey = fmt.Sprintf("/servicemeta/%s/%s", service.ServiceName, service.ServiceId)
 
 	return service, nil
 }
@@ -58,7 +61,8 @@ func NewDiscoveryService(healthCheck func() (bool, error)) (*EtcdDiscoveryServic
 func (service *EtcdDiscoveryService) RegisterService() error {
 	go service.updateTTL(service.HealthCheckFun)
 	updaterFunc := func() {
-		watchChan := service.EtcdClient.Watch(context.Background(), "/service/"+service.ServiceName, clientv3.WithPrefix())
+		// The prefix matches both the service keys and the metadata keys
+		watchChan := service.EtcdClient.Watch(context.Background(), "/service", clientv3.WithPrefix())
 		nodeMap := make(map[string]string, 0)
 		for {
 			updates := <-watchChan
@@ -70,6 +74,9 @@ func (service *EtcdDiscoveryService) RegisterService() error {
 				for k := range updates.Events {
 					event := updates.Events[k]
 					keyStr := string(event.Kv.Key)
+					if !service.isClusterKey(keyStr) {
+						continue
+					}
 					if event.IsCreate() || event.IsModify() {
 						val, exists := nodeMap[keyStr]
 						valStr := string(event.Kv.Value)
@@ -85,24 +92,7 @@ func (service *EtcdDiscoveryService) RegisterService() error {
 					}
 				}
 				if isUpdated {
-					memberList := make([]taskhandler.ServingService, 0, len(nodeMap))
-					for k := range nodeMap {
-						serviceParts := strings.Split(nodeMap[k], ":")
-						restPort, err := strconv.Atoi(serviceParts[1])
-						if err != nil {
-							log.WithError(err).Errorf("Invalid rest port: %s", serviceParts[1])
-						}
-						grpcPort, err := strconv.Atoi(serviceParts[2])
-						if err != nil {
-							log.WithError(err).Errorf("Invalid grpc port: %s", serviceParts[2])
-						}
-						memberList = append(memberList, taskhandler.ServingService{
-							Host:     serviceParts[0],
-							RestPort: restPort,
-							GrpcPort: grpcPort,
-						})
-						log.Debugf("Found node: %s: %s", k, nodeMap[k])
-					}
+					memberList := service.members(nodeMap)
 					for ch := range service.ListUpdatedChans {
 						service.ListUpdatedChans[ch] <- memberList
 					}
@@ -116,7 +106,10 @@ func (service *EtcdDiscoveryService) RegisterService() error {
 }
 
 func (service *EtcdDiscoveryService) UnregisterService() error {
-	_, err := service.EtcdClient.KV.Delete(context.Background(), service.serviceKey)
+	_, err := service.EtcdClient.Txn(context.Background()).Then(
+		clientv3.OpDelete(service.serviceKey),
+		clientv3.OpDelete(service.metaKey),
+	).Commit()
 	if err != nil {
 		log.WithError(err).Error("Could not set etc.d key")
 	}
@@ -133,20 +126,89 @@ func (service *EtcdDiscoveryService) RemoveNodeListUpdated(key string) {
 
 func (service *EtcdDiscoveryService) updateTTL(check func() (bool, error)) {
 	ticker := time.NewTicker(service.ttl / 2)
-	restPort := viper.GetInt("cacheRestPort")
-	grpcPort := viper.GetInt("cacheGrpcPort")
+	local := taskhandler.LocalServingService(service.outboundIp)
+	meta, err := json.Marshal(local.Metadata())
+	if err != nil {
+		log.WithError(err).Fatal("Could not encode service metadata")
+	}
 	for range ticker.C {
+		// An unhealthy node does not renew its key, such that it expires and the node is removed from the cluster
+		if ok, err := check(); !ok {
+			log.WithError(err).Warn("Health check failed")
+			continue
+		}
 		lease, err := service.EtcdClient.Lease.Grant(context.Background(), int64(service.ttl.Seconds()))
 		if err != nil {
 			log.WithError(err).Error("Could not set etc.d key")
+			continue
 		}
-		_, err = service.EtcdClient.KV.Put(context.Background(), service.serviceKey, fmt.Sprintf("%s:%d:%d", service.outboundIp, restPort, grpcPort), clientv3.WithLease(lease.ID))
+		_, err = service.EtcdClient.Txn(context.Background()).Then(
+			clientv3.OpPut(service.serviceKey, local.String(), clientv3.WithLease(lease.ID)),
+			clientv3.OpPut(service.metaKey, string(meta), clientv3.WithLease(lease.ID)),
+		).Commit()
 		if err != nil {
 			log.WithError(err).Error("Could not set etc.d key")
 		}
 	}
 }
 
+// isClusterKey returns whether the key is a service key or a metadata key of the service
+func (service *EtcdDiscoveryService) isClusterKey(key string) bool {
+	return strings.HasPrefix(key, "/service/"+service.ServiceName+"/") ||
+		strings.HasPrefix(key, "/servicemeta/"+service.ServiceName+"/")
+}
+
+// members returns the nodes of the given keys and values. The value of a service key
+// is "<host>:<rest port>:<grpc port>", as understood by all versions, while the metadata
+// of the node is stored as JSON under the metadata key with the same node id.
+func (service *EtcdDiscoveryService) members(nodeMap map[string]string) []taskhandler.ServingService {
+	servicePrefix := "/service/" + service.ServiceName + "/"
+	memberList := make([]taskhandler.ServingService, 0, len(nodeMap))
+	for k, value := range nodeMap {
+		if !strings.HasPrefix(k, servicePrefix) {
+			continue
+		}
+		node, err := parseServiceValue(value)
+		if err != nil {
+			log.WithError(err).Errorf("Invalid service: %s", value)
+			continue
+		}
+		metaKey := "/servicemeta/" + service.ServiceName + "/" + strings.TrimPrefix(k, servicePrefix)
+		if metaValue, ok := nodeMap[metaKey]; ok {
+			var meta map[string]string
+			if err := json.Unmarshal([]byte(metaValue), &meta); err != nil {
+				log.WithError(err).Warnf("Invalid metadata of service: %s", value)
+			} else {
+				node.SetMetadata(meta)
+			}
+		}
+		memberList = append(memberList, node)
+		log.Debugf("Found node: %s: %s", k, value)
+	}
+	return memberList
+}
+
+// parseServiceValue parses the value of a service key: "<host>:<rest port>:<grpc port>"
+func parseServiceValue(value string) (taskhandler.ServingService, error) {
+	var node taskhandler.ServingService
+	serviceParts := strings.Split(value, ":")
+	if len(serviceParts) != 3 {
+		return node, fmt.Errorf("Invalid service value: %s", value)
+	}
+	restPort, err := strconv.Atoi(serviceParts[1])
+	if err != nil {
+		return node, fmt.Errorf("Invalid rest port: %s", serviceParts[1])
+	}
+	grpcPort, err := strconv.Atoi(serviceParts[2])
+	if err != nil {
+		return node, fmt.Errorf("Invalid grpc port: %s", serviceParts[2])
+	}
+	node.Host = serviceParts[0]
+	node.RestPort = restPort
+	node.GrpcPort = grpcPort
+	return node, nil
+}
+
 // Get preferred outbound ip of this machine
 // Source: https://stackoverflow.com/questions/23558425/how-do-i-get-the-local-ip-address-in-go
 func getOutboundIP() net.IP {
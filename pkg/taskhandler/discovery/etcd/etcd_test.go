@@ -0,0 +1,44 @@
+package etcd
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+)
+
+func TestMembersReadsMetadataFromSeparateKey(t *testing.T) {
+	service := &EtcdDiscoveryService{ServiceName: "cache"}
+	nodes := service.members(map[string]string{
+		// A node of an older version without metadata
+		"/service/cache/a":     "host1:8094:8095",
+		"/service/cache/b":     "host2:8094:8095",
+		"/servicemeta/cache/b": `{"cacheCapacity":"1000","zone":"eu-1a","version":"1.2.0"}`,
+		// Metadata of a node whose service key has expired is ignored
+		"/servicemeta/cache/c": `{"zone":"eu-1b"}`,
+		"/service/cache/d":     "invalid",
+	})
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Host < nodes[j].Host })
+	expected := []taskhandler.ServingService{
+		{Host: "host1", RestPort: 8094, GrpcPort: 8095},
+		{Host: "host2", RestPort: 8094, GrpcPort: 8095, CacheCapacity: 1000, Zone: "eu-1a", Version: "1.2.0"},
+	}
+	if len(nodes) != 2 || nodes[0] != expected[0] || nodes[1] != expected[1] {
+		t.Errorf("Expected %v, but got %v", expected, nodes)
+	}
+}
+
+func TestIsClusterKey(t *testing.T) {
+	service := &EtcdDiscoveryService{ServiceName: "cache"}
+	for key, expected := range map[string]bool{
+		"/service/cache/a":     true,
+		"/servicemeta/cache/a": true,
+		"/service/cache2/a":    false,
+		"/servicemeta/other/a": false,
+		"/services/cache/a":    false,
+	} {
+		if service.isClusterKey(key) != expected {
+			t.Errorf("Expected isClusterKey(%s) to be %v", key, expected)
+		}
+	}
+}
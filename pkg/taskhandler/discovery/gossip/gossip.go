@@ -0,0 +1,290 @@
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// GossipDiscoveryService discovers the nodes with the SWIM based gossip
+// protocol of memberlist, without any external coordination service. Nodes
+// join the cluster through a list of seed nodes and share their metadata
+// with the other nodes through the gossip protocol.
+type GossipDiscoveryService struct {
+	mux              sync.Mutex
+	ListUpdatedChans map[string]chan []taskhandler.ServingService
+	Config           *memberlist.Config
+	Seeds            []string
+	// RejoinInterval is the interval at which the node retries to join the
+	// seeds while it is the only member of the cluster
+	RejoinInterval time.Duration
+	local          taskhandler.ServingService
+	list           *memberlist.Memberlist
+	nodes          []taskhandler.ServingService
+	changed        chan struct{}
+	stop           chan struct{}
+}
+
+func NewDiscoveryService() (*GossipDiscoveryService, error) {
+	config := memberlist.DefaultLANConfig()
+	if name := viper.GetString("serviceDiscovery.gossip.nodeName"); name != "" {
+		config.Name = name
+	} else if hostname, err := os.Hostname(); err == nil {
+		config.Name = hostname
+	}
+	if viper.IsSet("serviceDiscovery.gossip.bindAddr") {
+		config.BindAddr = viper.GetString("serviceDiscovery.gossip.bindAddr")
+	}
+	if viper.IsSet("serviceDiscovery.gossip.bindPort") {
+		config.BindPort = viper.GetInt("serviceDiscovery.gossip.bindPort")
+	}
+	config.AdvertiseAddr = viper.GetString("serviceDiscovery.gossip.advertiseAddr")
+	config.AdvertisePort = config.BindPort
+	if port := viper.GetInt("serviceDiscovery.gossip.advertisePort"); port != 0 {
+		config.AdvertisePort = port
+	}
+	if timeout := viper.GetFloat64("serviceDiscovery.gossip.failureTimeout"); timeout > 0 {
+		SetFailureTimeout(config, time.Duration(timeout*float64(time.Second)))
+	}
+	if key := viper.GetString("serviceDiscovery.gossip.secretKey"); key != "" {
+		config.SecretKey = []byte(key)
+	}
+
+	service := newDiscoveryService(config, viper.GetStringSlice("serviceDiscovery.gossip.seeds"), taskhandler.LocalServingService(""))
+	return service, nil
+}
+
+func newDiscoveryService(config *memberlist.Config, seeds []string, local taskhandler.ServingService) *GossipDiscoveryService {
+	service := &GossipDiscoveryService{
+		ListUpdatedChans: make(map[string]chan []taskhandler.ServingService, 0),
+		Config:           config,
+		Seeds:            seeds,
+		RejoinInterval:   10 * time.Second,
+		local:            local,
+		changed:          make(chan struct{}, 1),
+	}
+	config.Delegate = &delegate{service: service}
+	config.Events = &eventDelegate{service: service}
+	config.LogOutput = log.StandardLogger().WriterLevel(log.DebugLevel)
+	return service
+}
+
+// SetFailureTimeout configures memberlist such that a failed node is detected and
+// removed after about the given timeout in clusters of up to 10 nodes. The
+// timeout grows logarithmically with the size of the cluster.
+func SetFailureTimeout(config *memberlist.Config, timeout time.Duration) {
+	// A failed node is detected within a probe interval and a probe timeout, after
+	// which it is suspected for SuspicionMult probe intervals before it is removed
+	config.SuspicionMult = 4
+	config.ProbeInterval = timeout / 6
+	config.ProbeTimeout = config.ProbeInterval / 2
+}
+
+// RegisterService starts the gossip protocol and joins the seed nodes
+func (service *GossipDiscoveryService) RegisterService() error {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.list != nil {
+		return nil
+	}
+	list, err := memberlist.Create(service.Config)
+	if err != nil {
+		log.WithError(err).Error("Could not start gossip")
+		return err
+	}
+	service.list = list
+	service.stop = make(chan struct{})
+	go service.publishChanges(service.stop)
+	go service.join(list, service.stop)
+	return nil
+}
+
+// UnregisterService leaves the cluster and stops the gossip protocol
+func (service *GossipDiscoveryService) UnregisterService() error {
+	service.mux.Lock()
+	list := service.list
+	if list == nil {
+		service.mux.Unlock()
+		return nil
+	}
+	service.list = nil
+	close(service.stop)
+	service.mux.Unlock()
+
+	err := list.Leave(5 * time.Second)
+	if err != nil {
+		log.WithError(err).Error("Could not leave gossip cluster")
+	}
+	if shutdownErr := list.Shutdown(); shutdownErr != nil {
+		log.WithError(shutdownErr).Error("Could not stop gossip")
+		return shutdownErr
+	}
+	return err
+}
+
+func (service *GossipDiscoveryService) AddNodeListUpdated(key string, sub chan []taskhandler.ServingService) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	service.ListUpdatedChans[key] = sub
+}
+
+func (service *GossipDiscoveryService) RemoveNodeListUpdated(key string) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	delete(service.ListUpdatedChans, key)
+}
+
+// Address returns the address other nodes can use as seed to join this node
+func (service *GossipDiscoveryService) Address() string {
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.list == nil {
+		return ""
+	}
+	node := service.list.LocalNode()
+	return net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+}
+
+// join joins the seed nodes, and retries while this node is the only member
+func (service *GossipDiscoveryService) join(list *memberlist.Memberlist, stop chan struct{}) {
+	if len(service.Seeds) == 0 {
+		return
+	}
+	ticker := time.NewTicker(service.RejoinInterval)
+	defer ticker.Stop()
+	for {
+		if list.NumMembers() <= 1 {
+			numJoined, err := list.Join(service.Seeds)
+			if err != nil {
+				log.WithError(err).Warnf("Could not join gossip seeds: %v", service.Seeds)
+			} else {
+				log.Infof("Joined gossip cluster through %d seeds", numJoined)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// notifyChanged schedules publishing the members without blocking memberlist
+func (service *GossipDiscoveryService) notifyChanged() {
+	select {
+	case service.changed <- struct{}{}:
+	default:
+	}
+}
+
+// publishChanges publishes the members to the subscribers when they change
+func (service *GossipDiscoveryService) publishChanges(stop chan struct{}) {
+	for {
+		select {
+		case <-service.changed:
+		case <-stop:
+			return
+		}
+		service.mux.Lock()
+		if service.list != nil {
+			nodes := service.members(service.list.Members())
+			if !reflect.DeepEqual(nodes, service.nodes) {
+				service.nodes = nodes
+				for ch := range service.ListUpdatedChans {
+					memberList := make([]taskhandler.ServingService, len(nodes))
+					copy(memberList, nodes)
+					service.ListUpdatedChans[ch] <- memberList
+				}
+			}
+		}
+		service.mux.Unlock()
+	}
+}
+
+// members returns the nodes of the given memberlist members, sorted by their address
+func (service *GossipDiscoveryService) members(members []*memberlist.Node) []taskhandler.ServingService {
+	nodes := make([]taskhandler.ServingService, 0, len(members))
+	for _, member := range members {
+		node, err := parseMember(member)
+		if err != nil {
+			log.WithError(err).Errorf("Invalid metadata of gossip member %s", member.Name)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].String() < nodes[j].String()
+	})
+	return nodes
+}
+
+// parseMember returns the node of a member. The metadata of a member is the
+// ServingService of the node, while its host is the address of the member.
+func parseMember(member *memberlist.Node) (taskhandler.ServingService, error) {
+	var node taskhandler.ServingService
+	if err := json.Unmarshal(member.Meta, &node); err != nil {
+		return node, err
+	}
+	if node.RestPort == 0 || node.GrpcPort == 0 {
+		return node, fmt.Errorf("Missing ports in metadata: %s", string(member.Meta))
+	}
+	node.Host = member.Addr.String()
+	if member.Addr.To4() == nil {
+		// IPv6 addresses are bracketed, such that they can be joined with a port
+		node.Host = "[" + node.Host + "]"
+	}
+	return node, nil
+}
+
+// delegate publishes the metadata of this node
+type delegate struct {
+	service *GossipDiscoveryService
+}
+
+func (d *delegate) NodeMeta(limit int) []byte {
+	meta, err := json.Marshal(d.service.local)
+	if err != nil {
+		log.WithError(err).Error("Could not encode gossip metadata")
+		return nil
+	}
+	if len(meta) > limit {
+		log.Errorf("Gossip metadata exceeds %d bytes: %s", limit, string(meta))
+		return nil
+	}
+	return meta
+}
+
+func (d *delegate) NotifyMsg([]byte)                           {}
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *delegate) LocalState(join bool) []byte                { return nil }
+func (d *delegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// eventDelegate is notified by memberlist when the members change
+type eventDelegate struct {
+	service *GossipDiscoveryService
+}
+
+func (d *eventDelegate) NotifyJoin(node *memberlist.Node) {
+	log.Infof("Gossip member joined: %s (%s)", node.Name, node.Address())
+	d.service.notifyChanged()
+}
+
+func (d *eventDelegate) NotifyLeave(node *memberlist.Node) {
+	log.Infof("Gossip member left: %s (%s)", node.Name, node.Address())
+	d.service.notifyChanged()
+}
+
+func (d *eventDelegate) NotifyUpdate(node *memberlist.Node) {
+	d.service.notifyChanged()
+}
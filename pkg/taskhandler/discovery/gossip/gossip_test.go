@@ -0,0 +1,86 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+)
+
+func startTestNode(t *testing.T, id int, seeds []string) (*GossipDiscoveryService, chan []taskhandler.ServingService) {
+	config := memberlist.DefaultLocalConfig()
+	config.Name = fmt.Sprintf("node_%d", id)
+	config.BindAddr = "127.0.0.1"
+	config.BindPort = 0
+	SetFailureTimeout(config, time.Second)
+	local := taskhandler.ServingService{RestPort: 8000 + id, GrpcPort: 9000 + id, CacheCapacity: int64(1000 * (id + 1))}
+	service := newDiscoveryService(config, seeds, local)
+	service.RejoinInterval = 100 * time.Millisecond
+
+	ch := make(chan []taskhandler.ServingService, 100)
+	service.AddNodeListUpdated("test", ch)
+	if err := service.RegisterService(); err != nil {
+		t.Fatalf("Error starting gossip: %v", err)
+	}
+	return service, ch
+}
+
+// waitForNodes waits until the node list has the given number of nodes and returns it
+func waitForNodes(t *testing.T, ch chan []taskhandler.ServingService, numNodes int) []taskhandler.ServingService {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if len(nodes) == numNodes {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for %d nodes", numNodes)
+		}
+	}
+}
+
+func TestGossipMembershipAndFailureDetection(t *testing.T) {
+	seed, seedCh := startTestNode(t, 0, nil)
+	defer seed.UnregisterService()
+	seeds := []string{seed.Address()}
+	second, secondCh := startTestNode(t, 1, seeds)
+	defer second.UnregisterService()
+	third, _ := startTestNode(t, 2, seeds)
+
+	nodes := waitForNodes(t, seedCh, 3)
+	for i, node := range nodes {
+		if node.Host != "127.0.0.1" || node.RestPort != 8000+i || node.GrpcPort != 9000+i {
+			t.Errorf("Unexpected node %d: %v", i, node)
+		}
+		if node.CacheCapacity != int64(1000*(i+1)) {
+			t.Errorf("Expected metadata of node %d to be gossiped, but got %v", i, node)
+		}
+	}
+	waitForNodes(t, secondCh, 3)
+
+	// Stop the third node without leaving the cluster, such that it must be detected as failed
+	third.mux.Lock()
+	list := third.list
+	third.list = nil
+	close(third.stop)
+	third.mux.Unlock()
+	start := time.Now()
+	list.Shutdown()
+
+	nodes = waitForNodes(t, seedCh, 2)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected failure to be detected within 5 seconds, but took %v", elapsed)
+	}
+	for _, node := range nodes {
+		if node.RestPort == 8002 {
+			t.Errorf("Expected failed node to be removed, but got %v", nodes)
+		}
+	}
+
+	// A node that leaves is removed immediately
+	second.UnregisterService()
+	waitForNodes(t, seedCh, 1)
+}
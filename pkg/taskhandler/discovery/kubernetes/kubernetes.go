@@ -2,20 +2,30 @@ package kubernetes
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	v1 "k8s.io/api/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	k8sWatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
 type K8sPodInfo struct {
@@ -23,19 +33,32 @@ type K8sPodInfo struct {
 	ReplicaSetName string
 }
 
+// K8sDiscoveryService discovers the nodes from the EndpointSlices of the
+// TFServingCache service, using an informer that watches the slices, and
+// reads the metadata of the nodes from the annotations of their pods
 type K8sDiscoveryService struct {
+	mux              sync.Mutex
 	ListUpdatedChans map[string]chan []taskhandler.ServingService
 	Namespace        string
 	PodInfo          K8sPodInfo
-	// Selector that defines the k8s service
-	FieldSelector string
-	K8sClient     *kubernetes.Clientset
+	// Selector for the labels of the EndpointSlices of the service
+	LabelSelector string
+	K8sClient     kubernetes.Interface
+	// ResyncInterval is the interval at which the informer lists all slices again
+	ResyncInterval time.Duration
 	// Name of gRPC cache port in k8s service
 	grpcCachePortName string
 	// Name of REST cache port in k8s service
 	httpCachePortName string
+	// Lister of the pods in the namespace, of which only the metadata annotations are stored
+	podLister corelisters.PodLister
+	nodes     []taskhandler.ServingService
+	stop      chan struct{}
 }
 
+// annotationPrefix is the prefix of the pod annotations that contain the metadata of a node
+const annotationPrefix = "tfservingcache/"
+
 func NewDiscoveryService() (*K8sDiscoveryService, error) {
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
@@ -60,107 +83,302 @@ func NewDiscoveryService() (*K8sDiscoveryService, error) {
 		return nil, err
 	}
 
-	fieldSelector := viper.GetStringMapString("serviceDiscovery.k8s.fieldSelector")
-	fieldSelectorString := labels.SelectorFromSet(fieldSelector).String()
+	selector, err := endpointSliceSelector()
+	if err != nil {
+		return nil, err
+	}
 
-	service := &K8sDiscoveryService{
+	service := newDiscoveryService(clientset, namespace, *podInfo, selector)
+	service.ResyncInterval = viper.GetDuration("serviceDiscovery.k8s.resyncInterval") * time.Second
+	service.grpcCachePortName = viperTryGetString("serviceDiscovery.k8s.portNames.grpcCache", "grpccache")
+	service.httpCachePortName = viperTryGetString("serviceDiscovery.k8s.portNames.httpCache", "httpcache")
+	return service, nil
+}
+
+func newDiscoveryService(client kubernetes.Interface, namespace string, podInfo K8sPodInfo, labelSelector string) *K8sDiscoveryService {
+	return &K8sDiscoveryService{
 		ListUpdatedChans:  make(map[string]chan []taskhandler.ServingService, 0),
-		K8sClient:         clientset,
+		K8sClient:         client,
 		Namespace:         namespace,
-		PodInfo:           *podInfo,
-		FieldSelector:     fieldSelectorString,
-		grpcCachePortName: viperTryGetString("serviceDiscovery.k8s.portNames.grpcCache", "grpccache"),
-		httpCachePortName: viperTryGetString("serviceDiscovery.k8s.portNames.httpCache", "httpcache"),
+		PodInfo:           podInfo,
+		LabelSelector:     labelSelector,
+		ResyncInterval:    30 * time.Second,
+		grpcCachePortName: "grpccache",
+		httpCachePortName: "httpcache",
 	}
+}
 
-	return service, nil
+// endpointSliceSelector returns the label selector of the EndpointSlices of the
+// service from serviceDiscovery.k8s.serviceName and labelSelector. The deprecated
+// fieldSelector on metadata.name of the Endpoints is used as service name.
+func endpointSliceSelector() (string, error) {
+	selector := viper.GetStringMapString("serviceDiscovery.k8s.labelSelector")
+	serviceName := viper.GetString("serviceDiscovery.k8s.serviceName")
+	if serviceName == "" {
+		if name, ok := viper.GetStringMapString("serviceDiscovery.k8s.fieldSelector")["metadata.name"]; ok {
+			log.Warn("serviceDiscovery.k8s.fieldSelector is deprecated. Use serviceDiscovery.k8s.serviceName")
+			serviceName = name
+		}
+	}
+	if serviceName != "" {
+		selector[discoveryv1.LabelServiceName] = serviceName
+	}
+	if len(selector) == 0 {
+		return "", fmt.Errorf("serviceDiscovery.k8s.serviceName or labelSelector must be set")
+	}
+	return labels.SelectorFromSet(selector).String(), nil
 }
 
 func (service *K8sDiscoveryService) RegisterService() error {
-	updaterFunc := func() error {
-		for {
-			// k8s will unregister after some time, so keep the watch in a loop
-			watch, err := service.K8sClient.CoreV1().Endpoints(service.Namespace).Watch(context.TODO(), metav1.ListOptions{
-				FieldSelector: service.FieldSelector,
-			})
-			if err != nil {
-				log.WithError(err).Error("Error subscribing to k8s")
-				return err
+	err := service.publishMetadata()
+	if err != nil {
+		log.WithError(err).Warn("Could not publish node metadata as pod annotations")
+	}
+	selector, err := labels.Parse(service.LabelSelector)
+	if err != nil {
+		return err
+	}
+
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.stop != nil {
+		return nil
+	}
+	service.stop = make(chan struct{})
+
+	factory := informers.NewSharedInformerFactoryWithOptions(service.K8sClient, service.ResyncInterval,
+		informers.WithNamespace(service.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = service.LabelSelector
+		}))
+	sliceInformer := factory.Discovery().V1().EndpointSlices()
+	lister := sliceInformer.Lister()
+	update := func() { service.update(lister, selector) }
+
+	// The pods do not have the labels of the slices, so they are watched by a separate factory
+	podFactory := informers.NewSharedInformerFactoryWithOptions(service.K8sClient, service.ResyncInterval,
+		informers.WithNamespace(service.Namespace))
+	podInformer := podFactory.Core().V1().Pods()
+	err = podInformer.Informer().SetTransform(stripPod)
+	if err != nil {
+		return err
+	}
+	service.podLister = podInformer.Lister()
+
+	_, err = sliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { update() },
+		UpdateFunc: func(oldObj, newObj interface{}) { update() },
+		DeleteFunc: func(obj interface{}) { update() },
+	})
+	if err != nil {
+		return err
+	}
+	// Pods only change the nodes when they publish their metadata. Deleted
+	// pods are removed from the slices, and thus from the nodes, by k8s.
+	_, err = podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { update() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, oldOk := oldObj.(*corev1.Pod)
+			newPod, newOk := newObj.(*corev1.Pod)
+			if !oldOk || !newOk || !reflect.DeepEqual(oldPod.Annotations, newPod.Annotations) {
+				update()
 			}
-			nodeMap := make(map[string]taskhandler.ServingService, 0)
-			for {
-				updates := <-watch.ResultChan()
-				endpoints, ok := updates.Object.(*v1.Endpoints)
-
-				isUpdated := false
-				if !ok {
-					log.Debug("Error reading object from K8S")
-					watch.Stop()
-					// Force a re-registering
-					break
-				} else {
-					if updates.Type == k8sWatch.Added || updates.Type == k8sWatch.Modified {
-						for _, sub := range endpoints.Subsets {
-							// Entire list of nodes is sent every time - so keep track of delta
-							nodeMap = make(map[string]taskhandler.ServingService, 0)
-							for _, addr := range sub.Addresses {
-								grpcCachePort := 0
-								httpCachePort := 0
-								for _, port := range sub.Ports {
-									if port.Name == service.grpcCachePortName {
-										grpcCachePort = int(port.Port)
-									} else if port.Name == service.httpCachePortName {
-										httpCachePort = int(port.Port)
-									}
-								}
-
-								nodeMap[addr.IP] = taskhandler.ServingService{
-									Host:     addr.IP,
-									GrpcPort: grpcCachePort,
-									RestPort: httpCachePort,
-								}
-								isUpdated = true
-							}
-						}
-					} else if updates.Type == k8sWatch.Deleted {
-						// Endpoint deleted - no nodes available
-						nodeMap = make(map[string]taskhandler.ServingService, 0)
-						isUpdated = true
-					}
-					if isUpdated {
-						memberList := make([]taskhandler.ServingService, 0, len(nodeMap))
-						for k := range nodeMap {
-							memberList = append(memberList, nodeMap[k])
-							log.WithFields(log.Fields{
-								"host":     k,
-								"grpcPort": nodeMap[k].GrpcPort,
-								"httpPort": nodeMap[k].RestPort,
-							}).Debug("Found node")
-						}
-						for ch := range service.ListUpdatedChans {
-							service.ListUpdatedChans[ch] <- memberList
-						}
-
-					}
-				}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(service.stop)
+	podFactory.Start(service.stop)
+	return nil
+}
+
+// stripPod removes everything but the name and the metadata annotations from the
+// pods stored by the pod informer, since only the annotations are used
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+	annotations := map[string]string{}
+	for key, value := range pod.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			annotations[key] = value
+		}
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			Annotations:     annotations,
+		},
+	}, nil
+}
+
+// update publishes the nodes of all EndpointSlices of the service if they changed
+func (service *K8sDiscoveryService) update(lister discoverylisters.EndpointSliceLister, selector labels.Selector) {
+	slices, err := lister.EndpointSlices(service.Namespace).List(selector)
+	if err != nil {
+		log.WithError(err).Error("Could not list EndpointSlices")
+		return
+	}
+	nodes := service.nodesFromSlices(slices)
+
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if reflect.DeepEqual(nodes, service.nodes) {
+		return
+	}
+	service.nodes = nodes
+	for _, node := range nodes {
+		log.WithFields(log.Fields{
+			"host":     node.Host,
+			"grpcPort": node.GrpcPort,
+			"httpPort": node.RestPort,
+		}).Debug("Found node")
+	}
+	for ch := range service.ListUpdatedChans {
+		memberList := make([]taskhandler.ServingService, len(nodes))
+		copy(memberList, nodes)
+		service.ListUpdatedChans[ch] <- memberList
+	}
+}
+
+// nodesFromSlices returns the nodes of the endpoints in all the given slices, sorted
+// by their address. Endpoints that are ready are used, and endpoints that are not
+// ready are ignored. If no endpoints are ready, e.g. while all pods are replaced,
+// endpoints that are serving but terminating are used instead.
+func (service *K8sDiscoveryService) nodesFromSlices(slices []*discoveryv1.EndpointSlice) []taskhandler.ServingService {
+	ready := map[string]taskhandler.ServingService{}
+	serving := map[string]taskhandler.ServingService{}
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		grpcCachePort := 0
+		httpCachePort := 0
+		for _, port := range slice.Ports {
+			if port.Name == nil || port.Port == nil {
+				continue
+			}
+			if *port.Name == service.grpcCachePortName {
+				grpcCachePort = int(*port.Port)
+			} else if *port.Name == service.httpCachePortName {
+				httpCachePort = int(*port.Port)
 			}
 		}
+		if grpcCachePort == 0 || httpCachePort == 0 {
+			log.Warnf("EndpointSlice %s has no %s and %s ports. Skipping", slice.Name, service.grpcCachePortName, service.httpCachePortName)
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			host := endpoint.Addresses[0]
+			if slice.AddressType == discoveryv1.AddressTypeIPv6 {
+				// IPv6 addresses are bracketed, such that they can be joined with a port
+				host = "[" + host + "]"
+			}
+			node := taskhandler.ServingService{
+				Host:     host,
+				GrpcPort: grpcCachePort,
+				RestPort: httpCachePort,
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				node.SetMetadata(service.metadataForPod(endpoint.TargetRef.Name))
+			}
+			if node.Zone == "" && endpoint.Zone != nil {
+				node.Zone = *endpoint.Zone
+			}
+
+			conditions := endpoint.Conditions
+			// A nil ready condition means ready, while nil serving and terminating conditions mean false
+			isReady := conditions.Ready == nil || *conditions.Ready
+			isTerminating := conditions.Terminating != nil && *conditions.Terminating
+			isServing := conditions.Serving != nil && *conditions.Serving
+			if isReady && !isTerminating {
+				ready[node.String()] = node
+			} else if isServing {
+				serving[node.String()] = node
+			}
+		}
+	}
+	nodeMap := ready
+	if len(ready) == 0 {
+		nodeMap = serving
 	}
-	go updaterFunc()
+	nodes := make([]taskhandler.ServingService, 0, len(nodeMap))
+	for _, node := range nodeMap {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].String() < nodes[j].String()
+	})
+	return nodes
+}
 
-	return nil
+// publishMetadata publishes the metadata of this node as annotations on its pod
+func (service *K8sDiscoveryService) publishMetadata() error {
+	local := taskhandler.LocalServingService("")
+	annotations := map[string]string{}
+	for key, value := range local.Metadata() {
+		annotations[annotationPrefix+key] = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = service.K8sClient.CoreV1().Pods(service.Namespace).Patch(context.TODO(), service.PodInfo.PodName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
+// metadataForPod returns the metadata published in the annotations of a pod
+func (service *K8sDiscoveryService) metadataForPod(podName string) map[string]string {
+	if service.podLister == nil {
+		return nil
+	}
+	pod, err := service.podLister.Pods(service.Namespace).Get(podName)
+	if err != nil {
+		// The pod may not have been received by the informer yet. The nodes
+		// are updated once it is received.
+		log.WithError(err).Debugf("Could not get metadata of pod: %s", podName)
+		return nil
+	}
+	meta := map[string]string{}
+	for key, value := range pod.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			meta[strings.TrimPrefix(key, annotationPrefix)] = value
+		}
+	}
+	return meta
+}
+
+// UnregisterService stops watching the EndpointSlices. The node itself
+// is removed from the service by k8s.
 func (service *K8sDiscoveryService) UnregisterService() error {
-	// Let k8s handle this by itself
+	service.mux.Lock()
+	defer service.mux.Unlock()
+	if service.stop != nil {
+		close(service.stop)
+		service.stop = nil
+	}
 	return nil
 }
 
 func (service *K8sDiscoveryService) AddNodeListUpdated(key string, sub chan []taskhandler.ServingService) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
 	service.ListUpdatedChans[key] = sub
 }
 
 func (service *K8sDiscoveryService) RemoveNodeListUpdated(key string) {
+	service.mux.Lock()
+	defer service.mux.Unlock()
 	delete(service.ListUpdatedChans, key)
 }
 
@@ -180,7 +398,7 @@ func k8sNamespace() (string, error) {
 }
 
 // Finds the name of the ReplicaSet for the given pod
-func k8sFindPodInfo(k8sClient *kubernetes.Clientset, namespace string, podName string) (*K8sPodInfo, error) {
+func k8sFindPodInfo(k8sClient kubernetes.Interface, namespace string, podName string) (*K8sPodInfo, error) {
 	// Find current service
 	pod, err := k8sClient.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
 	if err != nil {
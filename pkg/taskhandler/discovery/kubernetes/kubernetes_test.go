@@ -0,0 +1,212 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testNamespace = "default"
+
+func boolPtr(b bool) *bool { return &b }
+
+func endpointSlice(name string, serviceName string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	grpcName, httpName := "grpccache", "httpcache"
+	grpcPort, httpPort := int32(8095), int32(8094)
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: serviceName},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &grpcName, Port: &grpcPort},
+			{Name: &httpName, Port: &httpPort},
+		},
+		Endpoints: endpoints,
+	}
+}
+
+func endpoint(ip string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       boolPtr(ready),
+			Serving:     boolPtr(serving),
+			Terminating: boolPtr(terminating),
+		},
+	}
+}
+
+func hosts(nodes []taskhandler.ServingService) []string {
+	res := make([]string, len(nodes))
+	for i := range nodes {
+		res[i] = nodes[i].Host
+	}
+	return res
+}
+
+func TestNodesFromSlicesMergesSlicesAndHonorsConditions(t *testing.T) {
+	service := newDiscoveryService(fake.NewClientset(), testNamespace, K8sPodInfo{}, "")
+	slices := []*discoveryv1.EndpointSlice{
+		endpointSlice("cache-a", "cache",
+			endpoint("10.0.0.1", true, true, false),
+			endpoint("10.0.0.2", false, true, true),
+			endpoint("10.0.0.3", false, false, false)),
+		endpointSlice("cache-b", "cache",
+			endpoint("10.0.0.4", true, true, false),
+			// The same endpoint may be in two slices while it moves between slices
+			endpoint("10.0.0.1", true, true, false)),
+	}
+	nodes := service.nodesFromSlices(slices)
+	if got := hosts(nodes); len(got) != 2 || got[0] != "10.0.0.1" || got[1] != "10.0.0.4" {
+		t.Errorf("Expected the ready endpoints of both slices, but got %v", got)
+	}
+	if nodes[0].RestPort != 8094 || nodes[0].GrpcPort != 8095 {
+		t.Errorf("Expected ports from the slice, but got %v", nodes[0])
+	}
+
+	// Terminating endpoints that are still serving are used when no endpoints are ready
+	slices = []*discoveryv1.EndpointSlice{
+		endpointSlice("cache-a", "cache",
+			endpoint("10.0.0.2", false, true, true),
+			endpoint("10.0.0.3", false, false, false)),
+	}
+	if got := hosts(service.nodesFromSlices(slices)); len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Errorf("Expected the serving endpoint, but got %v", got)
+	}
+}
+
+func annotatedPod(name string, cacheCapacity string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Annotations: map[string]string{
+				annotationPrefix + taskhandler.MetaCacheCapacity: cacheCapacity,
+				annotationPrefix + taskhandler.MetaVersion:       "1.0",
+				"other": "annotation",
+			},
+		},
+		Spec: v1.PodSpec{NodeName: "node-1"},
+	}
+}
+
+func TestNodesFromSlicesUsesZoneAndPodMetadata(t *testing.T) {
+	service := newDiscoveryService(fake.NewClientset(), testNamespace, K8sPodInfo{}, "")
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	pod, _ := stripPod(annotatedPod("cache-0", "1000"))
+	indexer.Add(pod)
+	service.podLister = corelisters.NewPodLister(indexer)
+	zone := "eu-west-1a"
+	ep := endpoint("10.0.0.1", true, true, false)
+	ep.Zone = &zone
+	ep.TargetRef = &v1.ObjectReference{Kind: "Pod", Name: "cache-0"}
+
+	nodes := service.nodesFromSlices([]*discoveryv1.EndpointSlice{endpointSlice("cache-a", "cache", ep)})
+	if len(nodes) != 1 || nodes[0].Zone != zone || nodes[0].CacheCapacity != 1000 {
+		t.Errorf("Expected node with zone and pod metadata, but got %v", nodes)
+	}
+	if stripped := pod.(*v1.Pod); len(stripped.Annotations) != 2 || stripped.Spec.NodeName != "" {
+		t.Errorf("Expected pod to be stripped to its metadata annotations, but got %v", stripped)
+	}
+
+	// Pods that are not known yet have no metadata
+	ep.TargetRef.Name = "cache-1"
+	nodes = service.nodesFromSlices([]*discoveryv1.EndpointSlice{endpointSlice("cache-a", "cache", ep)})
+	if len(nodes) != 1 || nodes[0].CacheCapacity != 0 {
+		t.Errorf("Expected node without metadata, but got %v", nodes)
+	}
+}
+
+func TestInformerPublishesPodMetadataChanges(t *testing.T) {
+	ep := endpoint("10.0.0.1", true, true, false)
+	ep.TargetRef = &v1.ObjectReference{Kind: "Pod", Name: "cache-0"}
+	client := fake.NewClientset(endpointSlice("cache-a", "cache", ep), annotatedPod("cache-0", "1000"))
+	service := newDiscoveryService(client, testNamespace, K8sPodInfo{PodName: "cache-0"}, discoveryv1.LabelServiceName+"=cache")
+	ch := make(chan []taskhandler.ServingService, 10)
+	service.AddNodeListUpdated("test", ch)
+	if err := service.RegisterService(); err != nil {
+		t.Fatalf("Error registering service: %v", err)
+	}
+	defer service.UnregisterService()
+
+	waitForCapacity := func(expected int64) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case nodes := <-ch:
+				if len(nodes) == 1 && nodes[0].CacheCapacity == expected {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timeout waiting for node with cache capacity %d", expected)
+			}
+		}
+	}
+	waitForCapacity(1000)
+
+	_, err := client.CoreV1().Pods(testNamespace).Update(context.TODO(), annotatedPod("cache-0", "2000"), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCapacity(2000)
+}
+
+func TestInformerPublishesChanges(t *testing.T) {
+	client := fake.NewClientset(
+		endpointSlice("cache-a", "cache", endpoint("10.0.0.1", true, true, false)),
+		endpointSlice("other-a", "other", endpoint("10.0.1.1", true, true, false)),
+	)
+	service := newDiscoveryService(client, testNamespace, K8sPodInfo{PodName: "cache-0"}, discoveryv1.LabelServiceName+"=cache")
+	ch := make(chan []taskhandler.ServingService, 10)
+	service.AddNodeListUpdated("test", ch)
+	if err := service.RegisterService(); err != nil {
+		t.Fatalf("Error registering service: %v", err)
+	}
+	defer service.UnregisterService()
+
+	waitForHosts := func(expected ...string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case nodes := <-ch:
+				got := hosts(nodes)
+				if len(got) == len(expected) {
+					match := true
+					for i := range got {
+						match = match && got[i] == expected[i]
+					}
+					if match {
+						return
+					}
+				}
+			case <-timeout:
+				t.Fatalf("Timeout waiting for nodes %v", expected)
+			}
+		}
+	}
+	waitForHosts("10.0.0.1")
+
+	_, err := client.DiscoveryV1().EndpointSlices(testNamespace).Create(context.TODO(),
+		endpointSlice("cache-b", "cache", endpoint("10.0.0.2", true, true, false)), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHosts("10.0.0.1", "10.0.0.2")
+
+	err = client.DiscoveryV1().EndpointSlices(testNamespace).Delete(context.TODO(), "cache-a", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHosts("10.0.0.2")
+}
@@ -0,0 +1,199 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// nodeList holds the current nodes of a discovery service and the
+// subscribers that are notified when the nodes change
+type nodeList struct {
+	mux              sync.Mutex
+	ListUpdatedChans map[string]chan []taskhandler.ServingService
+	nodes            []taskhandler.ServingService
+}
+
+func (list *nodeList) AddNodeListUpdated(key string, sub chan []taskhandler.ServingService) {
+	list.mux.Lock()
+	defer list.mux.Unlock()
+	list.ListUpdatedChans[key] = sub
+}
+
+func (list *nodeList) RemoveNodeListUpdated(key string) {
+	list.mux.Lock()
+	defer list.mux.Unlock()
+	delete(list.ListUpdatedChans, key)
+}
+
+// setNodes replaces the nodes and notifies the subscribers if the nodes changed
+func (list *nodeList) setNodes(nodes []taskhandler.ServingService) {
+	list.mux.Lock()
+	defer list.mux.Unlock()
+	if reflect.DeepEqual(nodes, list.nodes) {
+		return
+	}
+	list.nodes = nodes
+	list.publish()
+}
+
+// publish sends the nodes to the subscribers. It must be called with list.mux held.
+func (list *nodeList) publish() {
+	for ch := range list.ListUpdatedChans {
+		memberList := make([]taskhandler.ServingService, len(list.nodes))
+		copy(memberList, list.nodes)
+		list.ListUpdatedChans[ch] <- memberList
+	}
+}
+
+// StaticDiscoveryService is a discovery service with a fixed list of
+// nodes, configured in serviceDiscovery.static.nodes
+type StaticDiscoveryService struct {
+	nodeList
+}
+
+func NewDiscoveryService() (*StaticDiscoveryService, error) {
+	nodes, err := parseNodes(viper.Get("serviceDiscovery.static.nodes"))
+	if err != nil {
+		return nil, err
+	}
+	service := &StaticDiscoveryService{
+		nodeList: nodeList{
+			ListUpdatedChans: make(map[string]chan []taskhandler.ServingService, 0),
+			nodes:            nodes,
+		},
+	}
+	return service, nil
+}
+
+func (service *StaticDiscoveryService) RegisterService() error {
+	go func() {
+		service.mux.Lock()
+		defer service.mux.Unlock()
+		service.publish()
+	}()
+	return nil
+}
+
+func (service *StaticDiscoveryService) UnregisterService() error {
+	return nil
+}
+
+// FileDiscoveryService is a discovery service that reads the nodes from the
+// "nodes" list of a JSON or YAML file, and updates the nodes when the file changes
+type FileDiscoveryService struct {
+	nodeList
+	Path   string
+	config *viper.Viper
+}
+
+func NewFileDiscoveryService(path string) (*FileDiscoveryService, error) {
+	config := viper.New()
+	config.SetConfigFile(path)
+	if err := config.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	nodes, err := parseNodes(config.Get("nodes"))
+	if err != nil {
+		return nil, err
+	}
+	service := &FileDiscoveryService{
+		nodeList: nodeList{
+			ListUpdatedChans: make(map[string]chan []taskhandler.ServingService, 0),
+			nodes:            nodes,
+		},
+		Path:   path,
+		config: config,
+	}
+	return service, nil
+}
+
+func (service *FileDiscoveryService) RegisterService() error {
+	service.config.OnConfigChange(func(e fsnotify.Event) {
+		nodes, err := parseNodes(service.config.Get("nodes"))
+		if err != nil {
+			log.WithError(err).Errorf("Invalid nodes in %s. Keeping the current nodes", service.Path)
+			return
+		}
+		log.Debugf("Nodes in %s changed: %v", service.Path, nodes)
+		service.setNodes(nodes)
+	})
+	service.config.WatchConfig()
+	go func() {
+		service.mux.Lock()
+		defer service.mux.Unlock()
+		service.publish()
+	}()
+	return nil
+}
+
+func (service *FileDiscoveryService) UnregisterService() error {
+	return nil
+}
+
+// parseNodes parses a list of nodes, where each node is either a string
+// "<host>:<rest port>:<grpc port>" or a map with the fields of a ServingService,
+// e.g. host, restPort, grpcPort and zone
+func parseNodes(value interface{}) ([]taskhandler.ServingService, error) {
+	if value == nil {
+		return nil, fmt.Errorf("No nodes configured")
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Nodes must be a list, but was: %v", value)
+	}
+	nodes := make([]taskhandler.ServingService, 0, len(list))
+	for _, item := range list {
+		var node taskhandler.ServingService
+		if str, ok := item.(string); ok {
+			parsed, err := parseAddress(str)
+			if err != nil {
+				return nil, err
+			}
+			node = parsed
+		} else {
+			// Go through JSON to match the fields case-insensitively
+			encoded, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(encoded, &node); err != nil {
+				return nil, fmt.Errorf("Invalid node %v: %w", item, err)
+			}
+		}
+		if node.Host == "" || node.RestPort == 0 || node.GrpcPort == 0 {
+			return nil, fmt.Errorf("Node must have a host, rest port and grpc port: %v", item)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// parseAddress parses a node given as "<host>:<rest port>:<grpc port>"
+func parseAddress(address string) (taskhandler.ServingService, error) {
+	var node taskhandler.ServingService
+	parts := strings.Split(address, ":")
+	if len(parts) != 3 {
+		return node, fmt.Errorf("Invalid node address: %s", address)
+	}
+	restPort, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return node, fmt.Errorf("Invalid rest port: %s", parts[1])
+	}
+	grpcPort, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return node, fmt.Errorf("Invalid grpc port: %s", parts[2])
+	}
+	node.Host = parts[0]
+	node.RestPort = restPort
+	node.GrpcPort = grpcPort
+	return node, nil
+}
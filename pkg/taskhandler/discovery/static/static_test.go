@@ -0,0 +1,71 @@
+package static
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/taskhandler"
+)
+
+func receiveNodes(t *testing.T, ch chan []taskhandler.ServingService) []taskhandler.ServingService {
+	select {
+	case nodes := <-ch:
+		return nodes
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for node list")
+		return nil
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := parseNodes([]interface{}{
+		"host1:8094:8095",
+		map[string]interface{}{"host": "host2", "restPort": 8094, "grpcPort": 8095, "zone": "b"},
+	})
+	if err != nil {
+		t.Fatalf("Error parsing nodes: %v", err)
+	}
+	expected := []taskhandler.ServingService{
+		{Host: "host1", RestPort: 8094, GrpcPort: 8095},
+		{Host: "host2", RestPort: 8094, GrpcPort: 8095, Zone: "b"},
+	}
+	if len(nodes) != 2 || nodes[0] != expected[0] || nodes[1] != expected[1] {
+		t.Errorf("Expected %v, but got %v", expected, nodes)
+	}
+
+	for _, invalid := range []interface{}{"host1:8094", map[string]interface{}{"host": "host1"}, "nodes"} {
+		if _, err := parseNodes([]interface{}{invalid}); err == nil {
+			t.Errorf("Expected error for invalid node %v", invalid)
+		}
+	}
+}
+
+func TestFileDiscoveryWatchesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.yaml")
+	if err := os.WriteFile(path, []byte("nodes:\n  - host1:8094:8095\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewFileDiscoveryService(path)
+	if err != nil {
+		t.Fatalf("Error creating discovery service: %v", err)
+	}
+	ch := make(chan []taskhandler.ServingService)
+	service.AddNodeListUpdated("test", ch)
+	if err := service.RegisterService(); err != nil {
+		t.Fatalf("Error registering service: %v", err)
+	}
+	if nodes := receiveNodes(t, ch); len(nodes) != 1 || nodes[0].Host != "host1" {
+		t.Errorf("Expected host1, but got %v", nodes)
+	}
+
+	err = os.WriteFile(path, []byte("nodes:\n  - host1:8094:8095\n  - host: host2\n    restPort: 8094\n    grpcPort: 8095\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := receiveNodes(t, ch); len(nodes) != 2 || nodes[1].Host != "host2" {
+		t.Errorf("Expected host1 and host2, but got %v", nodes)
+	}
+	service.RemoveNodeListUpdated("test")
+}
@@ -0,0 +1,302 @@
+package taskhandler
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"stathat.com/c/consistent"
+)
+
+// errEmptyRing is returned when looking up a key in a ring without members
+var errEmptyRing = errors.New("Empty hash ring")
+
+// hashRing maps model keys to the nodes that serve them
+type hashRing interface {
+	// set replaces the members of the ring
+	set(members []ServingService)
+	// getN returns the names of the n nodes that serve the given key
+	getN(key string, n int) ([]string, error)
+}
+
+// newHashRing creates the hash ring configured in proxy.hashRing. The bounded
+// ring uses load to bound the number of in-flight requests of each node.
+func newHashRing(load *nodeLoad) hashRing {
+	var configuredWeights []struct {
+		Host   string
+		Weight float64
+	}
+	err := viper.UnmarshalKey("proxy.hashRing.weights", &configuredWeights)
+	if err != nil {
+		log.WithError(err).Error("Could not read hash ring weights. Using equal weights")
+	}
+	weights := map[string]float64{}
+	for _, nodeWeight := range configuredWeights {
+		weights[nodeWeight.Host] = nodeWeight.Weight
+	}
+	weightByCapacity := viper.GetBool("proxy.hashRing.weightByCapacity")
+	weightsFun := func(members []ServingService) map[string]float64 {
+		return nodeWeights(members, weights, weightByCapacity)
+	}
+
+	switch viper.GetString("proxy.hashRing.type") {
+	case "", "consistent":
+		return newConsistentRing(viper.GetBool("proxy.zones.spreadReplicas"), weightsFun)
+	case "bounded":
+		loadFactor := viper.GetFloat64("proxy.hashRing.loadFactor")
+		if loadFactor < 1 {
+			log.Warnf("Hash ring load factor must be at least 1, but was %f. Using 1.25", loadFactor)
+			loadFactor = 1.25
+		}
+		virtualNodes := viper.GetInt("proxy.hashRing.virtualNodes")
+		if virtualNodes <= 0 {
+			virtualNodes = 100
+		}
+		ring := newBoundedRing(loadFactor, virtualNodes, weightsFun)
+		ring.load = load
+		ring.spreadZones = viper.GetBool("proxy.zones.spreadReplicas")
+		return ring
+	default:
+		log.Errorf("Unknown hash ring type '%s'. Using consistent hashing", viper.GetString("proxy.hashRing.type"))
+		return newConsistentRing(viper.GetBool("proxy.zones.spreadReplicas"), weightsFun)
+	}
+}
+
+// consistentReplicas is the number of points on the consistent hash ring per node of weight 1
+const consistentReplicas = 20
+
+// consistentRing is a consistent hash ring where the number of points of a node
+// on the ring is proportional to its weight. If spreadZones is set, the replicas
+// of a key are spread across the zones of the nodes.
+type consistentRing struct {
+	consistent  *consistent.Consistent
+	weights     func(members []ServingService) map[string]float64
+	spreadZones bool
+	mux         sync.RWMutex
+	zones       map[string]string
+}
+
+func newConsistentRing(spreadZones bool, weights func(members []ServingService) map[string]float64) *consistentRing {
+	return &consistentRing{
+		consistent:  consistent.New(),
+		weights:     weights,
+		spreadZones: spreadZones,
+		zones:       map[string]string{},
+	}
+}
+
+// set rebuilds the ring. The points of a node only depend on its name and weight,
+// so the other nodes keep their points when a node joins or leaves the ring.
+func (ring *consistentRing) set(members []ServingService) {
+	var weights map[string]float64
+	if ring.weights != nil {
+		weights = ring.weights(members)
+	}
+	circle := consistent.New()
+	zones := make(map[string]string, len(members))
+	for m := range members {
+		name := members[m].String()
+		zones[name] = members[m].Zone
+		circle.NumberOfReplicas = consistentReplicas
+		if weight, ok := weights[name]; ok {
+			circle.NumberOfReplicas = int(math.Max(math.Round(consistentReplicas*weight), 1))
+		}
+		circle.Add(name)
+	}
+	ring.mux.Lock()
+	ring.consistent = circle
+	ring.zones = zones
+	ring.mux.Unlock()
+}
+
+func (ring *consistentRing) getN(key string, n int) ([]string, error) {
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+	if !ring.spreadZones {
+		return ring.consistent.GetN(key, n)
+	}
+	nodes, err := ring.consistent.GetN(key, len(ring.zones))
+	if err != nil {
+		return nil, err
+	}
+	return spreadAcrossZones(nodes, ring.zones, n), nil
+}
+
+// boundedRing is a consistent hash ring with bounded loads, see
+// https://arxiv.org/abs/1608.01350. The load of a node is the number of requests
+// in-flight from this proxy to the node, and is bounded by loadFactor times the
+// average load per unit of weight, where the weight of a node is e.g. its cache
+// capacity. Keys are assigned to the first nodes on the ring that are not
+// overloaded, so a key only moves away from its nodes while they are busy. If
+// spreadZones is set, nodes in zones that do not yet serve the key are preferred.
+type boundedRing struct {
+	mux          sync.RWMutex
+	loadFactor   float64
+	virtualNodes int
+	weights      func(members []ServingService) map[string]float64
+	nodeWeights  map[string]float64
+	spreadZones  bool
+	zones        map[string]string
+	addresses    map[string]string
+	hashes       []uint64
+	circle       map[uint64]string
+	totalWeight  float64
+	// load counts the in-flight requests of each node. If it is nil,
+	// keys are assigned as in a weighted consistent hash ring.
+	load *nodeLoad
+}
+
+func newBoundedRing(loadFactor float64, virtualNodes int, weights func(members []ServingService) map[string]float64) *boundedRing {
+	return &boundedRing{
+		loadFactor:   loadFactor,
+		virtualNodes: virtualNodes,
+		weights:      weights,
+		circle:       map[uint64]string{},
+		nodeWeights:  map[string]float64{},
+		zones:        map[string]string{},
+		addresses:    map[string]string{},
+	}
+}
+
+func (ring *boundedRing) set(members []ServingService) {
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+
+	weights := map[string]float64{}
+	for name, weight := range ring.weights(members) {
+		if weight > 0 {
+			weights[name] = weight
+		}
+	}
+	zones := map[string]string{}
+	addresses := map[string]string{}
+	for _, member := range members {
+		zones[member.String()] = member.Zone
+		addresses[member.String()] = restAddress(member)
+	}
+	if reflect.DeepEqual(weights, ring.nodeWeights) && reflect.DeepEqual(zones, ring.zones) {
+		return
+	}
+	ring.zones = zones
+	ring.addresses = addresses
+
+	ring.hashes = ring.hashes[:0]
+	ring.circle = map[uint64]string{}
+	ring.nodeWeights = weights
+	ring.totalWeight = 0
+	for name, weight := range weights {
+		ring.totalWeight += weight
+		numVirtualNodes := int(math.Max(math.Round(float64(ring.virtualNodes)*weight), 1))
+		for i := 0; i < numVirtualNodes; i++ {
+			hash := hashKey(strconv.Itoa(i) + name)
+			if _, ok := ring.circle[hash]; ok {
+				continue
+			}
+			ring.circle[hash] = name
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+}
+
+// overloaded returns the nodes that cannot take another request without their load
+// exceeding loadFactor times the average load, relative to their weight. The new
+// request is included in the average. It must be called with ring.mux held.
+func (ring *boundedRing) overloaded() map[string]bool {
+	overloaded := map[string]bool{}
+	if ring.load == nil {
+		return overloaded
+	}
+	loads := make(map[string]int, len(ring.nodeWeights))
+	totalLoad := 0
+	for name := range ring.nodeWeights {
+		loads[name] = ring.load.outstanding(ring.addresses[name])
+		totalLoad += loads[name]
+	}
+	for name, weight := range ring.nodeWeights {
+		maxLoad := math.Ceil(ring.loadFactor * float64(totalLoad+1) * weight / ring.totalWeight)
+		if float64(loads[name]+1) > maxLoad {
+			overloaded[name] = true
+		}
+	}
+	return overloaded
+}
+
+func (ring *boundedRing) getN(key string, n int) ([]string, error) {
+	ring.mux.RLock()
+	defer ring.mux.RUnlock()
+
+	if len(ring.hashes) == 0 {
+		return nil, errEmptyRing
+	}
+	if n > len(ring.nodeWeights) {
+		n = len(ring.nodeWeights)
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	overloaded := ring.overloaded()
+
+	nodes := make([]string, 0, n)
+	selected := map[string]bool{}
+	usedZones := map[string]bool{}
+	// Walk the ring clockwise and select the first nodes that are not overloaded,
+	// preferring new zones when spreading across zones. If there are not enough
+	// such nodes, fill up with the first nodes.
+	passes := []struct{ newZone, capacity bool }{{false, true}, {false, false}}
+	if ring.spreadZones {
+		passes = append([]struct{ newZone, capacity bool }{{true, true}}, passes...)
+	}
+	for _, pass := range passes {
+		for i := 0; i < len(ring.hashes) && len(nodes) < n; i++ {
+			name := ring.circle[ring.hashes[(start+i)%len(ring.hashes)]]
+			if selected[name] || (pass.newZone && usedZones[ring.zones[name]]) {
+				continue
+			}
+			if pass.capacity && overloaded[name] {
+				continue
+			}
+			selected[name] = true
+			usedZones[ring.zones[name]] = true
+			nodes = append(nodes, name)
+		}
+	}
+	return nodes, nil
+}
+
+// nodeWeights returns the weight of each node. Nodes whose host is in configured
+// have the configured weight. If weightByCapacity is set, other nodes that advertise their cache
+// capacity are weighted by their capacity relative to the average capacity of these
+// nodes. All other nodes have weight 1.
+func nodeWeights(members []ServingService, configured map[string]float64, weightByCapacity bool) map[string]float64 {
+	totalCapacity := int64(0)
+	numWithCapacity := 0
+	for _, member := range members {
+		if member.CacheCapacity > 0 {
+			totalCapacity += member.CacheCapacity
+			numWithCapacity++
+		}
+	}
+	weights := make(map[string]float64, len(members))
+	for _, member := range members {
+		if weight, ok := configured[member.Host]; ok {
+			weights[member.String()] = weight
+		} else if weightByCapacity && member.CacheCapacity > 0 {
+			weights[member.String()] = float64(member.CacheCapacity) * float64(numWithCapacity) / float64(totalCapacity)
+		} else {
+			weights[member.String()] = 1
+		}
+	}
+	return weights
+}
+
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
@@ -0,0 +1,71 @@
+package taskhandler
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// BuildVersion is the version of TFServingCache. It is set at build time with
+// -ldflags "-X github.com/mKaloer/TFServingCache/pkg/taskhandler.BuildVersion=<version>"
+var BuildVersion = "dev"
+
+// Metadata keys used by the discovery services to publish the metadata of a node
+const (
+	MetaCacheCapacity       = "cacheCapacity"
+	MetaMaxConcurrentModels = "maxConcurrentModels"
+	MetaZone                = "zone"
+	MetaVersion             = "version"
+)
+
+// LocalServingService returns the ServingService of this node with the given host
+func LocalServingService(host string) ServingService {
+	return ServingService{
+		Host:                host,
+		RestPort:            viper.GetInt("cacheRestPort"),
+		GrpcPort:            viper.GetInt("cacheGrpcPort"),
+		CacheCapacity:       viper.GetInt64("modelCache.size"),
+		MaxConcurrentModels: viper.GetInt("serving.maxConcurrentModels"),
+		Zone:                viper.GetString("serviceDiscovery.zone"),
+		Version:             BuildVersion,
+	}
+}
+
+// Metadata returns the metadata of the node, excluding its address, as strings
+func (service *ServingService) Metadata() map[string]string {
+	meta := map[string]string{
+		MetaVersion: service.Version,
+	}
+	if service.CacheCapacity > 0 {
+		meta[MetaCacheCapacity] = strconv.FormatInt(service.CacheCapacity, 10)
+	}
+	if service.MaxConcurrentModels > 0 {
+		meta[MetaMaxConcurrentModels] = strconv.Itoa(service.MaxConcurrentModels)
+	}
+	if service.Zone != "" {
+		meta[MetaZone] = service.Zone
+	}
+	return meta
+}
+
+// SetMetadata sets the metadata of the node from the strings returned by Metadata.
+// Unknown keys are ignored, and invalid values are logged and ignored.
+func (service *ServingService) SetMetadata(meta map[string]string) {
+	if capacity, ok := meta[MetaCacheCapacity]; ok {
+		value, err := strconv.ParseInt(capacity, 10, 64)
+		if err != nil {
+			log.WithError(err).Warnf("Invalid cache capacity of node %s: %s", service.Host, capacity)
+		}
+		service.CacheCapacity = value
+	}
+	if maxModels, ok := meta[MetaMaxConcurrentModels]; ok {
+		value, err := strconv.Atoi(maxModels)
+		if err != nil {
+			log.WithError(err).Warnf("Invalid max concurrent models of node %s: %s", service.Host, maxModels)
+		}
+		service.MaxConcurrentModels = value
+	}
+	service.Zone = meta[MetaZone]
+	service.Version = meta[MetaVersion]
+}
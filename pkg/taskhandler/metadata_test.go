@@ -0,0 +1,52 @@
+package taskhandler
+
+import (
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	node := ServingService{
+		Host:                "testhost",
+		CacheCapacity:       500 * 1024 * 1024 * 1024,
+		MaxConcurrentModels: 8,
+		Zone:                "eu-west-1a",
+		Version:             "1.2.3",
+	}
+	parsed := ServingService{Host: "testhost"}
+	parsed.SetMetadata(node.Metadata())
+	if parsed != node {
+		t.Errorf("Expected metadata to round trip, but got %v", parsed)
+	}
+}
+
+func TestInvalidMetadataIsIgnored(t *testing.T) {
+	node := ServingService{Host: "testhost"}
+	node.SetMetadata(map[string]string{
+		MetaCacheCapacity:       "large",
+		MetaMaxConcurrentModels: "4",
+		"unknown":               "foo",
+	})
+	if node.CacheCapacity != 0 || node.MaxConcurrentModels != 4 {
+		t.Errorf("Unexpected metadata: %v", node)
+	}
+}
+
+func TestClusterReturnsNodeMetadata(t *testing.T) {
+	members := testMembers(3)
+	for i := range members {
+		members[i].Zone = "zone-a"
+		members[i].CacheCapacity = int64(1000 * (i + 1))
+	}
+	handler, disconnect := connectTestCluster(t, members)
+	defer disconnect()
+
+	nodes, err := handler.Cluster.FindNodesForKey("foo##1", 2)
+	if err != nil {
+		t.Fatalf("Error finding nodes: %v", err)
+	}
+	for _, node := range nodes {
+		if node.Zone != "zone-a" || node.CacheCapacity == 0 {
+			t.Errorf("Expected node metadata to be returned, but got %v", node)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package taskhandler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+var promModelReplicas = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_model_replicas",
+	Help: "The number of nodes that serve a model",
+}, []string{"model", "version"})
+
+const (
+	// rateSmoothing is the weight of the latest observed request rate in the smoothed request rate
+	rateSmoothing = 0.5
+	// scaleUpRatio is the multiple of the target rate of the current replicas that the
+	// request rate must exceed before replicas are added, such that the count does not flap
+	scaleUpRatio = 1.1
+	// scaleDownRatio is the fraction of the target rate of the remaining replicas that the
+	// request rate must drop below before a replica is removed, such that the count does not flap
+	scaleDownRatio = 0.8
+)
+
+// ModelReplicas is the replica count of a model
+type ModelReplicas struct {
+	ModelName string
+	Version   int64
+	Replicas  int
+	// RequestRate is the smoothed number of requests per second for the model
+	RequestRate float64
+}
+
+// replicaScaler adjusts the number of nodes that serve each model to the request rate of the model
+type replicaScaler struct {
+	mux            sync.Mutex
+	minReplicas    int
+	maxReplicas    int
+	targetRate     float64
+	interval       time.Duration
+	scaleUpDelay   time.Duration
+	scaleDownDelay time.Duration
+	models         map[string]*modelReplicas
+	stop           chan struct{}
+}
+
+type modelReplicas struct {
+	modelName  string
+	version    string
+	requests   int
+	rate       float64
+	replicas   int
+	lastChange time.Time
+}
+
+// newReplicaScaler creates the replica scaler configured in proxy.replicas.
+// It returns nil if dynamic replicas are disabled.
+func newReplicaScaler() *replicaScaler {
+	if !viper.GetBool("proxy.replicas.dynamic") {
+		return nil
+	}
+	scaler := &replicaScaler{
+		minReplicas:    int(math.Max(viper.GetFloat64("proxy.replicas.min"), 1)),
+		maxReplicas:    viper.GetInt("proxy.replicas.max"),
+		targetRate:     viper.GetFloat64("proxy.replicas.targetRequestRate"),
+		interval:       viper.GetDuration("proxy.replicas.interval") * time.Second,
+		scaleUpDelay:   viper.GetDuration("proxy.replicas.scaleUpDelay") * time.Second,
+		scaleDownDelay: viper.GetDuration("proxy.replicas.scaleDownDelay") * time.Second,
+		models:         map[string]*modelReplicas{},
+	}
+	if scaler.maxReplicas < scaler.minReplicas {
+		scaler.maxReplicas = scaler.minReplicas
+	}
+	if scaler.targetRate <= 0 {
+		scaler.targetRate = 10
+	}
+	return scaler
+}
+
+// recordRequest registers a request for the given model
+func (scaler *replicaScaler) recordRequest(modelName string, version string) {
+	if scaler == nil {
+		return
+	}
+	scaler.mux.Lock()
+	defer scaler.mux.Unlock()
+	key := modelName + "##" + version
+	model, ok := scaler.models[key]
+	if !ok {
+		model = &modelReplicas{
+			modelName: modelName,
+			version:   version,
+			replicas:  scaler.minReplicas,
+		}
+		scaler.models[key] = model
+		promModelReplicas.WithLabelValues(modelName, version).Set(float64(model.replicas))
+	}
+	model.requests++
+}
+
+// replicaCount returns the number of nodes that serve the given model
+func (scaler *replicaScaler) replicaCount(modelName string, version string) int {
+	scaler.mux.Lock()
+	defer scaler.mux.Unlock()
+	if model, ok := scaler.models[modelName+"##"+version]; ok {
+		return model.replicas
+	}
+	return scaler.minReplicas
+}
+
+// update updates the request rates with the requests of the last elapsed
+// duration and adjusts the replica counts. Replicas are added when the
+// request rate exceeds the target rate of the current replicas by
+// scaleUpRatio, at most once per scaleUpDelay, while they are removed one
+// at a time, at most once per scaleDownDelay.
+func (scaler *replicaScaler) update(elapsed time.Duration, now time.Time) {
+	scaler.mux.Lock()
+	defer scaler.mux.Unlock()
+	for key, model := range scaler.models {
+		observedRate := float64(model.requests) / elapsed.Seconds()
+		model.rate = rateSmoothing*observedRate + (1-rateSmoothing)*model.rate
+		model.requests = 0
+
+		desired := int(math.Ceil(model.rate / scaler.targetRate))
+		if desired < scaler.minReplicas {
+			desired = scaler.minReplicas
+		}
+		if desired > scaler.maxReplicas {
+			desired = scaler.maxReplicas
+		}
+		switch {
+		case desired > model.replicas &&
+			model.rate > float64(model.replicas)*scaler.targetRate*scaleUpRatio &&
+			now.Sub(model.lastChange) >= scaler.scaleUpDelay:
+			model.replicas = desired
+			model.lastChange = now
+		case desired < model.replicas &&
+			model.rate <= float64(model.replicas-1)*scaler.targetRate*scaleDownRatio &&
+			now.Sub(model.lastChange) >= scaler.scaleDownDelay:
+			model.replicas--
+			model.lastChange = now
+		}
+
+		if model.replicas == scaler.minReplicas && model.rate < 0.01 {
+			// Forget models that are no longer requested
+			delete(scaler.models, key)
+			promModelReplicas.DeleteLabelValues(model.modelName, model.version)
+			continue
+		}
+		promModelReplicas.WithLabelValues(model.modelName, model.version).Set(float64(model.replicas))
+	}
+}
+
+// start updates the replica counts periodically until stopped
+func (scaler *replicaScaler) start() {
+	if scaler == nil || scaler.interval <= 0 || scaler.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	scaler.stop = stop
+	go func() {
+		ticker := time.NewTicker(scaler.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				scaler.update(scaler.interval, now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (scaler *replicaScaler) close() {
+	if scaler != nil && scaler.stop != nil {
+		close(scaler.stop)
+		scaler.stop = nil
+	}
+}
+
+// list returns the replica counts of the models that have been requested recently
+func (scaler *replicaScaler) list() []ModelReplicas {
+	scaler.mux.Lock()
+	defer scaler.mux.Unlock()
+	res := make([]ModelReplicas, 0, len(scaler.models))
+	for _, model := range scaler.models {
+		version, _ := strconv.ParseInt(model.version, 10, 64)
+		res = append(res, ModelReplicas{
+			ModelName:   model.modelName,
+			Version:     version,
+			Replicas:    model.replicas,
+			RequestRate: model.rate,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ModelName != res[j].ModelName {
+			return res[i].ModelName < res[j].ModelName
+		}
+		return res[i].Version < res[j].Version
+	})
+	return res
+}
+
+// replicaCount returns the number of nodes that serve the given model
+func (handler *TaskHandler) replicaCount(modelName string, version string) int {
+	if handler.replicas == nil {
+		return int(math.Max(viper.GetFloat64("proxy.replicasPerModel"), 1))
+	}
+	return handler.replicas.replicaCount(modelName, version)
+}
+
+// ServeReplicas returns the HTTP handler function that lists the current
+// replica count of each model when dynamic replicas are enabled:
+//
+//	GET /admin/cluster/replicas
+func (handler *TaskHandler) ServeReplicas() func(http.ResponseWriter, *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !handler.authorizeAdmin(rw, req) {
+			return
+		}
+		if req.Method != http.MethodGet {
+			writeAdminError(rw, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if handler.replicas == nil {
+			writeAdminError(rw, http.StatusNotFound, "Dynamic replicas are not enabled")
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(handler.replicas.list())
+	}
+}
@@ -0,0 +1,207 @@
+package taskhandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func newTestReplicaScaler() *replicaScaler {
+	return &replicaScaler{
+		minReplicas:    1,
+		maxReplicas:    4,
+		targetRate:     10,
+		scaleUpDelay:   30 * time.Second,
+		scaleDownDelay: time.Minute,
+		models:         map[string]*modelReplicas{},
+	}
+}
+
+func recordRequests(scaler *replicaScaler, numRequests int) {
+	for i := 0; i < numRequests; i++ {
+		scaler.recordRequest("foo", "1")
+	}
+}
+
+func TestReplicaScalerScalesUpWithinBounds(t *testing.T) {
+	scaler := newTestReplicaScaler()
+	now := time.Now()
+	if scaler.replicaCount("foo", "1") != 1 {
+		t.Errorf("Expected min replicas for unknown model")
+	}
+
+	// 50 requests per second is smoothed to 25 requests per second
+	recordRequests(scaler, 50)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 3 {
+		t.Errorf("Expected 3 replicas, but got %d", replicas)
+	}
+
+	recordRequests(scaler, 1000)
+	scaler.update(time.Second, now.Add(time.Minute))
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 4 {
+		t.Errorf("Expected replicas to be capped at 4, but got %d", replicas)
+	}
+}
+
+func TestReplicaScalerScaleUpHysteresis(t *testing.T) {
+	scaler := newTestReplicaScaler()
+	now := time.Now()
+	recordRequests(scaler, 20)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 1 {
+		t.Fatalf("Expected 1 replica, but got %d", replicas)
+	}
+
+	// 10.5 requests per second exceeds the target rate, but is too close to it to scale up
+	scaler.models["foo##1"].rate = 10.5
+	recordRequests(scaler, 10)
+	now = now.Add(time.Minute)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 1 {
+		t.Errorf("Expected replicas not to scale up close to capacity, but got %d", replicas)
+	}
+
+	recordRequests(scaler, 20)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 2 {
+		t.Fatalf("Expected replicas to scale up to 2, but got %d", replicas)
+	}
+	// Replicas are added at most once per scale up delay
+	recordRequests(scaler, 100)
+	scaler.update(time.Second, now.Add(time.Second))
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 2 {
+		t.Errorf("Expected replicas not to scale up before the scale up delay, but got %d", replicas)
+	}
+	recordRequests(scaler, 100)
+	scaler.update(time.Second, now.Add(time.Minute))
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 4 {
+		t.Errorf("Expected replicas to scale up to 4, but got %d", replicas)
+	}
+}
+
+func TestReplicaScalerScaleDownHysteresis(t *testing.T) {
+	scaler := newTestReplicaScaler()
+	now := time.Now()
+	recordRequests(scaler, 60)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 3 {
+		t.Fatalf("Expected 3 replicas, but got %d", replicas)
+	}
+
+	// 19 requests per second needs 2 replicas, but is too close to their capacity to scale down
+	scaler.models["foo##1"].rate = 19
+	recordRequests(scaler, 19)
+	now = now.Add(2 * time.Minute)
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 3 {
+		t.Errorf("Expected replicas not to scale down close to capacity, but got %d", replicas)
+	}
+
+	// Scale down one replica at a time, at most once per scale down delay
+	scaler.update(time.Second, now)
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 2 {
+		t.Errorf("Expected replicas to scale down to 2, but got %d", replicas)
+	}
+	scaler.update(time.Second, now.Add(time.Second))
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 2 {
+		t.Errorf("Expected replicas not to scale down before the scale down delay, but got %d", replicas)
+	}
+	scaler.update(time.Second, now.Add(2*time.Minute))
+	if replicas := scaler.replicaCount("foo", "1"); replicas != 1 {
+		t.Errorf("Expected replicas to scale down to 1, but got %d", replicas)
+	}
+
+	// Idle models are forgotten
+	for i := 0; i < 20; i++ {
+		scaler.update(time.Second, now.Add(2*time.Minute))
+	}
+	if len(scaler.list()) != 0 {
+		t.Errorf("Expected idle model to be forgotten, but got: %v", scaler.list())
+	}
+}
+
+func TestDynamicReplicasSelectMoreNodes(t *testing.T) {
+	viper.Set("proxy.replicas.dynamic", true)
+	viper.Set("proxy.replicas.max", 4)
+	viper.Set("proxy.replicas.targetRequestRate", 10)
+	defer func() {
+		viper.Set("proxy.replicas.dynamic", nil)
+		viper.Set("proxy.replicas.max", nil)
+		viper.Set("proxy.replicas.targetRequestRate", nil)
+	}()
+	handler, disconnect := connectTestCluster(t, testMembers(5))
+	defer disconnect()
+
+	owners, _ := handler.modelOwners("foo", "1")
+	if len(owners) != 1 {
+		t.Errorf("Expected 1 owner before any requests, but got %d", len(owners))
+	}
+	recordRequests(handler.replicas, 80)
+	handler.replicas.update(time.Second, time.Now())
+	scaledOwners, _ := handler.modelOwners("foo", "1")
+	if len(scaledOwners) != 4 {
+		t.Errorf("Expected 4 owners after scaling up, but got %d", len(scaledOwners))
+	}
+	if scaledOwners[0] != owners[0] {
+		t.Errorf("Expected the original owner to keep serving the model")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeReplicas()(rec, newAdminRequest(http.MethodGet, "/admin/cluster/replicas"))
+	var replicas []ModelReplicas
+	if err := json.NewDecoder(rec.Body).Decode(&replicas); err != nil {
+		t.Fatalf("Error decoding replicas: %v", err)
+	}
+	if len(replicas) != 1 || replicas[0].ModelName != "foo" || replicas[0].Version != 1 || replicas[0].Replicas != 4 {
+		t.Errorf("Unexpected replicas: %v", replicas)
+	}
+}
+
+func TestDynamicReplicasOfProxiesWithDifferentRates(t *testing.T) {
+	viper.Set("proxy.replicas.dynamic", true)
+	viper.Set("proxy.replicas.max", 4)
+	viper.Set("proxy.replicas.targetRequestRate", 10)
+	defer func() {
+		viper.Set("proxy.replicas.dynamic", nil)
+		viper.Set("proxy.replicas.max", nil)
+		viper.Set("proxy.replicas.targetRequestRate", nil)
+	}()
+	handler, disconnect := connectTestCluster(t, testMembers(5))
+	defer disconnect()
+	otherHandler, otherDisconnect := connectTestCluster(t, testMembers(5))
+	defer otherDisconnect()
+
+	// Each proxy only counts its own requests, so a proxy that receives
+	// fewer requests uses fewer replicas
+	recordRequests(handler.replicas, 80)
+	handler.replicas.update(time.Second, time.Now())
+	recordRequests(otherHandler.replicas, 30)
+	otherHandler.replicas.update(time.Second, time.Now())
+	owners, _ := handler.modelOwners("foo", "1")
+	otherOwners, _ := otherHandler.modelOwners("foo", "1")
+	if len(owners) != 4 || len(otherOwners) != 2 {
+		t.Fatalf("Expected 4 and 2 owners, but got %v and %v", owners, otherOwners)
+	}
+	// The replicas of the proxy with the lower rate are a subset of the replicas of the other proxy
+	for i, owner := range otherOwners {
+		if owners[i] != owner {
+			t.Errorf("Expected owners %v to start with %v", owners, otherOwners)
+		}
+	}
+}
+
+func TestServeReplicasWithoutDynamicReplicas(t *testing.T) {
+	handler, disconnect := connectTestCluster(t, testMembers(2))
+	defer disconnect()
+
+	rec := httptest.NewRecorder()
+	handler.ServeReplicas()(rec, newAdminRequest(http.MethodGet, "/admin/cluster/replicas"))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status code 404, but was %d", rec.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package taskhandler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// retryTransport is a http.RoundTripper that retries failed REST
+// requests on the other nodes that serve the requested model
+type retryTransport struct {
+	handler   *TaskHandler
+	transport http.RoundTripper
+	policy    *tfservingproxy.RetryPolicy
+}
+
+func newRetryTransport(handler *TaskHandler, transport http.RoundTripper, policy *tfservingproxy.RetryPolicy) *retryTransport {
+	return &retryTransport{
+		handler:   handler,
+		transport: transport,
+		policy:    policy,
+	}
+}
+
+func (transport *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, isBuffered, err := bufferBody(req, transport.policy.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	modelName, version, ok := tfservingproxy.ParseRestURL(req.URL.Path)
+	if !ok || !isBuffered {
+		return transport.attempt(req)
+	}
+	hosts := transport.candidateHosts(req.URL.Host, modelName, version)
+
+	transport.policy.StartRequest()
+	for attempt := 1; ; attempt++ {
+		attemptReq := req.Clone(req.Context())
+		attemptReq.URL.Host = hosts[attempt-1]
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := transport.attempt(attemptReq)
+		isRetryable := (err != nil && req.Context().Err() == nil) || (err == nil && resp.StatusCode >= 500)
+		if !isRetryable || attempt >= len(hosts) || !transport.policy.AllowRetry(attempt, "rest") {
+			return resp, err
+		}
+		if err == nil {
+			err = fmt.Errorf("Status %d", resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.WithError(err).Warnf("Request for model %s failed on %s. Retrying (attempt %d)", modelName, hosts[attempt-1], attempt+1)
+	}
+}
+
+// attempt sends a single request. The per-attempt timeout
+// applies until the response headers have been received.
+func (transport *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if transport.policy.PerAttemptTimeout <= 0 {
+		return transport.transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(transport.policy.PerAttemptTimeout, cancel)
+	resp, err := transport.transport.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// candidateHosts returns the REST hosts of the nodes that serve the
+// model, starting with the host that was selected by the director
+func (transport *retryTransport) candidateHosts(selectedHost string, modelName string, version string) []string {
+	hosts := []string{selectedHost}
+	nodes, err := transport.handler.nodesForKey(modelName, version)
+	if err != nil {
+		return hosts
+	}
+	for _, node := range nodes {
+		host := fmt.Sprintf("%s:%d", node.Host, node.RestPort)
+		if host != selectedHost {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// bufferBody reads the request body into memory, such that the request can be
+// sent more than once. If the body is larger than maxSize, it is not buffered
+// and the request body is left readable from the start.
+func bufferBody(req *http.Request, maxSize int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > maxSize {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > maxSize {
+		req.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cancelOnClose cancels the context of a request when the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
@@ -0,0 +1,98 @@
+package taskhandler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
+)
+
+// setupRetryCluster creates a cluster of two nodes, where the first node always fails
+func setupRetryCluster(t *testing.T) (*TaskHandler, *httptest.Server, *[]string, func()) {
+	failingNode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	receivedBodies := []string{}
+	workingNode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		receivedBodies = append(receivedBodies, string(body))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	members := []ServingService{}
+	for _, server := range []*httptest.Server{failingNode, workingNode} {
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		restPort, _ := strconv.Atoi(port)
+		members = append(members, ServingService{Host: host, RestPort: restPort, GrpcPort: 1})
+	}
+	handler, disconnect := connectTestCluster(t, members)
+	return handler, failingNode, &receivedBodies, func() {
+		disconnect()
+		failingNode.Close()
+		workingNode.Close()
+	}
+}
+
+func TestRetryTransportRetriesOnOtherReplica(t *testing.T) {
+	handler, failingNode, receivedBodies, cleanup := setupRetryCluster(t)
+	defer cleanup()
+	transport := newRetryTransport(handler, http.DefaultTransport, &tfservingproxy.RetryPolicy{MaxAttempts: 2, MaxBodySize: 1024})
+
+	req, _ := http.NewRequest(http.MethodPost, failingNode.URL+"/v1/models/foo/versions/1:predict", bytes.NewBufferString("instances"))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected request to be retried on the working replica, but status was %d", resp.StatusCode)
+	}
+	if len(*receivedBodies) != 1 || (*receivedBodies)[0] != "instances" {
+		t.Errorf("Expected working replica to receive the request body, but received: %v", *receivedBodies)
+	}
+}
+
+func TestRetryTransportDoesNotRetryLargeBodies(t *testing.T) {
+	handler, failingNode, receivedBodies, cleanup := setupRetryCluster(t)
+	defer cleanup()
+	transport := newRetryTransport(handler, http.DefaultTransport, &tfservingproxy.RetryPolicy{MaxAttempts: 2, MaxBodySize: 4})
+
+	req, _ := http.NewRequest(http.MethodPost, failingNode.URL+"/v1/models/foo/versions/1:predict", bytes.NewBufferString("instances"))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || len(*receivedBodies) != 0 {
+		t.Errorf("Expected request with large body not to be retried")
+	}
+}
+
+func TestRetryTransportRespectsMaxAttempts(t *testing.T) {
+	handler, failingNode, _, cleanup := setupRetryCluster(t)
+	defer cleanup()
+	transport := newRetryTransport(handler, http.DefaultTransport, &tfservingproxy.RetryPolicy{MaxAttempts: 1, MaxBodySize: 1024})
+
+	req, _ := http.NewRequest(http.MethodGet, failingNode.URL+"/v1/models/foo/versions/1", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected request not to be retried, but status was %d", resp.StatusCode)
+	}
+}
+
+func TestBufferBodyKeepsUnbufferedBodyReadable(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", ioutil.NopCloser(bytes.NewBufferString("instances")))
+	_, isBuffered, err := bufferBody(req, 4)
+	if err != nil || isBuffered {
+		t.Fatalf("Expected body not to be buffered (err: %v)", err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "instances" {
+		t.Errorf("Expected complete body to be readable, but was '%s'", string(body))
+	}
+}
@@ -0,0 +1,269 @@
+package taskhandler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// selectionStrategy decides which of the nodes that serve a model handles a request
+type selectionStrategy interface {
+	// order returns the nodes in the order they should be tried. The first
+	// node handles the request, and the others are used for retries.
+	order(modelName string, version string, nodes []ServingService) []ServingService
+}
+
+// newSelectionStrategy creates the selection strategy with the given name.
+// Unknown names fall back to random selection.
+func newSelectionStrategy(name string, load *nodeLoad, status *modelStatus) selectionStrategy {
+	switch name {
+	case "random":
+		return &randomSelection{}
+	case "leastOutstanding":
+		return &leastOutstandingSelection{load: load}
+	case "powerOfTwo":
+		return &powerOfTwoSelection{load: load}
+	case "preferLoaded":
+		return &preferLoadedSelection{status: status, fallback: &leastOutstandingSelection{load: load}}
+	default:
+		log.Errorf("Unknown selection strategy '%s'. Using random selection", name)
+		return &randomSelection{}
+	}
+}
+
+// randomSelection picks a random node
+type randomSelection struct{}
+
+func (strategy *randomSelection) order(modelName string, version string, nodes []ServingService) []ServingService {
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	return nodes
+}
+
+// leastOutstandingSelection picks the node with the fewest in-flight requests from this proxy
+type leastOutstandingSelection struct {
+	load *nodeLoad
+}
+
+func (strategy *leastOutstandingSelection) order(modelName string, version string, nodes []ServingService) []ServingService {
+	// Shuffle first such that ties are broken randomly
+	nodes = (&randomSelection{}).order(modelName, version, nodes)
+	outstanding := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		outstanding[restAddress(node)] = strategy.load.outstanding(restAddress(node))
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return outstanding[restAddress(nodes[i])] < outstanding[restAddress(nodes[j])]
+	})
+	return nodes
+}
+
+// powerOfTwoSelection picks two random nodes and selects the one with the fewest
+// in-flight requests, which avoids sending all requests to the same node when
+// the load information is outdated.
+type powerOfTwoSelection struct {
+	load *nodeLoad
+}
+
+func (strategy *powerOfTwoSelection) order(modelName string, version string, nodes []ServingService) []ServingService {
+	nodes = (&randomSelection{}).order(modelName, version, nodes)
+	if len(nodes) >= 2 && strategy.load.outstanding(restAddress(nodes[1])) < strategy.load.outstanding(restAddress(nodes[0])) {
+		nodes[0], nodes[1] = nodes[1], nodes[0]
+	}
+	return nodes
+}
+
+// preferLoadedSelection prefers nodes that have the model loaded in TF Serving,
+// such that requests avoid a cold fetch when another replica is warm. Nodes
+// are otherwise ordered by the fallback strategy.
+type preferLoadedSelection struct {
+	status   *modelStatus
+	fallback selectionStrategy
+}
+
+func (strategy *preferLoadedSelection) order(modelName string, version string, nodes []ServingService) []ServingService {
+	nodes = strategy.fallback.order(modelName, version, nodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return strategy.status.isLoaded(nodes[i], modelName, version) && !strategy.status.isLoaded(nodes[j], modelName, version)
+	})
+	return nodes
+}
+
+// nodeLoad counts the requests in-flight from this proxy to each node,
+// keyed by the REST address of the node
+type nodeLoad struct {
+	mux      sync.Mutex
+	requests map[string]int
+}
+
+func newNodeLoad() *nodeLoad {
+	return &nodeLoad{requests: map[string]int{}}
+}
+
+// start registers a new request to the node and returns the function that marks it as done
+func (load *nodeLoad) start(address string) func() {
+	load.mux.Lock()
+	load.requests[address]++
+	load.mux.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			load.mux.Lock()
+			defer load.mux.Unlock()
+			load.requests[address]--
+			if load.requests[address] == 0 {
+				delete(load.requests, address)
+			}
+		})
+	}
+}
+
+func (load *nodeLoad) outstanding(address string) int {
+	load.mux.Lock()
+	defer load.mux.Unlock()
+	return load.requests[address]
+}
+
+// transport returns a http.RoundTripper that counts the requests sent with
+// transport. A request is in-flight until its response body is closed.
+func (load *nodeLoad) transport(transport http.RoundTripper) http.RoundTripper {
+	return &loadTrackingTransport{load: load, transport: transport}
+}
+
+// unaryInterceptor returns a grpc interceptor that counts the requests sent to the node with the given address
+func (load *nodeLoad) unaryInterceptor(address string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		done := load.start(address)
+		defer done()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+type loadTrackingTransport struct {
+	load      *nodeLoad
+	transport http.RoundTripper
+}
+
+func (transport *loadTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := transport.load.start(req.URL.Host)
+	resp, err := transport.transport.RoundTrip(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &doneOnClose{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// doneOnClose calls done when the response body is closed
+type doneOnClose struct {
+	io.ReadCloser
+	done func()
+}
+
+func (body *doneOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.done()
+	return err
+}
+
+// modelStatus keeps track of the models that are loaded on each
+// node, as reported by the admin api of the cache nodes
+type modelStatus struct {
+	handler  *TaskHandler
+	interval time.Duration
+	mux      sync.RWMutex
+	loaded   map[string]map[string]bool
+	stop     chan struct{}
+}
+
+func newModelStatus(handler *TaskHandler, interval time.Duration) *modelStatus {
+	return &modelStatus{
+		handler:  handler,
+		interval: interval,
+		loaded:   map[string]map[string]bool{},
+	}
+}
+
+// start refreshes the model status periodically until stopped
+func (status *modelStatus) start() {
+	if status.interval <= 0 || status.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	status.stop = stop
+	go func() {
+		ticker := time.NewTicker(status.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				status.refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (status *modelStatus) close() {
+	if status.stop != nil {
+		close(status.stop)
+		status.stop = nil
+	}
+}
+
+// refresh fetches the loaded models from all nodes in the cluster. Nodes that
+// cannot be reached are considered to have no models loaded.
+func (status *modelStatus) refresh() {
+	members := status.handler.Cluster.Members()
+	loaded := make(map[string]map[string]bool, len(members))
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range members {
+		wg.Add(1)
+		go func(node ServingService) {
+			defer wg.Done()
+			var models []cachedModel
+			err := status.handler.adminRequest(http.MethodGet, node, "/admin/models", &models)
+			if err != nil {
+				log.WithError(err).Warnf("Could not get model status of node: %s", node.String())
+				return
+			}
+			nodeModels := map[string]bool{}
+			for _, model := range models {
+				if model.State == "AVAILABLE" {
+					nodeModels[fmt.Sprintf("%s##%d", model.Name, model.Version)] = true
+				}
+			}
+			mux.Lock()
+			loaded[node.String()] = nodeModels
+			mux.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	status.mux.Lock()
+	status.loaded = loaded
+	status.mux.Unlock()
+}
+
+func (status *modelStatus) isLoaded(node ServingService, modelName string, version string) bool {
+	status.mux.RLock()
+	defer status.mux.RUnlock()
+	return status.loaded[node.String()][modelName+"##"+version]
+}
+
+// restAddress returns the address of the REST api of a node
+func restAddress(node ServingService) string {
+	return fmt.Sprintf("%s:%d", node.Host, node.RestPort)
+}
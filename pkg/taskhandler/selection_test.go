@@ -0,0 +1,122 @@
+package taskhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func connectSelectionTestCluster(t *testing.T, strategy string, members []ServingService) (*TaskHandler, func()) {
+	viper.Set("proxy.selection.strategy", strategy)
+	handler, disconnect := connectTestCluster(t, members)
+	return handler, func() {
+		disconnect()
+		viper.Set("proxy.selection.strategy", nil)
+	}
+}
+
+func testMembers(numMembers int) []ServingService {
+	dService := &DiscoveryServiceMock{ListUpdatedChans: map[string]chan []ServingService{}}
+	ch := make(chan []ServingService, 1)
+	dService.AddNodeListUpdated("members", ch)
+	dService.GenerateMembers(numMembers)
+	return <-ch
+}
+
+func assertSelectsNode(t *testing.T, handler *TaskHandler, modelName string, version string, expected ServingService) {
+	for i := 0; i < 20; i++ {
+		node, err := handler.nodeForKey(modelName, version)
+		if err != nil {
+			t.Fatalf("Error finding node: %v", err)
+		}
+		if node != expected {
+			t.Fatalf("Expected node %s to be selected, but was %s", expected.String(), node.String())
+		}
+	}
+}
+
+func TestLeastOutstandingSelectsLeastLoadedNode(t *testing.T) {
+	for _, strategy := range []string{"leastOutstanding", "powerOfTwo"} {
+		handler, disconnect := connectSelectionTestCluster(t, strategy, testMembers(5))
+		owners, _ := handler.modelOwners("foo", "1")
+		if len(owners) != 2 {
+			t.Fatalf("Expected 2 owners, but got %d", len(owners))
+		}
+		done := handler.load.start(restAddress(owners[0]))
+
+		assertSelectsNode(t, handler, "foo", "1", owners[1])
+		done()
+		disconnect()
+	}
+}
+
+func TestLeastOutstandingBalancesIdleNodes(t *testing.T) {
+	handler, disconnect := connectSelectionTestCluster(t, "leastOutstanding", testMembers(5))
+	defer disconnect()
+
+	selected := map[ServingService]bool{}
+	for i := 0; i < 100; i++ {
+		node, _ := handler.nodeForKey("foo", "1")
+		selected[node] = true
+	}
+	if len(selected) != 2 {
+		t.Errorf("Expected requests to be spread over both idle replicas, but used %d", len(selected))
+	}
+}
+
+func TestPreferLoadedSelectsNodeWithModelLoaded(t *testing.T) {
+	viper.Set("proxy.selection.strategy", "preferLoaded")
+	defer viper.Set("proxy.selection.strategy", nil)
+	handler, nodes, cleanup := setupAdminCluster(t, 3)
+	defer cleanup()
+
+	owners, _ := handler.modelOwners("foo", "1")
+	loadedNode := nodes[owners[1].String()]
+	loadedNode.mux.Lock()
+	loadedNode.cached = true
+	loadedNode.mux.Unlock()
+	handler.modelStatus.refresh()
+
+	// The node with the model loaded is preferred, even if it is busier
+	done := handler.load.start(restAddress(owners[1]))
+	defer done()
+	assertSelectsNode(t, handler, "foo", "1", owners[1])
+
+	// Without the model loaded anywhere, the least loaded node is selected
+	loadedNode.mux.Lock()
+	loadedNode.cached = false
+	loadedNode.mux.Unlock()
+	handler.modelStatus.refresh()
+	assertSelectsNode(t, handler, "foo", "1", owners[0])
+}
+
+func TestUnknownStrategyFallsBackToRandom(t *testing.T) {
+	strategy := newSelectionStrategy("unknown", newNodeLoad(), nil)
+	if _, ok := strategy.(*randomSelection); !ok {
+		t.Errorf("Expected unknown strategy to fall back to random selection")
+	}
+}
+
+func TestLoadTrackingTransportCountsUntilBodyIsClosed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("OK"))
+	}))
+	defer server.Close()
+	load := newNodeLoad()
+	client := &http.Client{Transport: load.transport(http.DefaultTransport)}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if load.outstanding(req.URL.Host) != 1 {
+		t.Errorf("Expected 1 outstanding request before the body is closed, but got %d", load.outstanding(req.URL.Host))
+	}
+	resp.Body.Close()
+	if load.outstanding(req.URL.Host) != 0 {
+		t.Errorf("Expected 0 outstanding requests after the body is closed, but got %d", load.outstanding(req.URL.Host))
+	}
+}
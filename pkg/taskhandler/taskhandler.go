@@ -1,6 +1,7 @@
 package taskhandler
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -23,6 +24,14 @@ type TaskHandler struct {
 	GrpcProxy       *tfservingproxy.GrpcProxy
 	grpcConnections *grpcConnMap
 	maxGrpcMsgSize  int
+	versionResolver tfservingproxy.VersionResolver
+	adminClient     *http.Client
+	adminToken      string
+	load            *nodeLoad
+	modelStatus     *modelStatus
+	selection       selectionStrategy
+	health          *nodeHealth
+	replicas        *replicaScaler
 }
 
 type grpcConnMap struct {
@@ -35,22 +44,55 @@ func (handler *TaskHandler) ServeRest() func(http.ResponseWriter, *http.Request)
 	return handler.RestProxy.Serve()
 }
 
-// NewTaskHandler creates a new TaskHandler
-func NewTaskHandler(dService DiscoveryService) *TaskHandler {
+// NewTaskHandler creates a new TaskHandler. Requests without a model
+// version are routed to the latest version given by versionResolver.
+func NewTaskHandler(dService DiscoveryService, versionResolver tfservingproxy.VersionResolver) *TaskHandler {
 	maxGrpcMsgSize := viper.GetInt("serving.grpcMaxMsgSize")
 	if maxGrpcMsgSize == 0 {
 		maxGrpcMsgSize = 16 * 1024 * 1024
 	}
+	load := newNodeLoad()
 	h := &TaskHandler{
-		Cluster:        NewClusterConnection(dService),
-		maxGrpcMsgSize: maxGrpcMsgSize,
+		Cluster:         newClusterConnection(dService, load),
+		load:            load,
+		maxGrpcMsgSize:  maxGrpcMsgSize,
+		versionResolver: versionResolver,
+		adminClient:     &http.Client{Timeout: viper.GetDuration("proxy.adminTimeout") * time.Second},
+		adminToken:      viper.GetString("admin.token"),
 	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector)
-	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector, maxGrpcMsgSize)
+	h.modelStatus = newModelStatus(h, viper.GetDuration("proxy.selection.statusInterval")*time.Second)
+	h.selection = newSelectionStrategy(viper.GetString("proxy.selection.strategy"), h.load, h.modelStatus)
+	h.health = newNodeHealth(viper.GetDuration("proxy.zones.failureCooldown") * time.Second)
+	if zone := viper.GetString("serviceDiscovery.zone"); zone != "" && viper.GetBool("proxy.zones.preferLocal") {
+		h.selection = &zoneAwareSelection{zone: zone, health: h.health, strategy: h.selection}
+	}
+	h.replicas = newReplicaScaler()
+
+	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector, versionResolver)
+	h.RestProxy.SetTimeouts(tfservingproxy.RestTimeouts{
+		Request:        viper.GetDuration("proxy.rest.timeout") * time.Second,
+		ResponseHeader: viper.GetDuration("proxy.rest.responseHeaderTimeout") * time.Second,
+		Body:           viper.GetDuration("proxy.rest.bodyTimeout") * time.Second,
+	})
+	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector, versionResolver, maxGrpcMsgSize)
 	h.grpcConnections = &grpcConnMap{ConnMap: make(map[string]*grpc.ClientConn)}
+	h.RestProxy.RestProxy.Transport = h.health.transport(h.load.transport(h.RestProxy.RestProxy.Transport))
+
+	retryPolicy := &tfservingproxy.RetryPolicy{
+		MaxAttempts:       viper.GetInt("proxy.retries.maxAttempts"),
+		PerAttemptTimeout: viper.GetDuration("proxy.retries.perAttemptTimeout") * time.Second,
+		MaxBodySize:       viper.GetInt64("proxy.retries.maxBodySize"),
+		Budget: tfservingproxy.NewRetryBudget(
+			viper.GetFloat64("proxy.retries.budget.ratio"),
+			viper.GetFloat64("proxy.retries.budget.maxTokens")),
+	}
+	if retryPolicy.MaxAttempts > 1 {
+		h.RestProxy.RestProxy.Transport = newRetryTransport(h, h.RestProxy.RestProxy.Transport, retryPolicy)
+		h.GrpcProxy.SetRetryPolicy(retryPolicy)
+	}
 	return h
 }
 
@@ -59,40 +101,65 @@ func (handler *TaskHandler) Close() error {
 	if err != nil {
 		log.WithError(err).Error("Could not disconnect from cluster")
 	}
-	err = handler.GrpcProxy.Close()
+	return handler.Shutdown(context.Background())
+}
+
+// Shutdown stops the grpc proxy after the pending requests have finished, or
+// ctx is done, and closes the connections to the other nodes. It does not
+// disconnect from the cluster, such that the node can be drained first.
+func (handler *TaskHandler) Shutdown(ctx context.Context) error {
+	err := handler.GrpcProxy.Shutdown(ctx)
 	if err != nil {
-		log.WithError(err).Error("Could not close grpc proxy")
+		log.WithError(err).Error("Could not stop grpc proxy gracefully")
 	}
-	err = handler.grpcConnections.Close()
-
-	return err
+	return handler.grpcConnections.Close()
 }
 
 // ConnectToCluster makes this TaskHandler discoverable
 // in the cluster and starts listening for other members
 func (handler *TaskHandler) ConnectToCluster() error {
-	return handler.Cluster.Connect()
+	err := handler.Cluster.Connect()
+	if err != nil {
+		return err
+	}
+	if usesModelStatus(handler.selection) {
+		handler.modelStatus.start()
+	}
+	handler.replicas.start()
+	return nil
 }
 
 // DisconnectFromCluster disconnects the TaskHandler from the
 // cluster (eventually)
 func (handler *TaskHandler) DisconnectFromCluster() error {
+	handler.modelStatus.close()
+	handler.replicas.close()
 	return handler.Cluster.Disconnect()
 }
 
+// nodesForKey returns the nodes that can handle the given model, in the order
+// given by the selection strategy
+func (handler *TaskHandler) nodesForKey(modelName string, version string) ([]ServingService, error) {
+	var modelKey = modelName + "##" + version
+	nodes, err := handler.Cluster.FindNodesForKey(modelKey, handler.replicaCount(modelName, version))
+	if err != nil {
+		return nil, err
+	}
+	return handler.selection.order(modelName, version, nodes), nil
+}
+
 // nodeForKey returns a node that can handle the given model
 func (handler *TaskHandler) nodeForKey(modelName string, version string) (ServingService, error) {
-	var modelKey = modelName + "##" + version
-	nodes, err := handler.Cluster.FindNodeForKey(modelKey)
+	nodes, err := handler.nodesForKey(modelName, version)
 	if err != nil {
 		return ServingService{}, err
 	}
-	// Pick random node
-	return nodes[rand.Intn(len(nodes))], nil
+	return nodes[0], nil
 }
 
 // restDirector is the director of REST requests.
 func (handler *TaskHandler) restDirector(req *http.Request, modelName string, version string) error {
+	handler.replicas.recordRequest(modelName, version)
 	selectedNode, err := handler.nodeForKey(modelName, version)
 	if err != nil {
 		log.WithError(err).Error("Error finding node for model")
@@ -113,16 +180,35 @@ func (handler *TaskHandler) restDirector(req *http.Request, modelName string, ve
 	return nil
 }
 
-// grpcDirector is the director of GRPC requests.
-func (handler *TaskHandler) grpcDirector(modelName string, version string) (*grpc.ClientConn, error) {
-	selectedNode, err := handler.nodeForKey(modelName, version)
+// grpcDirector is the director of GRPC requests. It returns connections
+// to all nodes that can handle the model, such that failed requests
+// can be retried on the other nodes.
+func (handler *TaskHandler) grpcDirector(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error) {
+	handler.replicas.recordRequest(modelName, version)
+	nodes, err := handler.nodesForKey(modelName, version)
 	if err != nil {
 		log.WithError(err).Error("Error finding node")
 		return nil, err
 	}
-	// grpc host is idx 0, port is idx 2 after split
-	grpcHost := fmt.Sprintf("%s:%d", selectedNode.Host, selectedNode.GrpcPort)
-	log.Infof("Forwarding to cache: %s", grpcHost)
+	conns := make([]*grpc.ClientConn, 0, len(nodes))
+	for _, node := range nodes {
+		conn, err := handler.grpcConnection(node)
+		if err != nil {
+			log.WithError(err).Errorf("Could not connect to cache: %s", node.String())
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("Could not connect to any node for model: %s", modelName)
+	}
+	log.Infof("Forwarding to cache: %s:%d", nodes[0].Host, nodes[0].GrpcPort)
+	return conns, nil
+}
+
+// grpcConnection returns the connection to the given node
+func (handler *TaskHandler) grpcConnection(node ServingService) (*grpc.ClientConn, error) {
+	grpcHost := fmt.Sprintf("%s:%d", node.Host, node.GrpcPort)
 	// Check if connection exists - otherwise create new connection
 	handler.grpcConnections.mutex.RLock()
 	if conn, ok := handler.grpcConnections.ConnMap[grpcHost]; ok {
@@ -133,20 +219,27 @@ func (handler *TaskHandler) grpcDirector(modelName string, version string) (*grp
 	handler.grpcConnections.mutex.RUnlock()
 	handler.grpcConnections.mutex.Lock()
 	defer handler.grpcConnections.mutex.Unlock()
+	if conn, ok := handler.grpcConnections.ConnMap[grpcHost]; ok {
+		return conn, nil
+	}
 	conn, err := grpc.Dial(grpcHost,
 		grpc.WithInsecure(),
 		grpc.WithTimeout(viper.GetDuration("serving.grpcPredictTimeout")*time.Second),
 		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoff.DefaultConfig}),
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(handler.maxGrpcMsgSize), grpc.MaxCallSendMsgSize(handler.maxGrpcMsgSize)),
+		grpc.WithChainUnaryInterceptor(
+			handler.load.unaryInterceptor(restAddress(node)),
+			handler.health.unaryInterceptor(restAddress(node))),
 	)
 	if err == nil {
 		handler.grpcConnections.ConnMap[grpcHost] = conn
 	}
 	return conn, err
-
 }
 
 func (connMap *grpcConnMap) Close() error {
+	connMap.mutex.Lock()
+	defer connMap.mutex.Unlock()
 	var err error = nil
 	for k := range connMap.ConnMap {
 		err = connMap.ConnMap[k].Close()
@@ -0,0 +1,150 @@
+package taskhandler
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// zoneAwareSelection prefers healthy nodes in the zone of this node, such that
+// requests only cross zones when there are no healthy replicas in the local zone.
+// Nodes are otherwise ordered by the wrapped strategy.
+type zoneAwareSelection struct {
+	zone     string
+	health   *nodeHealth
+	strategy selectionStrategy
+}
+
+func (strategy *zoneAwareSelection) order(modelName string, version string, nodes []ServingService) []ServingService {
+	nodes = strategy.strategy.order(modelName, version, nodes)
+	rank := func(node ServingService) int {
+		rank := 0
+		if !strategy.health.isHealthy(restAddress(node)) {
+			rank += 2
+		}
+		if node.Zone != strategy.zone {
+			rank++
+		}
+		return rank
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return rank(nodes[i]) < rank(nodes[j])
+	})
+	return nodes
+}
+
+// usesModelStatus reports whether the selection strategy needs the model status of the nodes
+func usesModelStatus(strategy selectionStrategy) bool {
+	switch s := strategy.(type) {
+	case *preferLoadedSelection:
+		return true
+	case *zoneAwareSelection:
+		return usesModelStatus(s.strategy)
+	default:
+		return false
+	}
+}
+
+// nodeHealth keeps track of nodes that recently failed requests from this proxy, keyed
+// by the REST address of the node. A node is considered unhealthy until it succeeds a
+// request or until the cooldown has passed since it failed.
+type nodeHealth struct {
+	mux      sync.Mutex
+	cooldown time.Duration
+	failures map[string]time.Time
+}
+
+func newNodeHealth(cooldown time.Duration) *nodeHealth {
+	return &nodeHealth{
+		cooldown: cooldown,
+		failures: map[string]time.Time{},
+	}
+}
+
+func (health *nodeHealth) markFailed(address string) {
+	health.mux.Lock()
+	defer health.mux.Unlock()
+	health.failures[address] = time.Now()
+}
+
+func (health *nodeHealth) markSucceeded(address string) {
+	health.mux.Lock()
+	defer health.mux.Unlock()
+	delete(health.failures, address)
+}
+
+func (health *nodeHealth) isHealthy(address string) bool {
+	health.mux.Lock()
+	defer health.mux.Unlock()
+	failedAt, ok := health.failures[address]
+	return !ok || time.Since(failedAt) >= health.cooldown
+}
+
+// transport returns a http.RoundTripper that records the result of the requests sent with transport
+func (health *nodeHealth) transport(transport http.RoundTripper) http.RoundTripper {
+	return &healthTrackingTransport{health: health, transport: transport}
+}
+
+// unaryInterceptor returns a grpc interceptor that records the result of the requests
+// sent to the node with the given address. Only errors that indicate that the node is
+// down or overloaded mark the node as failed.
+func (health *nodeHealth) unaryInterceptor(address string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		switch {
+		case err == nil:
+			health.markSucceeded(address)
+		case status.Code(err) == codes.Unavailable || status.Code(err) == codes.ResourceExhausted:
+			health.markFailed(address)
+		}
+		return err
+	}
+}
+
+type healthTrackingTransport struct {
+	health    *nodeHealth
+	transport http.RoundTripper
+}
+
+func (transport *healthTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.transport.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == nil:
+		transport.health.markFailed(req.URL.Host)
+	case err == nil && resp.StatusCode >= 500:
+		transport.health.markFailed(req.URL.Host)
+	case err == nil:
+		transport.health.markSucceeded(req.URL.Host)
+	}
+	return resp, err
+}
+
+// spreadAcrossZones picks n of the given nodes, in order, such that the picked nodes are
+// in as many different zones as possible
+func spreadAcrossZones(nodes []string, zones map[string]string, n int) []string {
+	if n > len(nodes) {
+		n = len(nodes)
+	}
+	res := make([]string, 0, n)
+	picked := map[string]bool{}
+	usedZones := map[string]bool{}
+	for _, node := range nodes {
+		if len(res) < n && !usedZones[zones[node]] {
+			res = append(res, node)
+			picked[node] = true
+			usedZones[zones[node]] = true
+		}
+	}
+	for _, node := range nodes {
+		if len(res) < n && !picked[node] {
+			res = append(res, node)
+		}
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package taskhandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func zonedTestMembers(numMembers int, zones ...string) []ServingService {
+	members := testMembers(numMembers)
+	for i := range members {
+		members[i].Zone = zones[i%len(zones)]
+	}
+	return members
+}
+
+func TestZoneAwareSelectionPrefersHealthyLocalNodes(t *testing.T) {
+	members := zonedTestMembers(4, "a", "b")
+	health := newNodeHealth(time.Minute)
+	strategy := &zoneAwareSelection{
+		zone:     "b",
+		health:   health,
+		strategy: newSelectionStrategy("leastOutstanding", newNodeLoad(), nil),
+	}
+
+	nodes := strategy.order("foo", "1", append([]ServingService{}, members...))
+	if nodes[0].Zone != "b" || nodes[1].Zone != "b" {
+		t.Errorf("Expected nodes in the local zone first, but got %v", nodes)
+	}
+
+	// Unhealthy local nodes are only used after the remote nodes
+	health.markFailed(restAddress(members[1]))
+	health.markFailed(restAddress(members[3]))
+	nodes = strategy.order("foo", "1", append([]ServingService{}, members...))
+	if nodes[0].Zone != "a" || nodes[1].Zone != "a" {
+		t.Errorf("Expected remote nodes first when the local nodes are unhealthy, but got %v", nodes)
+	}
+	if nodes[2].Zone != "b" || nodes[3].Zone != "b" {
+		t.Errorf("Expected unhealthy local nodes last, but got %v", nodes)
+	}
+
+	health.markSucceeded(restAddress(members[1]))
+	nodes = strategy.order("foo", "1", append([]ServingService{}, members...))
+	if nodes[0] != members[1] {
+		t.Errorf("Expected recovered local node %s first, but got %s", members[1].String(), nodes[0].String())
+	}
+}
+
+func TestNodeHealthCooldown(t *testing.T) {
+	health := newNodeHealth(0)
+	health.markFailed("localhost:8100")
+	if !health.isHealthy("localhost:8100") {
+		t.Errorf("Expected node to be healthy after the cooldown")
+	}
+	health = newNodeHealth(time.Minute)
+	health.markFailed("localhost:8100")
+	if health.isHealthy("localhost:8100") {
+		t.Errorf("Expected node to be unhealthy during the cooldown")
+	}
+}
+
+func TestHealthTrackingTransport(t *testing.T) {
+	statusCode := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+	health := newNodeHealth(time.Minute)
+	client := &http.Client{Transport: health.transport(http.DefaultTransport)}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if health.isHealthy(req.URL.Host) {
+		t.Errorf("Expected node to be unhealthy after a 500 response")
+	}
+
+	statusCode = http.StatusNotFound
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if !health.isHealthy(req.URL.Host) {
+		t.Errorf("Expected node to be healthy after a 404 response")
+	}
+}
+
+func TestHashRingSpreadsReplicasAcrossZones(t *testing.T) {
+	viper.Set("proxy.zones.spreadReplicas", true)
+	defer viper.Set("proxy.zones.spreadReplicas", nil)
+	forEachHashRing(t, func(t *testing.T) {
+		members := zonedTestMembers(9, "a", "b", "c")
+		zones := map[string]string{}
+		for i := range members {
+			zones[members[i].String()] = members[i].Zone
+		}
+		ring := newHashRing(nil)
+		ring.set(members)
+		for i := 0; i < 200; i++ {
+			nodes, err := ring.getN(fmt.Sprintf("model_%d##1", i), 3)
+			if err != nil {
+				t.Fatalf("Error getting nodes: %v", err)
+			}
+			used := map[string]bool{}
+			for _, node := range nodes {
+				used[zones[node]] = true
+			}
+			if len(nodes) != 3 || len(used) != 3 {
+				t.Fatalf("Expected 3 nodes in 3 zones, but got %v", nodes)
+			}
+		}
+	})
+}
+
+func TestSpreadAcrossZonesFillsUpWithinZones(t *testing.T) {
+	zones := map[string]string{"n1": "a", "n2": "a", "n3": "b", "n4": "a"}
+	nodes := spreadAcrossZones([]string{"n1", "n2", "n3", "n4"}, zones, 3)
+	expected := []string{"n1", "n3", "n2"}
+	if fmt.Sprint(nodes) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, but got %v", expected, nodes)
+	}
+}
+
+func TestTaskHandlerPrefersLocalZone(t *testing.T) {
+	viper.Set("serviceDiscovery.zone", "a")
+	viper.Set("proxy.zones.preferLocal", true)
+	viper.Set("proxy.selection.strategy", "preferLoaded")
+	defer func() {
+		viper.Set("serviceDiscovery.zone", nil)
+		viper.Set("proxy.zones.preferLocal", nil)
+		viper.Set("proxy.selection.strategy", nil)
+	}()
+	handler := NewTaskHandler(&DiscoveryServiceMock{}, nil)
+	if _, ok := handler.selection.(*zoneAwareSelection); !ok {
+		t.Errorf("Expected zone aware selection when a zone is configured")
+	}
+	if !usesModelStatus(handler.selection) {
+		t.Errorf("Expected zone aware preferLoaded selection to use the model status")
+	}
+}
@@ -0,0 +1,109 @@
+package tfservingproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promRequestsRetried = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_retries_total",
+	Help: "The total number of retried requests",
+}, []string{"protocol"})
+
+// RetryPolicy describes how failed requests are retried on other replicas
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts for a request, including the first attempt
+	MaxAttempts int
+	// PerAttemptTimeout is the timeout of each attempt. Zero means no timeout.
+	PerAttemptTimeout time.Duration
+	// MaxBodySize is the max size of REST request bodies that are buffered for retries
+	MaxBodySize int64
+	// Budget limits the number of retries across requests. Nil means no limit.
+	Budget *RetryBudget
+}
+
+// RetryBudget limits retries to a ratio of the number of requests, such that
+// retries do not multiply the load on the cluster when many nodes fail.
+// Each request adds ratio tokens to the budget, up to maxTokens, and each
+// retry spends one token.
+type RetryBudget struct {
+	mux       sync.Mutex
+	ratio     float64
+	maxTokens float64
+	tokens    float64
+}
+
+// NewRetryBudget creates a new RetryBudget, which starts out full
+func NewRetryBudget(ratio float64, maxTokens float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:     ratio,
+		maxTokens: maxTokens,
+		tokens:    maxTokens,
+	}
+}
+
+func (budget *RetryBudget) deposit() {
+	budget.mux.Lock()
+	defer budget.mux.Unlock()
+	budget.tokens += budget.ratio
+	if budget.tokens > budget.maxTokens {
+		budget.tokens = budget.maxTokens
+	}
+}
+
+func (budget *RetryBudget) withdraw() bool {
+	budget.mux.Lock()
+	defer budget.mux.Unlock()
+	if budget.tokens < 1 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+// StartRequest registers a new request in the retry budget
+func (policy *RetryPolicy) StartRequest() {
+	if policy != nil && policy.Budget != nil {
+		policy.Budget.deposit()
+	}
+}
+
+// AllowRetry reports whether a request may be retried after the given
+// number of attempts, and spends from the retry budget if so.
+func (policy *RetryPolicy) AllowRetry(attempts int, protocol string) bool {
+	if policy == nil || attempts >= policy.MaxAttempts {
+		return false
+	}
+	if policy.Budget != nil && !policy.Budget.withdraw() {
+		return false
+	}
+	promRequestsRetried.WithLabelValues(protocol).Inc()
+	return true
+}
+
+// AttemptContext returns the context of a single attempt of a request
+func (policy *RetryPolicy) AttemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if policy == nil || policy.PerAttemptTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, policy.PerAttemptTimeout)
+}
+
+// isRetryableGrpcError reports whether a failed grpc call may succeed on another replica.
+// Deadlines are only retried if the deadline of the request itself has not been exceeded.
+func isRetryableGrpcError(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
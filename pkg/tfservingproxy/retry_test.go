@@ -0,0 +1,126 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setupGrpcRetryTest creates a grpc proxy whose client provider returns a connection
+// to a node that is down followed by a connection to a working model server
+func setupGrpcRetryTest(t *testing.T, policy *RetryPolicy, modelCallback func(modelName string, version int64)) (*grpc.ClientConn, func()) {
+	modelLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	modelServer := grpc.NewServer()
+	pb.RegisterPredictionServiceServer(modelServer, &mockProxyServiceServer{modelCallback})
+	go modelServer.Serve(modelLis)
+
+	downConn, _ := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	upConn, _ := grpc.Dial(modelLis.Addr().String(), grpc.WithInsecure())
+	proxy := NewGrpcProxy(func(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error) {
+		return []*grpc.ClientConn{downConn, upConn}, nil
+	}, nil, 1024*1024*16)
+	proxy.SetRetryPolicy(policy)
+	go proxy.Listen(8892)
+
+	clientConn, _ := grpc.Dial("127.0.0.1:8892", grpc.WithInsecure())
+	return clientConn, func() {
+		clientConn.Close()
+		proxy.Close()
+		downConn.Close()
+		upConn.Close()
+		modelServer.Stop()
+	}
+}
+
+func classify(conn *grpc.ClientConn) error {
+	_, err := pb.NewPredictionServiceClient(conn).Classify(context.Background(), &pb.ClassificationRequest{
+		ModelSpec: &pb.ModelSpec{
+			Name:          "foobar",
+			VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 42}},
+		},
+	}, grpc.WaitForReady(true))
+	return err
+}
+
+func TestGrpcProxyRetriesOnNextReplica(t *testing.T) {
+	modelServerCalled := false
+	policy := &RetryPolicy{MaxAttempts: 2, Budget: NewRetryBudget(0.1, 10)}
+	conn, cleanup := setupGrpcRetryTest(t, policy, func(string, int64) {
+		modelServerCalled = true
+	})
+	defer cleanup()
+
+	if err := classify(conn); err != nil {
+		t.Errorf("Expected request to be retried on the next replica, but got error: %v", err)
+	}
+	if !modelServerCalled {
+		t.Errorf("Model server not called")
+	}
+}
+
+func TestGrpcProxyDoesNotRetryWithoutPolicy(t *testing.T) {
+	conn, cleanup := setupGrpcRetryTest(t, nil, func(string, int64) {})
+	defer cleanup()
+
+	err := classify(conn)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable error without retries, but got: %v", err)
+	}
+}
+
+func TestGrpcProxyDoesNotRetryWhenBudgetIsSpent(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 2, Budget: NewRetryBudget(0, 0)}
+	conn, cleanup := setupGrpcRetryTest(t, policy, func(string, int64) {})
+	defer cleanup()
+
+	if err := classify(conn); err == nil {
+		t.Errorf("Expected request to fail when the retry budget is spent")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 2)
+	if !budget.withdraw() || !budget.withdraw() {
+		t.Errorf("Expected full budget to allow 2 retries")
+	}
+	if budget.withdraw() {
+		t.Errorf("Expected spent budget to deny retries")
+	}
+	budget.deposit()
+	if budget.withdraw() {
+		t.Errorf("Expected budget of 0.5 tokens to deny retries")
+	}
+	budget.deposit()
+	if !budget.withdraw() {
+		t.Errorf("Expected budget of 1 token to allow a retry")
+	}
+	for i := 0; i < 10; i++ {
+		budget.deposit()
+	}
+	if budget.tokens != 2 {
+		t.Errorf("Expected budget to be capped at 2 tokens, but was %f", budget.tokens)
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3}
+	if !policy.AllowRetry(1, "grpc") || !policy.AllowRetry(2, "grpc") {
+		t.Errorf("Expected retries to be allowed before max attempts")
+	}
+	if policy.AllowRetry(3, "grpc") {
+		t.Errorf("Expected retries to be denied after max attempts")
+	}
+	var nilPolicy *RetryPolicy
+	if nilPolicy.AllowRetry(1, "grpc") {
+		t.Errorf("Expected nil policy to deny retries")
+	}
+}
@@ -0,0 +1,101 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+// setupGrpcShutdownTest creates a grpc proxy to a model server that blocks requests until
+// release is closed, and sends a request through the proxy. It returns when the request
+// has reached the model server.
+func setupGrpcShutdownTest(t *testing.T, release chan struct{}) (*GrpcProxy, chan error, func()) {
+	modelLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	started := make(chan struct{})
+	modelServer := grpc.NewServer()
+	pb.RegisterPredictionServiceServer(modelServer, &mockProxyServiceServer{func(string, int64) {
+		close(started)
+		<-release
+	}})
+	go modelServer.Serve(modelLis)
+
+	modelConn, _ := grpc.Dial(modelLis.Addr().String(), grpc.WithInsecure())
+	proxy := NewGrpcProxy(func(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error) {
+		return []*grpc.ClientConn{modelConn}, nil
+	}, nil, 1024*1024*16)
+	go proxy.Listen(8893)
+
+	clientConn, _ := grpc.Dial("127.0.0.1:8893", grpc.WithInsecure())
+	result := make(chan error, 1)
+	go func() {
+		result <- classify(clientConn)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for request to reach the model server")
+	}
+	return proxy, result, func() {
+		clientConn.Close()
+		modelConn.Close()
+		modelServer.Stop()
+	}
+}
+
+func TestGrpcProxyShutdownWaitsForPendingRequests(t *testing.T) {
+	release := make(chan struct{})
+	proxy, result, cleanup := setupGrpcShutdownTest(t, release)
+	defer cleanup()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- proxy.Shutdown(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("Expected shutdown to wait for the pending request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Errorf("Expected graceful shutdown, but got: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Expected pending request to succeed, but got: %v", err)
+	}
+	if err := proxy.Listen(8893); !errors.Is(err, grpc.ErrServerStopped) {
+		t.Errorf("Expected proxy not to listen after shutdown, but got: %v", err)
+	}
+}
+
+func TestGrpcProxyShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	proxy, result, cleanup := setupGrpcShutdownTest(t, release)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected shutdown to time out, but got: %v", err)
+	}
+	if err := <-result; err == nil {
+		t.Errorf("Expected pending request to be cancelled")
+	}
+}
+
+func TestGrpcProxyShutdownBeforeListen(t *testing.T) {
+	proxy := NewGrpcProxy(nil, nil, 1024)
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected shutdown without server to succeed, but got: %v", err)
+	}
+}
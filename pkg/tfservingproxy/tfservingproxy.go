@@ -5,15 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
 	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
+	"github.com/golang/protobuf/ptypes/wrappers"
 	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,7 +27,7 @@ import (
 	"google.golang.org/grpc"
 )
 
-var tfServingRestURLMatch = regexp.MustCompile(`(?i)^/v1/models/(?P<modelName>[^/]+)(/versions/(?P<version>[0-9]+))?`)
+var tfServingRestURLMatch = regexp.MustCompile(`(?i)^/v1/models/(?P<modelName>[^/:]+)(/versions/(?P<version>[0-9]+)|/labels/(?P<label>[^/:]+))?`)
 var promRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "tfservingcache_proxy_requests_total",
 	Help: "The total number of requests",
@@ -31,54 +37,93 @@ var promRequestsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "The total number of failed requests",
 }, []string{"protocol"})
 
+// VersionResolver resolves the model version to use for
+// requests that do not specify a version or specify a version label
+type VersionResolver interface {
+	LatestVersion(modelName string) (int64, error)
+	LabelVersion(modelName string, label string) (int64, error)
+}
+
 // RestProxy is the proxy for the TFServing HTTP REST api that directs
 // api calls to the right nodes
 type RestProxy struct {
-	RestProxy      *httputil.ReverseProxy
-	successCounter *prometheus.CounterVec
-	errorCounter   *prometheus.CounterVec
+	RestProxy       *httputil.ReverseProxy
+	handler         func(req *http.Request, modelName string, version string) error
+	versionResolver VersionResolver
+	transport       *http.Transport
+	timeouts        RestTimeouts
+	successCounter  *prometheus.CounterVec
+	errorCounter    *prometheus.CounterVec
+}
+
+// RestTimeouts are the timeouts of REST requests. Zero means no timeout.
+type RestTimeouts struct {
+	// Request is the end-to-end timeout of requests, including model loading
+	Request time.Duration
+	// ResponseHeader is the time to wait for the response headers of the upstream node
+	ResponseHeader time.Duration
+	// Body is the time to wait for the complete response body of the upstream node,
+	// after the response headers have been received
+	Body time.Duration
 }
 
+// cancelRequestKey is the context key of the function that cancels a proxied request
+type cancelRequestKey struct{}
+
 // GrpcProxy is the proxy for the TFServing GRPC api that directs
 // api calls to the right nodes
 type GrpcProxy struct {
+	mux            sync.Mutex
 	GrpcProxy      *grpc.Server
 	serverImpl     *proxyServiceServer
 	listener       net.Listener
+	stopped        bool
 	healthcheck    *health.Server
 	maxGrpcMsgSize int
 }
 
-// NewRestProxy creates a new RestProxy for TF Serving
-func NewRestProxy(handler func(req *http.Request, modelName string, version string) error) *RestProxy {
+// NewRestProxy creates a new RestProxy for TF Serving. Requests without a model
+// version are resolved to the latest version using versionResolver, and version
+// labels are resolved to the version they are assigned to. If versionResolver
+// is nil, requests must specify a model version.
+func NewRestProxy(handler func(req *http.Request, modelName string, version string) error, versionResolver VersionResolver) *RestProxy {
 	promRequestsTotal.WithLabelValues("rest")
 	promRequestsFailed.WithLabelValues("rest")
 
-	director := func(req *http.Request) {
-		log.Debugf("Handling URL: %s", req.URL.String())
-		matches := tfServingRestURLMatch.FindStringSubmatch(req.URL.String())
-		log.Debugf("Model name: '%s' Version: '%s'", matches[1], matches[3])
-		err := handler(req, matches[1], matches[3])
-		if err != nil {
-			promRequestsFailed.WithLabelValues("rest").Inc()
-		} else {
-			promRequestsFailed.WithLabelValues("rest").Inc()
-		}
-	}
 	h := &RestProxy{
-		RestProxy: &httputil.ReverseProxy{Director: director},
+		handler:         handler,
+		versionResolver: versionResolver,
+		transport:       http.DefaultTransport.(*http.Transport).Clone(),
+	}
+	h.RestProxy = &httputil.ReverseProxy{
+		// The request is directed by the handler before it is proxied
+		Director:       func(req *http.Request) {},
+		Transport:      h.transport,
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.handleError,
 	}
 
 	return h
 }
 
-// NewGrpcProxy creates a new GrpcProxy for TF Serving
-func NewGrpcProxy(clientProvider func(modelName string, version string) (*grpc.ClientConn, error), maxGrpcMsgSize int) *GrpcProxy {
+// SetTimeouts sets the timeouts of REST requests
+func (handler *RestProxy) SetTimeouts(timeouts RestTimeouts) {
+	handler.timeouts = timeouts
+	handler.transport.ResponseHeaderTimeout = timeouts.ResponseHeader
+}
+
+// NewGrpcProxy creates a new GrpcProxy for TF Serving. The clientProvider returns the
+// clients that can handle requests for a model, in the order they should be tried.
+// Requests without a model version are resolved to the latest version using
+// versionResolver, and version labels are resolved to the version they are assigned
+// to. If versionResolver is nil, requests must specify a model version.
+func NewGrpcProxy(clientProvider func(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error), versionResolver VersionResolver, maxGrpcMsgSize int) *GrpcProxy {
 	promRequestsTotal.WithLabelValues("grpc")
 	promRequestsFailed.WithLabelValues("grpc")
 
 	server := proxyServiceServer{
-		clientProvider: clientProvider,
+		clientProvider:  clientProvider,
+		versionResolver: versionResolver,
 	}
 
 	proxy := GrpcProxy{
@@ -97,45 +142,140 @@ func (handler *RestProxy) Serve() func(http.ResponseWriter, *http.Request) {
 		log.Debugf("Handling URL: %s", req.URL.String())
 		matches := tfServingRestURLMatch.FindStringSubmatch(req.URL.String())
 		if len(matches) == 0 {
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(rw).Encode(struct {
-				Status  string
-				Message string
-			}{
-				Status:  "Error",
-				Message: "Not found",
-			})
-			promRequestsFailed.WithLabelValues("rest").Inc()
+			writeRestError(rw, http.StatusNotFound, "Not found")
 			return
 		}
-		if matches[3] == "" {
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(rw).Encode(struct {
-				Status  string
-				Message string
-			}{
-				Status:  "Error",
-				Message: "Model version must be provided",
-			})
-			promRequestsFailed.WithLabelValues("rest").Inc()
+		if matches[3] == "" && handler.versionResolver == nil {
+			writeRestError(rw, http.StatusBadRequest, "Model version must be provided")
 			return
 		}
+		if matches[3] == "" {
+			var version int64
+			var err error
+			if matches[4] != "" {
+				version, err = handler.versionResolver.LabelVersion(matches[1], matches[4])
+			} else {
+				version, err = handler.versionResolver.LatestVersion(matches[1])
+			}
+			if err != nil {
+				log.WithError(err).Errorf("Could not resolve version of model: %s", matches[1])
+				writeRestError(rw, http.StatusNotFound, fmt.Sprintf("Could not resolve version of model: %s", matches[1]))
+				return
+			}
+			matches[3] = strconv.FormatInt(version, 10)
+			setRestURLVersion(req, matches[3])
+		}
 		log.Debugf("Model name: '%s' Version: '%s'", matches[1], matches[3])
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		if handler.timeouts.Request > 0 {
+			ctx, cancel = context.WithTimeout(ctx, handler.timeouts.Request)
+			defer cancel()
+		}
+		req = req.WithContext(context.WithValue(ctx, cancelRequestKey{}, cancel))
+		err := handler.handler(req, matches[1], matches[3])
+		if err != nil {
+			handler.handleError(rw, req, err)
+			return
+		}
 		handler.RestProxy.ServeHTTP(rw, req)
 	}
 	return proxyFun
 }
 
+// modifyResponse makes sure that the response body is read within the body timeout
+func (handler *RestProxy) modifyResponse(resp *http.Response) error {
+	if handler.timeouts.Body <= 0 {
+		return nil
+	}
+	cancel, ok := resp.Request.Context().Value(cancelRequestKey{}).(context.CancelFunc)
+	if !ok {
+		return nil
+	}
+	timer := time.AfterFunc(handler.timeouts.Body, cancel)
+	resp.Body = &stopTimerOnClose{ReadCloser: resp.Body, timer: timer}
+	return nil
+}
+
+// handleError responds with an error if a request could not be directed or proxied
+func (handler *RestProxy) handleError(rw http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case isTimeout(err):
+		log.WithError(err).Errorf("Request timed out: %s", req.URL.String())
+		writeRestError(rw, http.StatusGatewayTimeout, "Request timed out")
+	case errors.Is(err, context.Canceled):
+		log.WithError(err).Infof("Request cancelled: %s", req.URL.String())
+		promRequestsFailed.WithLabelValues("rest").Inc()
+	default:
+		log.WithError(err).Errorf("Error proxying request: %s", req.URL.String())
+		writeRestError(rw, http.StatusBadGateway, "Error proxying request")
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// stopTimerOnClose stops a timer when the response body is closed
+type stopTimerOnClose struct {
+	io.ReadCloser
+	timer *time.Timer
+}
+
+func (body *stopTimerOnClose) Close() error {
+	body.timer.Stop()
+	return body.ReadCloser.Close()
+}
+
+// ParseRestURL returns the model name and version of a TF serving REST api path.
+// The version is empty if the path does not specify a version.
+func ParseRestURL(path string) (modelName string, version string, ok bool) {
+	matches := tfServingRestURLMatch.FindStringSubmatch(path)
+	if len(matches) == 0 {
+		return "", "", false
+	}
+	return matches[1], matches[3], true
+}
+
+// writeRestError responds to a REST request with an error in the TF serving format
+func writeRestError(rw http.ResponseWriter, statusCode int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(struct {
+		Status  string
+		Message string
+	}{
+		Status:  "Error",
+		Message: message,
+	})
+	promRequestsFailed.WithLabelValues("rest").Inc()
+}
+
+// setRestURLVersion rewrites the URL of a request without a model version
+// or with a version label, such that it requests the given model version
+func setRestURLVersion(req *http.Request, version string) {
+	match := tfServingRestURLMatch.FindStringSubmatchIndex(req.URL.Path)
+	// match[3] is the end of the model name and match[1] is the end of the version part
+	req.URL.Path = fmt.Sprintf("%s/versions/%s%s", req.URL.Path[:match[3]], version, req.URL.Path[match[1]:])
+	req.URL.RawPath = ""
+}
+
 // Listen starts the grpc server that proxies TF serving GRPC api calls
 func (proxy *GrpcProxy) Listen(port int) error {
+	proxy.mux.Lock()
+	if proxy.stopped {
+		proxy.mux.Unlock()
+		return grpc.ErrServerStopped
+	}
 	proxy.GrpcProxy = grpc.NewServer(
 		grpc.MaxRecvMsgSize(proxy.maxGrpcMsgSize),
 		grpc.MaxSendMsgSize(proxy.maxGrpcMsgSize),
 	)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
+		proxy.mux.Unlock()
 		return err
 	}
 	proxy.listener = lis
@@ -143,9 +283,16 @@ func (proxy *GrpcProxy) Listen(port int) error {
 	pb.RegisterSessionServiceServer(proxy.GrpcProxy, proxy.serverImpl)
 
 	healthgrpc.RegisterHealthServer(proxy.GrpcProxy, proxy.healthcheck)
+	server := proxy.GrpcProxy
+	proxy.mux.Unlock()
 
-	proxy.GrpcProxy.Serve(lis)
-	return nil
+	return server.Serve(lis)
+}
+
+// SetRetryPolicy sets the policy for retrying failed requests on other
+// clients. Requests are not retried if the policy is nil.
+func (proxy *GrpcProxy) SetRetryPolicy(policy *RetryPolicy) {
+	proxy.serverImpl.retryPolicy = policy
 }
 
 func (proxy *GrpcProxy) SetHealth(isHealthy bool) {
@@ -156,58 +303,76 @@ func (proxy *GrpcProxy) SetHealth(isHealthy bool) {
 	}
 }
 
-// Close stops the grpc proxy ser
+// Close stops the grpc proxy server after the pending requests have finished
 func (proxy *GrpcProxy) Close() error {
-	err := proxy.listener.Close()
-	proxy.GrpcProxy.GracefulStop()
-	return err
+	return proxy.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting new requests and waits for the pending requests to
+// finish. If ctx is done first, the pending requests are cancelled and the
+// context error is returned.
+func (proxy *GrpcProxy) Shutdown(ctx context.Context) error {
+	proxy.mux.Lock()
+	proxy.stopped = true
+	server := proxy.GrpcProxy
+	proxy.mux.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		<-stopped
+		return ctx.Err()
+	}
 }
 
 // proxyServiceServer implements the relevant TF serving grpc methods
 // and extracts model name and version and forwards the requests to a handler node
 type proxyServiceServer struct {
-	clientProvider func(modelName string, version string) (*grpc.ClientConn, error)
+	clientProvider  func(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error)
+	versionResolver VersionResolver
+	retryPolicy     *RetryPolicy
 }
 
 // Classify.
 func (server *proxyServiceServer) Classify(ctx context.Context, req *pb.ClassificationRequest) (*pb.ClassificationResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		log.WithError(err).Error("Could not get grpc client")
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Classify(ctx, req)
+	var res *pb.ClassificationResponse
+	err := server.invoke(ctx, req.GetModelSpec(), true, func(ctx context.Context, client *grpc.ClientConn) error {
+		var err error
+		res, err = pb.NewPredictionServiceClient(client).Classify(ctx, req)
+		return err
+	})
 	return res, err
 }
 
 // Regress.
 func (server *proxyServiceServer) Regress(ctx context.Context, req *pb.RegressionRequest) (*pb.RegressionResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Regress(ctx, req)
+	var res *pb.RegressionResponse
+	err := server.invoke(ctx, req.GetModelSpec(), true, func(ctx context.Context, client *grpc.ClientConn) error {
+		var err error
+		res, err = pb.NewPredictionServiceClient(client).Regress(ctx, req)
+		return err
+	})
 	return res, err
 }
 
 // Predict -- provides access to loaded TensorFlow model.
 func (server *proxyServiceServer) Predict(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Predict(ctx, req)
+	var res *pb.PredictResponse
+	err := server.invoke(ctx, req.GetModelSpec(), true, func(ctx context.Context, client *grpc.ClientConn) error {
+		var err error
+		res, err = pb.NewPredictionServiceClient(client).Predict(ctx, req)
+		return err
+	})
 	return res, err
 }
 
@@ -218,33 +383,77 @@ func (server *proxyServiceServer) MultiInference(ctx context.Context, req *pb.Mu
 
 // GetModelMetadata - provides access to metadata for loaded models.
 func (server *proxyServiceServer) GetModelMetadata(ctx context.Context, req *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.GetModelMetadata(ctx, req)
+	var res *pb.GetModelMetadataResponse
+	err := server.invoke(ctx, req.GetModelSpec(), true, func(ctx context.Context, client *grpc.ClientConn) error {
+		var err error
+		res, err = pb.NewPredictionServiceClient(client).GetModelMetadata(ctx, req)
+		return err
+	})
 	return res, err
 }
 
+// SessionRun is not retried, since the session may have side effects
 func (server *proxyServiceServer) SessionRun(ctx context.Context, req *pb.SessionRunRequest) (*pb.SessionRunResponse, error) {
+	var res *pb.SessionRunResponse
+	err := server.invoke(ctx, req.GetModelSpec(), false, func(ctx context.Context, client *grpc.ClientConn) error {
+		var err error
+		res, err = pb.NewSessionServiceClient(client).SessionRun(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// invoke calls the given function with the clients that can handle requests for the model.
+// Idempotent calls that fail with a retryable error are retried on the next client
+// according to the retry policy.
+func (server *proxyServiceServer) invoke(ctx context.Context, modelSpec *pb.ModelSpec, idempotent bool, call func(ctx context.Context, client *grpc.ClientConn) error) error {
 	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
+	clients, err := server.clientsForSpec(ctx, modelSpec)
+	if err == nil && len(clients) == 0 {
+		err = status.Error(codes.Unavailable, "No nodes available")
+	}
 	if err != nil {
 		log.WithError(err).Error("Could not get grpc client")
 		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
+		return err
+	}
+	server.retryPolicy.StartRequest()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := server.retryPolicy.AttemptContext(ctx)
+		err = call(attemptCtx, clients[attempt-1])
+		cancel()
+		if err == nil || !idempotent || attempt >= len(clients) || !isRetryableGrpcError(ctx, err) ||
+			!server.retryPolicy.AllowRetry(attempt, "grpc") {
+			return err
+		}
+		log.WithError(err).Warnf("Request for model %s failed. Retrying (attempt %d)", modelSpec.GetName(), attempt+1)
 	}
-	service := pb.NewSessionServiceClient(client)
-	res, err := service.SessionRun(ctx, req)
-	return res, err
 }
 
-func (server *proxyServiceServer) clientForSpec(modelSpec *pb.ModelSpec) (*grpc.ClientConn, error) {
+// clientsForSpec returns the clients that can handle requests for the given model, in the order they should be tried.
+// If the model spec does not specify a version, it is set to the latest version.
+// If it specifies a version label, it is set to the version of the label.
+func (server *proxyServiceServer) clientsForSpec(ctx context.Context, modelSpec *pb.ModelSpec) ([]*grpc.ClientConn, error) {
+	if modelSpec == nil {
+		return nil, status.Error(codes.InvalidArgument, "Model spec must be provided")
+	}
 	modelName := modelSpec.GetName()
+	if modelSpec.GetVersion() == nil {
+		if server.versionResolver == nil {
+			return nil, status.Error(codes.InvalidArgument, "Model version must be provided")
+		}
+		var version int64
+		var err error
+		if label := modelSpec.GetVersionLabel(); label != "" {
+			version, err = server.versionResolver.LabelVersion(modelName, label)
+		} else {
+			version, err = server.versionResolver.LatestVersion(modelName)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Could not resolve version of model: %s", modelName)
+		}
+		modelSpec.VersionChoice = &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}}
+	}
 	modelVersion := strconv.FormatInt(modelSpec.GetVersion().GetValue(), 10)
-	return server.clientProvider(modelName, modelVersion)
+	return server.clientProvider(ctx, modelName, modelVersion)
 }
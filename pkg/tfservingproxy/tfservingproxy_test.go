@@ -2,6 +2,7 @@ package tfservingproxy
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 	"testing"
@@ -23,7 +24,25 @@ type grpcMockServer struct {
 	modelServer *grpc.Server
 }
 
-func setupHttpTestCache(proxyCallback func(modelName string, version string), modelCallback func()) *httpMockServer {
+type versionResolverMock struct {
+	latestVersion int64
+}
+
+func (resolver *versionResolverMock) LatestVersion(modelName string) (int64, error) {
+	if modelName != "foobar" {
+		return 0, errors.New("Model not found")
+	}
+	return resolver.latestVersion, nil
+}
+
+func (resolver *versionResolverMock) LabelVersion(modelName string, label string) (int64, error) {
+	if modelName != "foobar" || label != "stable" {
+		return 0, errors.New("Label not found")
+	}
+	return 7, nil
+}
+
+func setupHttpTestCache(proxyCallback func(modelName string, version string), modelCallback func(), versionResolver VersionResolver) *httpMockServer {
 	handlerMock := func(req *http.Request, modelName string, version string) error {
 		proxyCallback(modelName, version)
 		req.URL.Path = "http://localhost:8089/foobar"
@@ -31,17 +50,13 @@ func setupHttpTestCache(proxyCallback func(modelName string, version string), mo
 		req.URL.Host = "localhost:8089"
 		return nil
 	}
-	proxy := NewRestProxy(handlerMock)
+	proxy := NewRestProxy(handlerMock, versionResolver)
 
 	proxyHandler := http.NewServeMux()
 	proxyHandler.HandleFunc("/", proxy.Serve())
 
 	proxyServer := &http.Server{Addr: ":8088", Handler: proxyHandler}
-	go func() {
-		if err := proxyServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("Err: %v", err)
-		}
-	}()
+	serveHttp(proxyServer)
 
 	modelServerHandler := http.NewServeMux()
 
@@ -49,11 +64,7 @@ func setupHttpTestCache(proxyCallback func(modelName string, version string), mo
 		modelCallback()
 	})
 	modelServer := &http.Server{Addr: ":8089", Handler: modelServerHandler}
-	go func() {
-		if err := modelServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("Err: %v", err)
-		}
-	}()
+	serveHttp(modelServer)
 
 	return &httpMockServer{
 		proxyServer,
@@ -61,12 +72,25 @@ func setupHttpTestCache(proxyCallback func(modelName string, version string), mo
 	}
 }
 
+// serveHttp starts listening before returning, such that requests can be sent right away
+func serveHttp(server *http.Server) {
+	lis, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Err: %v", err)
+	}
+	go func() {
+		if err := server.Serve(lis); err != http.ErrServerClosed {
+			log.Fatalf("Err: %v", err)
+		}
+	}()
+}
+
 func (m *httpMockServer) shutdown() {
 	m.proxyServer.Shutdown(context.TODO())
 	m.modelServer.Shutdown(context.TODO())
 }
 
-func setupGrpcTestCache(proxyCallback func(modelName string, version string), modelCallback func(modelName string, version int64)) *grpcMockServer {
+func setupGrpcTestCache(proxyCallback func(modelName string, version string), modelCallback func(modelName string, version int64), versionResolver VersionResolver) *grpcMockServer {
 
 	modelServer := grpc.NewServer()
 	lis, err := net.Listen("tcp", ":8891")
@@ -79,7 +103,7 @@ func setupGrpcTestCache(proxyCallback func(modelName string, version string), mo
 		modelServer.Serve(lis)
 	}()
 
-	handlerMock := func(modelName string, version string) (*grpc.ClientConn, error) {
+	handlerMock := func(ctx context.Context, modelName string, version string) ([]*grpc.ClientConn, error) {
 		proxyCallback(modelName, version)
 		// No connection exists - swap to write lock and connect
 		conn, err := grpc.Dial(":8891",
@@ -87,10 +111,10 @@ func setupGrpcTestCache(proxyCallback func(modelName string, version string), mo
 		if err != nil {
 			log.Fatalf("Err: %v", err)
 		}
-		return conn, err
+		return []*grpc.ClientConn{conn}, err
 	}
 
-	grpcProxy := NewGrpcProxy(handlerMock, 1024*1024*16)
+	grpcProxy := NewGrpcProxy(handlerMock, versionResolver, 1024*1024*16)
 	go func() {
 		if err := grpcProxy.Listen(8890); err != nil {
 			log.Fatalf("Err: %v", err)
@@ -123,7 +147,7 @@ func TestHttpProxyParsesUrl(t *testing.T) {
 	modelServerCallback := func() {
 		modelServerCalled = true
 	}
-	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback)
+	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback, nil)
 	_, err := http.Get("http://localhost:8088/v1/models/foobar/versions/42")
 	if err != nil {
 		log.Fatalln(err)
@@ -148,7 +172,7 @@ func TestHttpProxyInvalidUrlCausesErr(t *testing.T) {
 	modelServerCallback := func() {
 		modelServerCalled = true
 	}
-	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback)
+	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback, nil)
 	resp, err := http.Get("http://localhost:8088/v1/thisisabadrequest/foobar/versions/42")
 	if err != nil {
 		log.Fatalln(err)
@@ -178,7 +202,7 @@ func TestHttpProxyNoVersionCodeCausesErr(t *testing.T) {
 	modelServerCallback := func() {
 		modelServerCalled = true
 	}
-	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback)
+	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback, nil)
 	resp, err := http.Get("http://localhost:8088/v1/models/foobar")
 	if err != nil {
 		log.Fatalln(err)
@@ -220,7 +244,7 @@ func TestGrpcProxyParsesRequest(t *testing.T) {
 			t.Errorf("Wrong model version")
 		}
 	}
-	mockServer := setupGrpcTestCache(proxyCallback, modelServerCallback)
+	mockServer := setupGrpcTestCache(proxyCallback, modelServerCallback, nil)
 	sendGrpcModelRequest("foobar", 42)
 
 	mockServer.shutdown()
@@ -233,18 +257,164 @@ func TestGrpcProxyParsesRequest(t *testing.T) {
 	}
 }
 
+func TestHttpProxyNoVersionResolvesLatestVersion(t *testing.T) {
+	modelHandlerCalled := false
+	proxyCallback := func(modelName string, version string) {
+		modelHandlerCalled = true
+		if modelName != "foobar" {
+			t.Errorf("Wrong model name: %s", modelName)
+		}
+		if version != "42" {
+			t.Errorf("Wrong model version: %s", version)
+		}
+	}
+	modelServerCalled := false
+	modelServerCallback := func() {
+		modelServerCalled = true
+	}
+	mockServer := setupHttpTestCache(proxyCallback, modelServerCallback, &versionResolverMock{latestVersion: 42})
+	resp, err := http.Post("http://localhost:8088/v1/models/foobar:predict", "application/json", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mockServer.shutdown()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, but was %d", resp.StatusCode)
+	}
+	if !modelHandlerCalled {
+		t.Errorf("Model handler (proxy) not called")
+	}
+	if !modelServerCalled {
+		t.Errorf("Model server not called")
+	}
+}
+
+func TestHttpProxyUnknownModelCausesErr(t *testing.T) {
+	modelHandlerCalled := false
+	proxyCallback := func(modelName string, version string) {
+		modelHandlerCalled = true
+	}
+	mockServer := setupHttpTestCache(proxyCallback, func() {}, &versionResolverMock{latestVersion: 42})
+	resp, err := http.Get("http://localhost:8088/v1/models/unknown")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mockServer.shutdown()
+
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected status code 404 when version cannot be resolved")
+	}
+	if modelHandlerCalled {
+		t.Errorf("Model handler (proxy) called for unknown model")
+	}
+}
+
+func TestSetRestURLVersion(t *testing.T) {
+	paths := map[string]string{
+		"/v1/models/foobar":          "/v1/models/foobar/versions/42",
+		"/v1/models/foobar:predict":  "/v1/models/foobar/versions/42:predict",
+		"/v1/models/foobar/metadata": "/v1/models/foobar/versions/42/metadata",
+		"/V1/Models/foobar:classify": "/V1/Models/foobar/versions/42:classify",
+	}
+	for path, expected := range paths {
+		req, _ := http.NewRequest("POST", "http://localhost"+path, nil)
+		setRestURLVersion(req, "42")
+		if req.URL.Path != expected {
+			t.Errorf("Expected path '%s' but was '%s'", expected, req.URL.Path)
+		}
+	}
+}
+
+func TestHttpProxyVersionLabelResolvesVersion(t *testing.T) {
+	modelHandlerCalled := false
+	proxyCallback := func(modelName string, version string) {
+		modelHandlerCalled = true
+		if version != "7" {
+			t.Errorf("Wrong model version: %s", version)
+		}
+	}
+	mockServer := setupHttpTestCache(proxyCallback, func() {}, &versionResolverMock{latestVersion: 42})
+	resp, err := http.Post("http://localhost:8088/v1/models/foobar/labels/stable:predict", "application/json", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	unknownResp, err := http.Post("http://localhost:8088/v1/models/foobar/labels/unknown:predict", "application/json", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mockServer.shutdown()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, but was %d", resp.StatusCode)
+	}
+	if !modelHandlerCalled {
+		t.Errorf("Model handler (proxy) not called")
+	}
+	if unknownResp.StatusCode != 404 {
+		t.Errorf("Expected status code 404 for unknown label, but was %d", unknownResp.StatusCode)
+	}
+}
+
+func TestGrpcProxyVersionLabelResolvesVersion(t *testing.T) {
+	modelServerCalled := false
+	modelServerCallback := func(modelName string, version int64) {
+		modelServerCalled = true
+		if version != 7 {
+			t.Errorf("Wrong model version in model server: %d", version)
+		}
+	}
+	mockServer := setupGrpcTestCache(func(string, string) {}, modelServerCallback, &versionResolverMock{latestVersion: 42})
+	sendGrpcRequest(&pb.ModelSpec{Name: "foobar", VersionChoice: &pb.ModelSpec_VersionLabel{VersionLabel: "stable"}})
+
+	mockServer.shutdown()
+	if !modelServerCalled {
+		t.Errorf("Model server not called")
+	}
+}
+
+func TestGrpcProxyNoVersionResolvesLatestVersion(t *testing.T) {
+	proxyCallback := func(modelName string, version string) {
+		if version != "42" {
+			t.Errorf("Wrong model version in proxy: %s", version)
+		}
+	}
+	modelServerCalled := false
+	modelServerCallback := func(modelName string, version int64) {
+		modelServerCalled = true
+		if version != 42 {
+			t.Errorf("Wrong model version in model server: %d", version)
+		}
+	}
+	mockServer := setupGrpcTestCache(proxyCallback, modelServerCallback, &versionResolverMock{latestVersion: 42})
+	sendGrpcRequest(&pb.ModelSpec{Name: "foobar"})
+
+	mockServer.shutdown()
+	if !modelServerCalled {
+		t.Errorf("Model server not called")
+	}
+}
+
 func sendGrpcModelRequest(modelName string, version int64) {
+	sendGrpcRequest(&pb.ModelSpec{
+		Name:          modelName,
+		VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}},
+	})
+}
+
+func sendGrpcRequest(modelSpec *pb.ModelSpec) {
 	conn, err := grpc.Dial(":8890", grpc.WithInsecure())
 	if err != nil {
 		log.WithError(err).Panic("Error")
 	}
+	defer conn.Close()
 	service := pb.NewPredictionServiceClient(conn)
 	_, err = service.Classify(context.Background(),
 		&pb.ClassificationRequest{
-			ModelSpec: &pb.ModelSpec{
-				Name:          modelName,
-				VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}},
-			},
+			ModelSpec: modelSpec,
 			Input: &pb.Input{
 				Kind: &pb.Input_ExampleList{
 					ExampleList: &pb.ExampleList{
@@ -256,7 +426,7 @@ func sendGrpcModelRequest(modelName string, version int64) {
 					},
 				},
 			},
-		})
+		}, grpc.WaitForReady(true))
 
 	if err != nil {
 		log.WithError(err).Panicf("Error classifying")
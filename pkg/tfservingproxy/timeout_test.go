@@ -0,0 +1,136 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// setupRestTimeoutTest creates a REST proxy in front of a model server that
+// responds after headerDelay and sends the rest of the body after bodyDelay
+func setupRestTimeoutTest(timeouts RestTimeouts, handlerErr error, headerDelay time.Duration, bodyDelay time.Duration) (*httptest.Server, func()) {
+	done := make(chan struct{})
+	modelServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(headerDelay):
+		case <-done:
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("{"))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-time.After(bodyDelay):
+		case <-done:
+			return
+		}
+		rw.Write([]byte("}"))
+	}))
+	modelURL, _ := url.Parse(modelServer.URL)
+	proxy := NewRestProxy(func(req *http.Request, modelName string, version string) error {
+		if handlerErr != nil {
+			return handlerErr
+		}
+		req.URL.Scheme = modelURL.Scheme
+		req.URL.Host = modelURL.Host
+		return nil
+	}, nil)
+	proxy.SetTimeouts(timeouts)
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxy.Serve()))
+	return proxyServer, func() {
+		close(done)
+		proxyServer.Close()
+		modelServer.Close()
+	}
+}
+
+func assertRestError(t *testing.T, resp *http.Response, statusCode int) {
+	if resp.StatusCode != statusCode {
+		t.Errorf("Expected status code %d, but was %d", statusCode, resp.StatusCode)
+	}
+	var body struct {
+		Status  string
+		Message string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Errorf("Expected JSON error body: %v", err)
+	}
+	if body.Status != "Error" {
+		t.Errorf("Expected status 'Error', but was '%s'", body.Status)
+	}
+}
+
+func TestHttpProxyRequestTimeout(t *testing.T) {
+	proxyServer, cleanup := setupRestTimeoutTest(RestTimeouts{Request: 100 * time.Millisecond}, nil, time.Second, 0)
+	defer cleanup()
+
+	resp, err := http.Post(proxyServer.URL+"/v1/models/foobar/versions/1:predict", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	assertRestError(t, resp, http.StatusGatewayTimeout)
+}
+
+func TestHttpProxyResponseHeaderTimeout(t *testing.T) {
+	proxyServer, cleanup := setupRestTimeoutTest(RestTimeouts{ResponseHeader: 100 * time.Millisecond}, nil, time.Second, 0)
+	defer cleanup()
+
+	resp, err := http.Post(proxyServer.URL+"/v1/models/foobar/versions/1:predict", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	assertRestError(t, resp, http.StatusGatewayTimeout)
+}
+
+func TestHttpProxyBodyTimeout(t *testing.T) {
+	proxyServer, cleanup := setupRestTimeoutTest(RestTimeouts{Body: 100 * time.Millisecond}, nil, 0, time.Second)
+	defer cleanup()
+
+	start := time.Now()
+	resp, err := http.Post(proxyServer.URL+"/v1/models/foobar/versions/1:predict", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && string(body) == "{}" {
+		t.Errorf("Expected response body to be cut off by the body timeout")
+	}
+	if time.Since(start) >= time.Second {
+		t.Errorf("Expected body timeout to stop the request before the model server responded")
+	}
+}
+
+func TestHttpProxyHandlerTimeoutCauses504(t *testing.T) {
+	handlerErr := fmt.Errorf("Model did not load in time: %w", context.DeadlineExceeded)
+	proxyServer, cleanup := setupRestTimeoutTest(RestTimeouts{}, handlerErr, 0, 0)
+	defer cleanup()
+
+	resp, err := http.Post(proxyServer.URL+"/v1/models/foobar/versions/1:predict", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	assertRestError(t, resp, http.StatusGatewayTimeout)
+}
+
+func TestHttpProxyHandlerErrorCauses502(t *testing.T) {
+	proxyServer, cleanup := setupRestTimeoutTest(RestTimeouts{}, errors.New("Could not fetch model"), 0, 0)
+	defer cleanup()
+
+	resp, err := http.Post(proxyServer.URL+"/v1/models/foobar/versions/1:predict", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	assertRestError(t, resp, http.StatusBadGateway)
+}